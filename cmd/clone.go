@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/anastop/virgo/pkg/virgo"
+
+	"github.com/spf13/cobra"
+)
+
+var cloneCmd = &cobra.Command{
+	Use:   "clone <source> <new>",
+	Short: "Clone a provisioned VM into one or more new VMs",
+	Long: `Clone a provisioned, shut off VM into one or more new VMs, which are launched with the
+same options as the source VM but for their name, their fresh MAC addresses, and their CPU
+pins: explicit pins are dropped so that clones don't share the source VM's cores, and auto
+pins are picked anew. With --count N, the clones are called <new>-1 to <new>-N.
+
+Clones are linked by default, i.e. their root images are qcow2 overlays on the source VM's,
+which should then be neither started nor re-provisioned while they exist, and can't be
+purged before them. With --full, each
+clone gets a copy of the source VM's root image instead.
+
+Each clone gets a fresh cloud-init config image setting its hostname and a new instance-id
+and machine-id, which take effect if the source VM was provisioned with "keep_cloud_init".`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		source, name := args[0], args[1]
+
+		count, err := cmd.Flags().GetInt("count")
+		if err != nil {
+			return fmt.Errorf("failed to parse count argument: %v", err)
+		}
+		if count < 1 {
+			return fmt.Errorf("count should be at least 1, got %d", count)
+		}
+
+		full, err := cmd.Flags().GetBool("full")
+		if err != nil {
+			return fmt.Errorf("failed to parse full argument: %v", err)
+		}
+
+		l, err := virgo.NewLibvirtConn(connectURI)
+		if err != nil {
+			return fmt.Errorf("failed to open Libvirt connection: %v", err)
+		}
+		defer func() {
+			if err := l.Disconnect(); err != nil {
+				log.Fatalf("failed to disconnect from Libvirt: %v", err)
+			}
+		}()
+
+		for _, clone := range virgo.CloneNames(name, count) {
+			if err := virgo.Clone(l, source, clone, full); err != nil {
+				return fmt.Errorf("failed to clone %s into %s: %v", source, clone, err)
+			}
+		}
+		return nil
+	},
+}
+
+func init() {
+	cloneCmd.Flags().IntP("count", "n", 1, "number of clones to create")
+	cloneCmd.Flags().Bool("full", false, "copy the source VM's root image, instead of overlaying it")
+	rootCmd.AddCommand(cloneCmd)
+}
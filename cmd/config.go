@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/anastop/virgo/pkg/virgo"
+
+	"github.com/spf13/cobra"
+)
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect config files",
+	Long: `Inspect config files.
+
+A config file may extend other config files, or named profiles in ~/.config/virgo/profiles
+(or $XDG_CONFIG_HOME/virgo/profiles), with its "extends" option: a path, relative to the
+config file, or a profile name, or a list of them. The options of the extended configs are
+merged in the order they're listed and then overridden by the config's own; nested options
+are merged, while lists are replaced as a whole. Any option can then be overridden on the
+command line with --set, e.g. --set guest_num_vcpus=16.`,
+}
+
+var configRenderCmd = &cobra.Command{
+	Use:   "render",
+	Short: "Print the effective config",
+	Long: `Print the effective config, i.e. that of the given config file merged over the configs and
+profiles it extends, with the --set overrides applied and defaults filled in.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := cmd.Flags().GetString("config")
+		if err != nil {
+			return fmt.Errorf("failed to parse config argument: %v", err)
+		}
+
+		sets, err := cmd.Flags().GetStringArray("set")
+		if err != nil {
+			return fmt.Errorf("failed to parse set argument: %v", err)
+		}
+
+		output, err := cmd.Flags().GetString("output")
+		if err != nil {
+			return fmt.Errorf("failed to parse output argument: %v", err)
+		}
+
+		pc, gc, err := virgo.LoadConf(conf, sets)
+		if err != nil {
+			return err
+		}
+
+		data, err := virgo.RenderConf(pc, gc, output)
+		if err != nil {
+			return err
+		}
+
+		if _, err := os.Stdout.Write(data); err != nil {
+			return fmt.Errorf("failed to print config: %v", err)
+		}
+		return nil
+	},
+}
+
+func init() {
+	configRenderCmd.Flags().StringP("config", "c", "", "config file (JSON, YAML or TOML)")
+	configRenderCmd.Flags().StringArray("set", nil, "override a config option, e.g. --set guest_num_vcpus=16 (repeatable)")
+	configRenderCmd.Flags().StringP("output", "o", "yaml", "output format: json, yaml or toml")
+	configRenderCmd.MarkFlagRequired("config")
+
+	configCmd.AddCommand(configRenderCmd)
+	rootCmd.AddCommand(configCmd)
+}
@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/anastop/virgo/pkg/virgo"
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/spf13/cobra"
+)
+
+var consoleCmd = &cobra.Command{
+	Use:   "console",
+	Short: "Attach to the serial console of a running VM",
+	Long: `Attach the terminal to the serial console of a running VM, e.g. to log in to a VM whose
+network is down. Press Ctrl-] to detach.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		guest := args[0]
+
+		l, err := virgo.NewLibvirtConn(connectURI)
+		if err != nil {
+			return fmt.Errorf("failed to open Libvirt connection: %v", err)
+		}
+		defer func() {
+			if err := l.Disconnect(); err != nil {
+				log.Fatalf("failed to disconnect from Libvirt: %v", err)
+			}
+		}()
+
+		fd := int(os.Stdin.Fd())
+		if terminal.IsTerminal(fd) {
+			state, err := terminal.MakeRaw(fd)
+			if err != nil {
+				return fmt.Errorf("failed to put terminal into raw mode: %v", err)
+			}
+			defer terminal.Restore(fd, state)
+		}
+
+		fmt.Printf("Connected to %s\r\nEscape character is ^]\r\n", guest)
+		if err := virgo.Console(l, connectURI, guest, os.Stdin, os.Stdout); err != nil {
+			return fmt.Errorf("console of %s failed: %v", guest, err)
+		}
+		fmt.Print("\r\n")
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(consoleCmd)
+}
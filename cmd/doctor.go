@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/anastop/virgo/pkg/virgo"
+
+	"github.com/spf13/cobra"
+)
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check that the host is ready to run VMs",
+	Long: `Check that the host is ready to run VMs, and print a pass/fail report: KVM support and
+the emulator, and with a config file (-c), the binaries needed for provisioning, free space
+in the storage pool for root_img_gb, free hugepages of the configured size on the host NUMA
+nodes the VM's memory is bound to, bridges, and vhostuser socket directories (on local
+hosts only).
+
+The same checks run before provisioning and launching VMs, which fail early if any of
+them fails.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := cmd.Flags().GetString("config")
+		if err != nil {
+			return fmt.Errorf("failed to parse config argument: %v", err)
+		}
+
+		sets, err := cmd.Flags().GetStringArray("set")
+		if err != nil {
+			return fmt.Errorf("failed to parse set argument: %v", err)
+		}
+
+		output, err := cmd.Flags().GetString("output")
+		if err != nil {
+			return fmt.Errorf("failed to parse output argument: %v", err)
+		}
+
+		var pc *virgo.ProvisionConf
+		var gc *virgo.GuestConf
+		if conf != "" {
+			if pc, gc, err = virgo.LoadConf(conf, sets); err != nil {
+				return err
+			}
+		}
+
+		l, err := virgo.NewLibvirtConn(connectURI)
+		if err != nil {
+			return fmt.Errorf("failed to open Libvirt connection: %v", err)
+		}
+		defer func() {
+			if err := l.Disconnect(); err != nil {
+				log.Fatalf("failed to disconnect from Libvirt: %v", err)
+			}
+		}()
+
+		checks := virgo.Preflight(l, pc, gc)
+		if err := printChecks(os.Stdout, checks, output); err != nil {
+			return err
+		}
+
+		if err, ok := virgo.PreflightErr(checks).(*virgo.PreflightError); ok {
+			return fmt.Errorf("%d of %d checks failed", len(err.Failed), len(checks))
+		}
+		return nil
+	},
+}
+
+// printChecks prints checks as a table, or as JSON if output is "json".
+func printChecks(w io.Writer, checks []virgo.Check, output string) error {
+	switch output {
+	case "json":
+		return printJSON(w, checks)
+	case "table":
+	default:
+		return fmt.Errorf("unsupported output format %q, expected table or json", output)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATUS\tCHECK\tDETAIL")
+	for _, c := range checks {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", strings.ToUpper(c.Status), c.Name, c.Detail)
+	}
+	return tw.Flush()
+}
+
+func init() {
+	doctorCmd.Flags().StringP("config", "c", "", "config file (JSON, YAML or TOML) of the VM to check the host for")
+	doctorCmd.Flags().StringArray("set", nil, "override a config option, e.g. --set guest_num_vcpus=16 (repeatable)")
+	doctorCmd.Flags().StringP("output", "o", "table", "output format: table or json")
+	rootCmd.AddCommand(doctorCmd)
+}
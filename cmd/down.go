@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/anastop/virgo/pkg/virgo"
+
+	"github.com/spf13/cobra"
+)
+
+var downCmd = &cobra.Command{
+	Use:   "down",
+	Short: "Purge the VMs of a topology file",
+	Long: `Purge the VMs of a topology file, i.e. undefine them and remove their images, in reverse
+dependency order, up to --parallel at a time. VMs that don't exist are skipped. The networks
+of the topology are deleted once all its VMs are purged.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		file, err := cmd.Flags().GetString("file")
+		if err != nil {
+			return fmt.Errorf("failed to parse file argument: %v", err)
+		}
+
+		parallel, err := cmd.Flags().GetInt("parallel")
+		if err != nil {
+			return fmt.Errorf("failed to parse parallel argument: %v", err)
+		}
+
+		topo, err := virgo.LoadTopology(file)
+		if err != nil {
+			return err
+		}
+
+		l, err := virgo.NewLibvirtConn(connectURI)
+		if err != nil {
+			return fmt.Errorf("failed to open Libvirt connection: %v", err)
+		}
+		defer func() {
+			if err := l.Disconnect(); err != nil {
+				log.Fatalf("failed to disconnect from Libvirt: %v", err)
+			}
+		}()
+
+		if err := virgo.Down(l, topo, parallel, os.Stderr); err != nil {
+			return fmt.Errorf("failed to bring down topology %s: %v", file, err)
+		}
+		return nil
+	},
+}
+
+func init() {
+	downCmd.Flags().StringP("file", "f", "virgo-topology.json", "topology file")
+	downCmd.Flags().IntP("parallel", "j", 4, "maximum number of VMs to purge at a time")
+	rootCmd.AddCommand(downCmd)
+}
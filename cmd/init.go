@@ -8,19 +8,160 @@ import (
 	"github.com/spf13/cobra"
 )
 
+var sampleConfigYAML = `# yaml-language-server: $schema=https://raw.githubusercontent.com/anastop/virgo/master/virgo.schema.json
+
+# Provisioning options
+
+cloud_img_url: https://cloud-images.ubuntu.com/releases/18.04/release/
+cloud_img_name: ubuntu-18.04-server-cloudimg-amd64.img
+user: guest
+passwd: guest
+root_img_gb: 10
+# cloud images are cached in /var/cache/virgo as root, ~/.cache/virgo otherwise
+# img_cache_dir: /srv/virgo/cache
+storage_pool: default
+# public keys, or paths to public key files (default: ~/.ssh/id_*.pub)
+# ssh_authorized_keys:
+#   - ~/.ssh/id_ed25519.pub
+disable_passwd_auth: false
+# keep cloud-init in the image, for clones to get their own hostname and identity
+keep_cloud_init: false
+
+# Launch options
+
+guest_memory_mb: 4096
+# vCPUs should equal sockets x cores x threads
+guest_num_vcpus: 8
+guest_num_sockets: 2
+guest_num_cores_per_socket: 2
+guest_num_threads_per_core: 2
+# every vCPU in exactly one node, and the nodes' memory adding up to guest_memory_mb
+guest_numa_nodes:
+  - {id: 0, cpus: 0-3, memory_mb: 2048}
+  - {id: 1, cpus: 4-7, memory_mb: 2048}
+# hugepages are 2M or 1G on x86_64
+guest_hugepage_support: true
+guest_hugepage_size: 2
+guest_hugepage_size_unit: M
+guest_hugepage_node_set: "0"
+guest_net_ifs:
+  # management interfaces
+  - type: bridge
+    bridge: virbr0
+  - type: bridge
+    bridge: virbr0
+  # data plane interfaces, attached to the ports of a DPDK-based vswitch
+  - type: vhostuser
+    mac_addr: de:ad:be:ef:01:23
+    unix_socket_path: /usr/local/var/run/openvswitch/dpdkvhostuser1
+    queues: 2
+  - type: vhostuser
+    mac_addr: de:ad:be:ef:45:67
+    unix_socket_path: /usr/local/var/run/openvswitch/dpdkvhostuser2
+    queues: 2
+# log the serial console, see "virgo logs"
+guest_serial_log: true
+# defaults to <name>.virgo.log in the storage pool's directory
+# guest_serial_log_path: /var/log/virgo/guest.log
+`
+
+var sampleConfigTOML = `# Provisioning options
+
+cloud_img_url = "https://cloud-images.ubuntu.com/releases/18.04/release/"
+cloud_img_name = "ubuntu-18.04-server-cloudimg-amd64.img"
+user = "guest"
+passwd = "guest"
+root_img_gb = 10
+# cloud images are cached in /var/cache/virgo as root, ~/.cache/virgo otherwise
+# img_cache_dir = "/srv/virgo/cache"
+storage_pool = "default"
+# public keys, or paths to public key files (default: ~/.ssh/id_*.pub)
+# ssh_authorized_keys = ["~/.ssh/id_ed25519.pub"]
+disable_passwd_auth = false
+# keep cloud-init in the image, for clones to get their own hostname and identity
+keep_cloud_init = false
+
+# Launch options
+
+guest_memory_mb = 4096
+# vCPUs should equal sockets x cores x threads
+guest_num_vcpus = 8
+guest_num_sockets = 2
+guest_num_cores_per_socket = 2
+guest_num_threads_per_core = 2
+# hugepages are 2M or 1G on x86_64
+guest_hugepage_support = true
+guest_hugepage_size = 2
+guest_hugepage_size_unit = "M"
+guest_hugepage_node_set = "0"
+# log the serial console, see "virgo logs"
+guest_serial_log = true
+# defaults to <name>.virgo.log in the storage pool's directory
+# guest_serial_log_path = "/var/log/virgo/guest.log"
+
+# every vCPU in exactly one node, and the nodes' memory adding up to guest_memory_mb
+[[guest_numa_nodes]]
+id = 0
+cpus = "0-3"
+memory_mb = 2048
+
+[[guest_numa_nodes]]
+id = 1
+cpus = "4-7"
+memory_mb = 2048
+
+# management interfaces
+[[guest_net_ifs]]
+type = "bridge"
+bridge = "virbr0"
+
+[[guest_net_ifs]]
+type = "bridge"
+bridge = "virbr0"
+
+# data plane interfaces, attached to the ports of a DPDK-based vswitch
+[[guest_net_ifs]]
+type = "vhostuser"
+mac_addr = "de:ad:be:ef:01:23"
+unix_socket_path = "/usr/local/var/run/openvswitch/dpdkvhostuser1"
+queues = 2
+
+[[guest_net_ifs]]
+type = "vhostuser"
+mac_addr = "de:ad:be:ef:45:67"
+unix_socket_path = "/usr/local/var/run/openvswitch/dpdkvhostuser2"
+queues = 2
+`
+
 // initCmd represents the init command
 var initCmd = &cobra.Command{
 	Use:   "init",
 	Short: "Create sample configuration files and scripts",
-	Long:  `Create sample configuration files and scripts.`,
+	Long: `Create sample configuration files and scripts. The config file is written as JSON, or
+with --format as YAML or TOML, which allow comments. Config files of any format are
+recognized by their extension (.json, .yaml or .yml, .toml).`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		configFile := "virgo.json"
+		format, err := cmd.Flags().GetString("format")
+		if err != nil {
+			return fmt.Errorf("failed to parse format argument: %v", err)
+		}
+
+		samples := map[string]string{
+			"json": sampleConfig,
+			"yaml": sampleConfigYAML,
+			"toml": sampleConfigTOML,
+		}
+		sample, ok := samples[format]
+		if !ok {
+			return fmt.Errorf("unsupported format %q, expected json, yaml or toml", format)
+		}
+		configFile := "virgo." + format
 
 		if _, err := os.Stat(configFile); err == nil {
 			return fmt.Errorf("file %s already exists", configFile)
 		}
 
-		err := ioutil.WriteFile(configFile, []byte(sampleConfig), 0644)
+		err = ioutil.WriteFile(configFile, []byte(sample), 0644)
 		if err != nil {
 			return fmt.Errorf("failed to create %s: %v", configFile, err)
 		}
@@ -30,5 +171,6 @@ var initCmd = &cobra.Command{
 }
 
 func init() {
+	initCmd.Flags().String("format", "json", "format of the config file: json, yaml or toml")
 	rootCmd.AddCommand(initCmd)
 }
@@ -1,11 +1,9 @@
 package cmd
 
 import (
-	"encoding/json"
 	"fmt"
 	"github.com/anastop/virgo/pkg/virgo"
 	"github.com/spf13/cobra"
-	"io/ioutil"
 	"log"
 )
 
@@ -27,18 +25,30 @@ The available launch options are presented in detail in virgo's main help messag
 			return fmt.Errorf("failed to parse config argument: %v", err)
 		}
 
-		data, err := ioutil.ReadFile(conf)
+		sets, err := cmd.Flags().GetStringArray("set")
 		if err != nil {
-			return fmt.Errorf("failed to read config file %s: %v", conf, err)
+			return fmt.Errorf("failed to parse set argument: %v", err)
 		}
 
-		gc := &virgo.GuestConf{}
-		if err := json.Unmarshal(data, gc); err != nil {
-			return fmt.Errorf("failed to unmarshal guest config: %v", err)
+		_, gc, err := virgo.LoadConf(conf, sets)
+		if err != nil {
+			return err
 		}
 		gc.Name = guest
 
-		l, err := virgo.NewLibvirtConn()
+		if err := validateConf(conf, nil, gc); err != nil {
+			return err
+		}
+
+		pool, err := cmd.Flags().GetString("pool")
+		if err != nil {
+			return fmt.Errorf("failed to parse pool argument: %v", err)
+		}
+		if pool != "" {
+			gc.StoragePool = pool
+		}
+
+		l, err := virgo.NewLibvirtConn(connectURI)
 		if err != nil {
 			return fmt.Errorf("failed to open Libvirt connection: %v", err)
 		}
@@ -48,7 +58,7 @@ The available launch options are presented in detail in virgo's main help messag
 			}
 		}()
 
-		gc.RootImgPath, gc.ConfigIsoPath, err = virgo.GuestImagePaths(l, virgo.DefaultPool(), guest)
+		gc.RootImgPath, gc.ConfigIsoPath, err = virgo.GuestImagePaths(l, virgo.PoolName(gc.StoragePool), guest)
 		if err != nil {
 			return fmt.Errorf("failed to compute image paths for %s: %v", guest, err)
 		}
@@ -62,6 +72,8 @@ The available launch options are presented in detail in virgo's main help messag
 }
 
 func init() {
-	launchCmd.Flags().StringP("config", "c", "", "JSON file containing the launch options")
+	launchCmd.Flags().StringP("config", "c", "", "config file (JSON, YAML or TOML) containing the launch options")
+	launchCmd.Flags().StringArray("set", nil, "override a config option, e.g. --set guest_num_vcpus=16 (repeatable)")
+	launchCmd.Flags().String("pool", "", "storage pool of the VM's image, overriding storage_pool")
 	rootCmd.AddCommand(launchCmd)
 }
@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/anastop/virgo/pkg/virgo"
+
+	"github.com/spf13/cobra"
+)
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the VMs created by virgo",
+	Long: `List the VMs created by virgo, along with their state, vCPUs, memory, IP addresses
+and root image size, and whether their volumes exist in the storage pool.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		output, err := cmd.Flags().GetString("output")
+		if err != nil {
+			return fmt.Errorf("failed to parse output argument: %v", err)
+		}
+
+		l, err := virgo.NewLibvirtConn(connectURI)
+		if err != nil {
+			return fmt.Errorf("failed to open Libvirt connection: %v", err)
+		}
+		defer func() {
+			if err := l.Disconnect(); err != nil {
+				log.Fatalf("failed to disconnect from Libvirt: %v", err)
+			}
+		}()
+
+		guests, err := virgo.List(l)
+		if err != nil {
+			return fmt.Errorf("failed to list guests: %v", err)
+		}
+		for _, g := range guests {
+			if g.Error != "" {
+				fmt.Fprintf(os.Stderr, "warning: failed to get status of %s: %s\n", g.Name, g.Error)
+			}
+		}
+
+		if guests == nil {
+			guests = []virgo.GuestStatus{}
+		}
+		return printGuests(os.Stdout, guests, output)
+	},
+}
+
+func printJSON(w io.Writer, v interface{}) error {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal output: %v", err)
+	}
+	_, err = fmt.Fprintln(w, string(out))
+	return err
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// printGuests prints guests as a table, or as JSON if output is "json".
+func printGuests(w io.Writer, guests []virgo.GuestStatus, output string) error {
+	switch output {
+	case "json":
+		return printJSON(w, guests)
+	case "table":
+	default:
+		return fmt.Errorf("unsupported output format %q, expected table or json", output)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSTATE\tVCPUS\tMEMORY\tIP ADDRESSES\tROOT IMAGE\tVOLUMES")
+	for _, g := range guests {
+		ips := strings.Join(g.IPAddrs, ",")
+		if ips == "" {
+			ips = "-"
+		}
+
+		root := "-"
+		if g.RootImgExists {
+			root = fmt.Sprintf("%.1f/%.1f GiB", float64(g.RootImgAllocation)/(1<<30), float64(g.RootImgCapacity)/(1<<30))
+		}
+
+		vols := fmt.Sprintf("root:%s iso:%s", yesNo(g.RootImgExists), yesNo(g.ConfigIsoExists))
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d MiB\t%s\t%s\t%s\n", g.Name, g.State, g.NumVcpus, g.MemoryMB, ips, root, vols)
+	}
+	return tw.Flush()
+}
+
+func init() {
+	listCmd.Flags().StringP("output", "o", "table", "output format: table or json")
+	rootCmd.AddCommand(listCmd)
+}
@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/anastop/virgo/pkg/virgo"
+
+	"github.com/spf13/cobra"
+)
+
+var logsCmd = &cobra.Command{
+	Use:   "logs",
+	Short: "Print the serial console log of a VM",
+	Long: `Print the serial console log of a VM, e.g. to debug a failing provision script.
+The VM should have been launched with "guest_serial_log" enabled, and the log file is
+read locally, so the command must run on the hypervisor.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		guest := args[0]
+
+		follow, err := cmd.Flags().GetBool("follow")
+		if err != nil {
+			return fmt.Errorf("failed to parse follow argument: %v", err)
+		}
+
+		l, err := virgo.NewLibvirtConn(connectURI)
+		if err != nil {
+			return fmt.Errorf("failed to open Libvirt connection: %v", err)
+		}
+		defer func() {
+			if err := l.Disconnect(); err != nil {
+				log.Fatalf("failed to disconnect from Libvirt: %v", err)
+			}
+		}()
+
+		path, err := virgo.GuestSerialLogPath(l, guest)
+		if err != nil {
+			return fmt.Errorf("failed to find serial console log of %s: %v", guest, err)
+		}
+
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt)
+		stop := make(chan struct{})
+		go func() {
+			<-sig
+			close(stop)
+		}()
+
+		if err := virgo.TailFile(path, os.Stdout, follow, stop); err != nil {
+			return fmt.Errorf("failed to print serial console log of %s: %v", guest, err)
+		}
+		return nil
+	},
+}
+
+func init() {
+	logsCmd.Flags().BoolP("follow", "f", false, "keep printing the log as it grows")
+	rootCmd.AddCommand(logsCmd)
+}
@@ -0,0 +1,208 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/anastop/virgo/pkg/virgo"
+
+	"github.com/spf13/cobra"
+)
+
+var netCmd = &cobra.Command{
+	Use:   "net",
+	Short: "Manage libvirt networks",
+	Long: `Manage the libvirt networks that VMs' network interfaces of type "network" refer to.
+Networks are NAT'ed to the host's uplinks (nat), routed without NAT (route), or only
+connect the VMs on them with each other and the host (isolated). Only networks created by
+virgo can be deleted with it.`,
+}
+
+// parseDHCPHost parses a static DHCP entry of the form MAC,IP[,NAME].
+func parseDHCPHost(s string) (virgo.DHCPHost, error) {
+	f := strings.Split(s, ",")
+	if len(f) < 2 || len(f) > 3 {
+		return virgo.DHCPHost{}, fmt.Errorf("invalid DHCP host %q, expected MAC,IP[,NAME]", s)
+	}
+	h := virgo.DHCPHost{MacAddr: f[0], IP: f[1]}
+	if len(f) == 3 {
+		h.Name = f[2]
+	}
+	return h, nil
+}
+
+var netCreateCmd = &cobra.Command{
+	Use:   "create <name>",
+	Short: "Create a network",
+	Long: `Create a network, and start it along with the host. The host gets the network's --address,
+e.g. 192.168.100.1/24, which nat and route networks require. DHCP hands out the addresses
+of --dhcp-range, and those of the --host entries to the VM interfaces with their MAC
+address, e.g. --host 52:54:00:00:00:10,192.168.100.10,vm1.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		n := &virgo.NetworkConf{Name: args[0]}
+
+		var err error
+		if n.Mode, err = cmd.Flags().GetString("mode"); err != nil {
+			return fmt.Errorf("failed to parse mode argument: %v", err)
+		}
+		if n.Bridge, err = cmd.Flags().GetString("bridge"); err != nil {
+			return fmt.Errorf("failed to parse bridge argument: %v", err)
+		}
+		if n.Address, err = cmd.Flags().GetString("address"); err != nil {
+			return fmt.Errorf("failed to parse address argument: %v", err)
+		}
+		if n.ForwardDev, err = cmd.Flags().GetString("forward-dev"); err != nil {
+			return fmt.Errorf("failed to parse forward-dev argument: %v", err)
+		}
+		if n.DHCPRange, err = cmd.Flags().GetString("dhcp-range"); err != nil {
+			return fmt.Errorf("failed to parse dhcp-range argument: %v", err)
+		}
+
+		hosts, err := cmd.Flags().GetStringArray("host")
+		if err != nil {
+			return fmt.Errorf("failed to parse host argument: %v", err)
+		}
+		for _, s := range hosts {
+			h, err := parseDHCPHost(s)
+			if err != nil {
+				return err
+			}
+			n.DHCPHosts = append(n.DHCPHosts, h)
+		}
+
+		if err, ok := n.Validate().(*virgo.ConfError); ok {
+			return fmt.Errorf("invalid network %s:\n  - %s", n.Name, strings.Join(err.Problems, "\n  - "))
+		}
+
+		l, err := virgo.NewLibvirtConn(connectURI)
+		if err != nil {
+			return fmt.Errorf("failed to open Libvirt connection: %v", err)
+		}
+		defer func() {
+			if err := l.Disconnect(); err != nil {
+				log.Fatalf("failed to disconnect from Libvirt: %v", err)
+			}
+		}()
+
+		if err := virgo.CreateNetwork(l, n); err != nil {
+			return fmt.Errorf("failed to create network %s: %v", n.Name, err)
+		}
+		return nil
+	},
+}
+
+var netListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the networks created by virgo",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		all, err := cmd.Flags().GetBool("all")
+		if err != nil {
+			return fmt.Errorf("failed to parse all argument: %v", err)
+		}
+
+		output, err := cmd.Flags().GetString("output")
+		if err != nil {
+			return fmt.Errorf("failed to parse output argument: %v", err)
+		}
+
+		l, err := virgo.NewLibvirtConn(connectURI)
+		if err != nil {
+			return fmt.Errorf("failed to open Libvirt connection: %v", err)
+		}
+		defer func() {
+			if err := l.Disconnect(); err != nil {
+				log.Fatalf("failed to disconnect from Libvirt: %v", err)
+			}
+		}()
+
+		nets, err := virgo.ListNetworks(l, all)
+		if err != nil {
+			return err
+		}
+
+		if nets == nil {
+			nets = []virgo.NetworkInfo{}
+		}
+		return printNetworks(os.Stdout, nets, all, output)
+	},
+}
+
+// printNetworks prints nets as a table, along with whether they were created by
+// virgo if all is set, or as JSON if output is "json".
+func printNetworks(w io.Writer, nets []virgo.NetworkInfo, all bool, output string) error {
+	switch output {
+	case "json":
+		return printJSON(w, nets)
+	case "table":
+	default:
+		return fmt.Errorf("unsupported output format %q, expected table or json", output)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	header := "NAME\tMODE\tBRIDGE\tADDRESS\tACTIVE\tAUTOSTART"
+	if all {
+		header += "\tVIRGO"
+	}
+	fmt.Fprintln(tw, header)
+	for _, n := range nets {
+		bridge, address := n.Bridge, n.Address
+		if bridge == "" {
+			bridge = "-"
+		}
+		if address == "" {
+			address = "-"
+		}
+
+		row := fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%s", n.Name, n.Mode, bridge, address, yesNo(n.Active), yesNo(n.Autostart))
+		if all {
+			row += "\t" + yesNo(n.Managed)
+		}
+		fmt.Fprintln(tw, row)
+	}
+	return tw.Flush()
+}
+
+var netDeleteCmd = &cobra.Command{
+	Use:   "delete <name>",
+	Short: "Delete a network created by virgo",
+	Long:  `Delete a network created by virgo, stopping it first if it's active.`,
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+
+		l, err := virgo.NewLibvirtConn(connectURI)
+		if err != nil {
+			return fmt.Errorf("failed to open Libvirt connection: %v", err)
+		}
+		defer func() {
+			if err := l.Disconnect(); err != nil {
+				log.Fatalf("failed to disconnect from Libvirt: %v", err)
+			}
+		}()
+
+		if err := virgo.DeleteNetwork(l, name); err != nil {
+			return fmt.Errorf("failed to delete network %s: %v", name, err)
+		}
+		return nil
+	},
+}
+
+func init() {
+	netCreateCmd.Flags().String("mode", "nat", "network mode: nat, route or isolated")
+	netCreateCmd.Flags().String("bridge", "", "name of the network's bridge (picked by libvirt if empty)")
+	netCreateCmd.Flags().String("address", "", "host address on the network, with its prefix length, e.g. 192.168.100.1/24")
+	netCreateCmd.Flags().String("forward-dev", "", "host NIC that nat and route networks forward to")
+	netCreateCmd.Flags().String("dhcp-range", "", "range of addresses handed out by DHCP, e.g. 192.168.100.100-192.168.100.200")
+	netCreateCmd.Flags().StringArray("host", nil, "static DHCP entry MAC,IP[,NAME] (repeatable)")
+	netListCmd.Flags().Bool("all", false, "list all networks, not only those created by virgo")
+	netListCmd.Flags().StringP("output", "o", "table", "output format: table or json")
+
+	netCmd.AddCommand(netCreateCmd, netListCmd, netDeleteCmd)
+	rootCmd.AddCommand(netCmd)
+}
@@ -1,10 +1,12 @@
 package cmd
 
 import (
-	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"os"
+	"time"
 
 	"github.com/anastop/virgo/pkg/virgo"
 
@@ -18,6 +20,9 @@ var provisionCmd = &cobra.Command{
 
 The available provisioning options are presented in detail in virgo's main help message. 
 The bash script can be any valid bash script and is executed with root permissions. 
+
+With --wait, the command returns once the VM has shut itself off after provisioning,
+and fails if the provision script exited with a non-zero status.
 `,
 	Args: cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
@@ -33,30 +38,53 @@ The bash script can be any valid bash script and is executed with root permissio
 			return fmt.Errorf("failed to parse initd argument: %v", err)
 		}
 
+		wait, err := cmd.Flags().GetBool("wait")
+		if err != nil {
+			return fmt.Errorf("failed to parse wait argument: %v", err)
+		}
+
+		timeout, err := cmd.Flags().GetDuration("timeout")
+		if err != nil {
+			return fmt.Errorf("failed to parse timeout argument: %v", err)
+		}
+
+		consoleLog, err := cmd.Flags().GetString("console-log")
+		if err != nil {
+			return fmt.Errorf("failed to parse console-log argument: %v", err)
+		}
+
 		conf, err := cmd.Flags().GetString("config")
 		if err != nil {
 			return fmt.Errorf("failed to parse config argument: %v", err)
 		}
 
-		data, err := ioutil.ReadFile(conf)
+		sets, err := cmd.Flags().GetStringArray("set")
 		if err != nil {
-			return fmt.Errorf("failed to read config file %s: %v", conf, err)
+			return fmt.Errorf("failed to parse set argument: %v", err)
 		}
 
-		pc := &virgo.ProvisionConf{}
-		if err := json.Unmarshal(data, pc); err != nil {
-			return fmt.Errorf("failed to unmarshal provision config: %v", err)
+		pc, gc, err := virgo.LoadConf(conf, sets)
+		if err != nil {
+			return err
 		}
 		pc.Name = guest
+		gc.Name = guest
 
-		gc := &virgo.GuestConf{}
-		if err := json.Unmarshal(data, gc); err != nil {
-			return fmt.Errorf("failed to unmarshal guest config: %v", err)
+		pool, err := cmd.Flags().GetString("pool")
+		if err != nil {
+			return fmt.Errorf("failed to parse pool argument: %v", err)
+		}
+		if pool != "" {
+			pc.StoragePool = pool
+			gc.StoragePool = pool
+		}
+
+		if err := validateConf(conf, pc, gc); err != nil {
+			return err
 		}
-		gc.Name = guest
 
 		if provisionScript != "" {
-			data, err = ioutil.ReadFile(provisionScript)
+			data, err := ioutil.ReadFile(provisionScript)
 			if err != nil {
 				return fmt.Errorf("failed to read provision script %s: %v", provisionScript, err)
 			}
@@ -64,14 +92,14 @@ The bash script can be any valid bash script and is executed with root permissio
 		}
 
 		if initdScript != "" {
-			data, err = ioutil.ReadFile(initdScript)
+			data, err := ioutil.ReadFile(initdScript)
 			if err != nil {
 				return fmt.Errorf("failed to read initd script %s: %v", initdScript, err)
 			}
 			pc.Initd = string(data)
 		}
 
-		l, err := virgo.NewLibvirtConn()
+		l, err := virgo.NewLibvirtConn(connectURI)
 		if err != nil {
 			return fmt.Errorf("failed to open Libvirt connection: %v", err)
 		}
@@ -85,6 +113,31 @@ The bash script can be any valid bash script and is executed with root permissio
 			return fmt.Errorf("provision failed: %v", err)
 		}
 
+		if !wait {
+			return nil
+		}
+
+		var console io.Writer
+		if consoleLog != "" {
+			f, err := os.Create(consoleLog)
+			if err != nil {
+				return fmt.Errorf("failed to create console log %s: %v", consoleLog, err)
+			}
+			defer f.Close()
+			console = f
+		}
+
+		status, err := virgo.WaitProvision(l, guest, timeout, console)
+		if err != nil {
+			return fmt.Errorf("failed waiting for provisioning of %s: %v", guest, err)
+		}
+
+		switch {
+		case status > 0:
+			return fmt.Errorf("provision script of %s exited with status %d", guest, status)
+		case status < 0 && pc.Provision != "":
+			fmt.Fprintf(os.Stderr, "warning: %s shut off without reporting the provision script's status\n", guest)
+		}
 		return nil
 	},
 }
@@ -92,7 +145,12 @@ The bash script can be any valid bash script and is executed with root permissio
 func init() {
 	provisionCmd.Flags().StringP("provision-script", "p", "", "bash script to be used for provisioning")
 	provisionCmd.Flags().StringP("initd-script", "i", "", "bash script to be used in init.d")
-	provisionCmd.Flags().StringP("config", "c", "", "JSON file containing the provisioning options")
+	provisionCmd.Flags().StringP("config", "c", "", "config file (JSON, YAML or TOML) containing the provisioning options")
+	provisionCmd.Flags().StringArray("set", nil, "override a config option, e.g. --set guest_num_vcpus=16 (repeatable)")
+	provisionCmd.Flags().Bool("wait", false, "wait for provisioning to complete and report the provision script's result")
+	provisionCmd.Flags().Duration("timeout", 30*time.Minute, "maximum time to wait for provisioning with --wait")
+	provisionCmd.Flags().String("console-log", "", "file to save the VM's serial console output to with --wait")
+	provisionCmd.Flags().String("pool", "", "storage pool to create the VM's image in, overriding storage_pool")
 	provisionCmd.MarkFlagRequired("config")
 	rootCmd.AddCommand(provisionCmd)
 }
@@ -16,7 +16,12 @@ var purgeCmd = &cobra.Command{
 	RunE: func(cmd *cobra.Command, args []string) error {
 		guest := args[0]
 
-		l, err := virgo.NewLibvirtConn()
+		pool, err := cmd.Flags().GetString("pool")
+		if err != nil {
+			return fmt.Errorf("failed to parse pool argument: %v", err)
+		}
+
+		l, err := virgo.NewLibvirtConn(connectURI)
 		if err != nil {
 			return fmt.Errorf("failed to open Libvirt connection: %v", err)
 		}
@@ -26,11 +31,19 @@ var purgeCmd = &cobra.Command{
 			}
 		}()
 
+		if pool == "" {
+			pool = virgo.GuestPool(l, guest)
+		}
+
+		if err := virgo.CheckPurge(l, guest, pool); err != nil {
+			return fmt.Errorf("failed to purge %s: %v", guest, err)
+		}
+
 		if err := virgo.Undefine(l, guest); err != nil {
 			return fmt.Errorf("failed to undefine %s: %v", guest, err)
 		}
 
-		if err := virgo.Purge(l, guest); err != nil {
+		if err := virgo.Purge(l, guest, pool); err != nil {
 			return fmt.Errorf("failed to purge %s: %v", guest, err)
 		}
 		return nil
@@ -38,5 +51,6 @@ var purgeCmd = &cobra.Command{
 }
 
 func init() {
+	purgeCmd.Flags().String("pool", "", "storage pool of the VM's image (default: the pool it was launched from)")
 	rootCmd.AddCommand(purgeCmd)
 }
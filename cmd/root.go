@@ -4,9 +4,13 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/anastop/virgo/pkg/virgo"
 	"github.com/spf13/cobra"
 )
 
+// connectURI is the libvirt URI that every command connects to
+var connectURI string
+
 var sampleConfig = `
 {
   "cloud_img_url": "https://cloud-images.ubuntu.com/releases/18.04/release/",
@@ -14,6 +18,9 @@ var sampleConfig = `
   "user": "guest",
   "passwd": "guest",
   "root_img_gb": 10,
+  "storage_pool": "default",
+  "disable_passwd_auth": false,
+  "keep_cloud_init": false,
 
   "guest_memory_mb": 4096,
   "guest_num_vcpus": 8,
@@ -42,7 +49,8 @@ var sampleConfig = `
       "mac_addr": "de:ad:be:ef:45:67",
       "unix_socket_path": "/usr/local/var/run/openvswitch/dpdkvhostuser2",
       "queues": 2
-    }]
+    }],
+  "guest_serial_log": true
 }
 `
 
@@ -55,27 +63,85 @@ var rootCmd = &cobra.Command{
 Most virgo commands accept a single argument, the name of the VM they act upon. Every command
 has its own flags. 
 
-For provisioning a new VM image, you should specify a JSON config file with provisioning
+All commands accept a --connect flag with the libvirt URI to manage, e.g. qemu:///system
+(the default), qemu:///session for unprivileged guests, qemu+ssh://user@host/system or
+qemu+tcp://host/system for remote hypervisors. LIBVIRT_DEFAULT_URI is honored if set.
+
+For provisioning a new VM image, you should specify a config file with provisioning
 options. Additionally, you may specify a provisioning script to be executed on image's first boot,
 and/or an initd script with commands to be executed on every boot. 
 
 For launching a new VM instance from an already-provisioned image, you should specify a 
-JSON config file with launch options. 
+config file with launch options. Config files are JSON, YAML or TOML, by their
+extension; see "virgo init --format" for commented samples, and "virgo schema".
 
 The example below shows all available provisioning and launch options, all in a single JSON file
 (these groups of options are separated by an empty line).
 
 ` + sampleConfig + `
 
+"storage_pool" is created as a directory pool if it does not exist. Pools that are not 
+directory-based (e.g. LVM or ZFS) get full copies of the cloud image instead of 
+copy-on-write overlays; the cloud image itself is then cached in the "default" pool.
+
+"ssh_authorized_keys" accepts public keys or paths to public key files, and defaults to
+~/.ssh/id_*.pub of the invoking user. With "disable_passwd_auth", the user's password is 
+locked and SSH password authentication is turned off.
+
+cloud-init is removed from the image after provisioning, unless "keep_cloud_init" is set,
+which allows clones of the VM (see "virgo clone") to get their own hostname and identity.
+
+"guest_net_ifs" entries are of type "bridge" (with "bridge"), "network" (a libvirt network, with
+"network" and optionally "portgroup"), "direct" (macvtap on the host NIC "dev", with "mode" vepa,
+bridge, private or passthrough), "user" (user-mode networking, e.g. for qemu:///session) or
+"vhostuser" (with "mac_addr" and "unix_socket_path"). All of them take optional "mac_addr",
+"model" (virtio, the default, or e1000), "queues" (virtio only) and "pci_address", e.g. 0000:00:0a.0.
+Networks for "network" interfaces can be created with "virgo net create", e.g.:
+
+  virgo net create lab --address 192.168.100.1/24 --dhcp-range 192.168.100.100-192.168.100.200
+
+"guest_serial_log" logs the VM's serial console, see "virgo logs", to "guest_serial_log_path",
+which defaults to <name>.virgo.log in the storage pool's directory.
+
+"guest_cputune" pins the VM to host CPUs, e.g. for DPDK benchmarks:
+
+  "guest_cputune": {
+    "vcpu_pins": [{"vcpu": 0, "cpuset": "2"}, {"vcpu": 1, "cpuset": "3"}],
+    "emulator_pin": "0-1",
+    "iothreads": 1,
+    "iothread_pins": [{"iothread": 1, "cpuset": "0-1"}],
+    "vcpu_sched": [{"vcpus": "1", "scheduler": "fifo", "priority": 1}]
+  }
+
+With "auto": true and "host_nic" set to the name or PCI address of the host NIC behind
+the vhostuser interfaces, the vCPUs that aren't pinned explicitly are pinned one-to-one
+to the isolated CPUs (isolcpus) of the NIC's NUMA node at launch, skipping the ones that
+other running VMs are pinned to, and the emulator and I/O threads to the node's other
+CPUs. Auto pinning reads the host's sysfs, so it's only supported on local hosts.
+
+"guest_numatune" binds the VM's memory to host NUMA nodes, so that e.g. hugepages are
+allocated on the socket of the NIC, either as a whole or per guest NUMA node:
+
+  "guest_numatune": {
+    "mem_nodes": [{"cell_id": 0, "node_set": "0"}, {"cell_id": 1, "node_set": "1"}]
+  }
+
+Modes are "strict" (the default), "preferred" (a single host node) or "interleave" (for
+the VM as a whole, with "mode" and "node_set"). At launch, the host nodes are checked to
+exist and, in strict mode, to have enough hugepages for the memory bound to them.
+
 The provisioning script can be any valid bash script, and it's executed as the 
 last step of cloud-init provisioning. 
 
 PREREQUISITES
 The following Linux utilities are required by virgo: 
-- wget
-- genisoimage
+- openssl (1.1.1 or later)
 `}
 
+func init() {
+	rootCmd.PersistentFlags().StringVar(&connectURI, "connect", virgo.DefaultConnectURI(), "libvirt connection URI")
+}
+
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/anastop/virgo/pkg/virgo"
+
+	"github.com/spf13/cobra"
+)
+
+var schemaCmd = &cobra.Command{
+	Use:   "schema",
+	Short: "Print the JSON Schema of config files",
+	Long: `Print the JSON Schema of config files, for editors to validate and complete them.
+The schema applies to YAML and TOML config files as well.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		schema, err := virgo.ConfSchema()
+		if err != nil {
+			return err
+		}
+
+		if _, err := os.Stdout.Write(schema); err != nil {
+			return fmt.Errorf("failed to print schema: %v", err)
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(schemaCmd)
+}
@@ -0,0 +1,186 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/anastop/virgo/pkg/virgo"
+
+	"github.com/spf13/cobra"
+)
+
+var snapshotCmd = &cobra.Command{
+	Use:   "snapshot",
+	Short: "Manage the snapshots of a VM",
+	Long: `Manage the snapshots of a VM, e.g. to roll a test VM back to its just-provisioned state.
+Snapshots are internal by default, i.e. kept inside the VM's qcow2 root image along with
+its memory if it's running. External snapshots are disk-only, and redirect the VM's writes
+to a new overlay volume in its storage pool. VMs in non file-based pools have raw root
+images, which support neither.`,
+}
+
+// snapshotName returns the optional snapshot name argument.
+func snapshotName(args []string) string {
+	if len(args) > 1 {
+		return args[1]
+	}
+	return ""
+}
+
+var snapshotCreateCmd = &cobra.Command{
+	Use:   "create <vm> [name]",
+	Short: "Create a snapshot of a VM",
+	Long:  `Create a snapshot of a VM. It is named after the current time, if no name is given.`,
+	Args:  cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		guest := args[0]
+
+		external, err := cmd.Flags().GetBool("external")
+		if err != nil {
+			return fmt.Errorf("failed to parse external argument: %v", err)
+		}
+
+		l, err := virgo.NewLibvirtConn(connectURI)
+		if err != nil {
+			return fmt.Errorf("failed to open Libvirt connection: %v", err)
+		}
+		defer func() {
+			if err := l.Disconnect(); err != nil {
+				log.Fatalf("failed to disconnect from Libvirt: %v", err)
+			}
+		}()
+
+		name, err := virgo.CreateSnapshot(l, guest, snapshotName(args), external)
+		if err != nil {
+			return fmt.Errorf("failed to create snapshot of %s: %v", guest, err)
+		}
+		fmt.Println(name)
+		return nil
+	},
+}
+
+var snapshotListCmd = &cobra.Command{
+	Use:   "list <vm>",
+	Short: "List the snapshots of a VM",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		guest := args[0]
+
+		output, err := cmd.Flags().GetString("output")
+		if err != nil {
+			return fmt.Errorf("failed to parse output argument: %v", err)
+		}
+
+		l, err := virgo.NewLibvirtConn(connectURI)
+		if err != nil {
+			return fmt.Errorf("failed to open Libvirt connection: %v", err)
+		}
+		defer func() {
+			if err := l.Disconnect(); err != nil {
+				log.Fatalf("failed to disconnect from Libvirt: %v", err)
+			}
+		}()
+
+		snaps, err := virgo.ListSnapshots(l, guest)
+		if err != nil {
+			return fmt.Errorf("failed to list snapshots of %s: %v", guest, err)
+		}
+
+		if snaps == nil {
+			snaps = []virgo.SnapshotInfo{}
+		}
+		return printSnapshots(os.Stdout, snaps, output)
+	},
+}
+
+// printSnapshots prints snaps as a table, or as JSON if output is "json".
+func printSnapshots(w io.Writer, snaps []virgo.SnapshotInfo, output string) error {
+	switch output {
+	case "json":
+		return printJSON(w, snaps)
+	case "table":
+	default:
+		return fmt.Errorf("unsupported output format %q, expected table or json", output)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tCREATED\tSTATE\tKIND\tPARENT\tCURRENT")
+	for _, s := range snaps {
+		kind := "internal"
+		if s.External {
+			kind = "external"
+		}
+
+		parent := s.Parent
+		if parent == "" {
+			parent = "-"
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", s.Name, s.Created.Format("2006-01-02 15:04:05"), s.State, kind, parent, yesNo(s.Current))
+	}
+	return tw.Flush()
+}
+
+var snapshotRevertCmd = &cobra.Command{
+	Use:   "revert <vm> [name]",
+	Short: "Revert a VM to a snapshot",
+	Long: `Revert a VM to a snapshot, or to its current snapshot if no name is given, discarding
+its state since. A VM reverted to an external snapshot is left shut off, and the snapshots
+taken after it are deleted.`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		guest := args[0]
+
+		l, err := virgo.NewLibvirtConn(connectURI)
+		if err != nil {
+			return fmt.Errorf("failed to open Libvirt connection: %v", err)
+		}
+		defer func() {
+			if err := l.Disconnect(); err != nil {
+				log.Fatalf("failed to disconnect from Libvirt: %v", err)
+			}
+		}()
+
+		if err := virgo.RevertSnapshot(l, guest, snapshotName(args)); err != nil {
+			return fmt.Errorf("failed to revert %s to snapshot: %v", guest, err)
+		}
+		return nil
+	},
+}
+
+var snapshotDeleteCmd = &cobra.Command{
+	Use:   "delete <vm> [name]",
+	Short: "Delete a snapshot of a VM",
+	Long: `Delete a snapshot of a VM, or its current snapshot if no name is given. The overlay of an
+external snapshot that the VM's disk still depends on is kept until the VM is purged.`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		guest := args[0]
+
+		l, err := virgo.NewLibvirtConn(connectURI)
+		if err != nil {
+			return fmt.Errorf("failed to open Libvirt connection: %v", err)
+		}
+		defer func() {
+			if err := l.Disconnect(); err != nil {
+				log.Fatalf("failed to disconnect from Libvirt: %v", err)
+			}
+		}()
+
+		if err := virgo.DeleteSnapshot(l, guest, snapshotName(args)); err != nil {
+			return fmt.Errorf("failed to delete snapshot of %s: %v", guest, err)
+		}
+		return nil
+	},
+}
+
+func init() {
+	snapshotCreateCmd.Flags().Bool("external", false, "create an external disk-only snapshot, instead of an internal one")
+	snapshotListCmd.Flags().StringP("output", "o", "table", "output format: table or json")
+
+	snapshotCmd.AddCommand(snapshotCreateCmd, snapshotListCmd, snapshotRevertCmd, snapshotDeleteCmd)
+	rootCmd.AddCommand(snapshotCmd)
+}
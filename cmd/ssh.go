@@ -2,35 +2,73 @@ package cmd
 
 import (
 	"fmt"
+	"log"
+
+	"github.com/anastop/virgo/pkg/virgo"
 
 	"github.com/spf13/cobra"
 )
 
-// sshCmd represents the ssh command
 var sshCmd = &cobra.Command{
-	Use:   "ssh",
-	Short: "A brief description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
-
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
-	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Printf("ssh called, args %+v", args)
-	},
-}
+	Use:   "ssh <guest> [-- command...]",
+	Short: "Open an SSH session to a running VM",
+	Long: `Open an SSH session to a running VM, optionally running a command in it.
+The VM's IP address is discovered automatically from Libvirt's DHCP leases,
+the guest agent or the host's ARP table.
 
-func init() {
-	//rootCmd.AddCommand(sshCmd)
+The user is taken from --user, or else from the provisioning options in --config.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		guest := args[0]
+
+		user, err := cmd.Flags().GetString("user")
+		if err != nil {
+			return fmt.Errorf("failed to parse user argument: %v", err)
+		}
+
+		conf, err := cmd.Flags().GetString("config")
+		if err != nil {
+			return fmt.Errorf("failed to parse config argument: %v", err)
+		}
 
-	// Here you will define your flags and configuration settings.
+		insecure, err := cmd.Flags().GetBool("insecure")
+		if err != nil {
+			return fmt.Errorf("failed to parse insecure argument: %v", err)
+		}
 
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// sshCmd.PersistentFlags().String("foo", "", "A help for foo")
+		if user == "" && conf != "" {
+			pc, _, err := virgo.LoadConf(conf, nil)
+			if err != nil {
+				return err
+			}
+			user = pc.User
+		}
 
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// sshCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+		l, err := virgo.NewLibvirtConn(connectURI)
+		if err != nil {
+			return fmt.Errorf("failed to open Libvirt connection: %v", err)
+		}
+		defer func() {
+			if err := l.Disconnect(); err != nil {
+				log.Fatalf("failed to disconnect from Libvirt: %v", err)
+			}
+		}()
+
+		addrs, err := virgo.GuestIPAddrs(l, guest)
+		if err != nil {
+			return fmt.Errorf("failed to discover IP address of %s: %v", guest, err)
+		}
+
+		if err := virgo.SSHCommand(user, addrs[0], insecure, args[1:]...).Run(); err != nil {
+			return fmt.Errorf("ssh to %s (%s) failed: %v", guest, addrs[0], err)
+		}
+		return nil
+	},
+}
+
+func init() {
+	sshCmd.Flags().StringP("user", "u", "", "user to log in as")
+	sshCmd.Flags().StringP("config", "c", "", "config file containing the provisioning options")
+	sshCmd.Flags().Bool("insecure", false, "skip the guest's host key verification")
+	rootCmd.AddCommand(sshCmd)
 }
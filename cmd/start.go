@@ -18,7 +18,7 @@ either via 'provision' or 'launch'`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		guest := args[0]
 
-		l, err := virgo.NewLibvirtConn()
+		l, err := virgo.NewLibvirtConn(connectURI)
 		if err != nil {
 			return fmt.Errorf("failed to open Libvirt connection: %v", err)
 		}
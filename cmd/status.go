@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/anastop/virgo/pkg/virgo"
+
+	"github.com/spf13/cobra"
+)
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the status of a VM created by virgo",
+	Long: `Show the state, vCPUs, memory, IP addresses and root image size of a VM created by virgo,
+and whether its volumes exist in the storage pool.
+
+With --file, the status of all the VMs of a topology file is shown instead (see "virgo up").`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		output, err := cmd.Flags().GetString("output")
+		if err != nil {
+			return fmt.Errorf("failed to parse output argument: %v", err)
+		}
+
+		file, err := cmd.Flags().GetString("file")
+		if err != nil {
+			return fmt.Errorf("failed to parse file argument: %v", err)
+		}
+		if (file == "") == (len(args) == 0) {
+			return fmt.Errorf("expected either a VM name or a topology file")
+		}
+
+		l, err := virgo.NewLibvirtConn(connectURI)
+		if err != nil {
+			return fmt.Errorf("failed to open Libvirt connection: %v", err)
+		}
+		defer func() {
+			if err := l.Disconnect(); err != nil {
+				log.Fatalf("failed to disconnect from Libvirt: %v", err)
+			}
+		}()
+
+		if file != "" {
+			topo, err := virgo.LoadTopology(file)
+			if err != nil {
+				return err
+			}
+
+			guests, err := virgo.TopologyStatus(l, topo)
+			if err != nil {
+				return fmt.Errorf("failed to get status of topology %s: %v", file, err)
+			}
+			return printGuests(os.Stdout, guests, output)
+		}
+
+		guest := args[0]
+		st, err := virgo.Status(l, guest)
+		if err != nil {
+			return fmt.Errorf("failed to get status of %s: %v", guest, err)
+		}
+
+		if output == "json" {
+			return printJSON(os.Stdout, st)
+		}
+		return printGuests(os.Stdout, []virgo.GuestStatus{*st}, output)
+	},
+}
+
+func init() {
+	statusCmd.Flags().StringP("output", "o", "table", "output format: table or json")
+	statusCmd.Flags().StringP("file", "f", "", "topology file whose VMs to show")
+	rootCmd.AddCommand(statusCmd)
+}
@@ -11,12 +11,24 @@ import (
 var stopCmd = &cobra.Command{
 	Use:   "stop",
 	Short: "Shut down a running VM instance",
-	Long:  `Shut down a running VM instance. Keep its current definition intact.`,
+	Long: `Shut down a running VM instance. Keep its current definition intact.
+The command waits up to --timeout for the VM to power off; with --force, a VM that 
+is still running after that is destroyed (i.e. powered off forcefully).`,
 	Args: cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		guest := args[0]
 
-		l, err := virgo.NewLibvirtConn()
+		timeout, err := cmd.Flags().GetDuration("timeout")
+		if err != nil {
+			return fmt.Errorf("failed to parse timeout argument: %v", err)
+		}
+
+		force, err := cmd.Flags().GetBool("force")
+		if err != nil {
+			return fmt.Errorf("failed to parse force argument: %v", err)
+		}
+
+		l, err := virgo.NewLibvirtConn(connectURI)
 		if err != nil {
 			return fmt.Errorf("failed to open Libvirt connection: %v", err)
 		}
@@ -26,7 +38,7 @@ var stopCmd = &cobra.Command{
 			}
 		}()
 
-		if err := virgo.Stop(l, guest); err != nil {
+		if err := virgo.Stop(l, guest, timeout, force); err != nil {
 			return fmt.Errorf("failed to stop guest %s: %v", guest, err)
 		}
 		return nil
@@ -34,5 +46,7 @@ var stopCmd = &cobra.Command{
 }
 
 func init() {
+	stopCmd.Flags().Duration("timeout", virgo.DefaultStopTimeout, "maximum time to wait for the VM to shut down, 0 to not wait")
+	stopCmd.Flags().Bool("force", false, "destroy the VM if it does not shut down within the timeout")
 	rootCmd.AddCommand(stopCmd)
 }
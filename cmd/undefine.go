@@ -13,12 +13,13 @@ var undefineCmd = &cobra.Command{
 	Use:   "undefine",
 	Short: "Undefine a VM by removing its specification",
 	Long: `Undefine a VM by removing its specification. Its image is not affected.
-If it's running, the domain is first stopped.'`,
+If it's running, the domain is first stopped, and destroyed if it does not shut down
+within a minute. Any managed save image and snapshot metadata are removed too.`,
 	Args: cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		guest := args[0]
 
-		l, err := virgo.NewLibvirtConn()
+		l, err := virgo.NewLibvirtConn(connectURI)
 		if err != nil {
 			return fmt.Errorf("failed to open Libvirt connection: %v", err)
 		}
@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/anastop/virgo/pkg/virgo"
+
+	"github.com/spf13/cobra"
+)
+
+var upCmd = &cobra.Command{
+	Use:   "up",
+	Short: "Bring up the VMs of a topology file",
+	Long: `Bring up the VMs of a topology file, provisioning and launching them in dependency order,
+up to --parallel at a time. VMs that are already running are skipped, VMs that are shut off
+are started, and VMs whose image is already provisioned are just launched.
+
+A topology file is a JSON (or YAML, or TOML) file with the "defaults" options shared by all VMs, and the list of
+"guests". Each guest takes any provisioning or launch option, overriding the defaults, along
+with its "name", the "depends_on" list of guests it's brought up after, and the paths of its
+"provision_script" and "initd_script", relative to the topology file. The "networks" that
+the VMs' network interfaces refer to, with the options of "virgo net create", are created
+before any VM is brought up:
+
+{
+  "defaults": {
+    "cloud_img_url": "https://cloud-images.ubuntu.com/releases/18.04/release/",
+    "cloud_img_name": "ubuntu-18.04-server-cloudimg-amd64.img",
+    "user": "guest",
+    "passwd": "guest",
+    "root_img_gb": 10,
+    "guest_memory_mb": 4096,
+    "guest_num_vcpus": 2
+  },
+  "networks": [
+    {"name": "lab", "address": "192.168.100.1/24", "dhcp_range": "192.168.100.100-192.168.100.200"}
+  ],
+  "guests": [
+    {"name": "vswitch", "guest_num_vcpus": 4, "provision_script": "ovs.sh"},
+    {"name": "vm1", "depends_on": ["vswitch"], "provision_script": "dpdk.sh"},
+    {"name": "vm2", "depends_on": ["vswitch"], "provision_script": "dpdk.sh"}
+  ]
+}
+`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		file, err := cmd.Flags().GetString("file")
+		if err != nil {
+			return fmt.Errorf("failed to parse file argument: %v", err)
+		}
+
+		parallel, err := cmd.Flags().GetInt("parallel")
+		if err != nil {
+			return fmt.Errorf("failed to parse parallel argument: %v", err)
+		}
+
+		timeout, err := cmd.Flags().GetDuration("timeout")
+		if err != nil {
+			return fmt.Errorf("failed to parse timeout argument: %v", err)
+		}
+
+		topo, err := virgo.LoadTopology(file)
+		if err != nil {
+			return err
+		}
+
+		l, err := virgo.NewLibvirtConn(connectURI)
+		if err != nil {
+			return fmt.Errorf("failed to open Libvirt connection: %v", err)
+		}
+		defer func() {
+			if err := l.Disconnect(); err != nil {
+				log.Fatalf("failed to disconnect from Libvirt: %v", err)
+			}
+		}()
+
+		if err := virgo.Up(l, topo, parallel, timeout, os.Stderr); err != nil {
+			return fmt.Errorf("failed to bring up topology %s: %v", file, err)
+		}
+		return nil
+	},
+}
+
+func init() {
+	upCmd.Flags().StringP("file", "f", "virgo-topology.json", "topology file")
+	upCmd.Flags().IntP("parallel", "j", 4, "maximum number of VMs to bring up at a time")
+	upCmd.Flags().Duration("timeout", 30*time.Minute, "maximum time to wait for the provisioning of each VM")
+	rootCmd.AddCommand(upCmd)
+}
@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/anastop/virgo/pkg/virgo"
+
+	"github.com/spf13/cobra"
+)
+
+var validateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Check a config or topology file for problems",
+	Long: `Check a config file (-c) or a topology file (-f) for problems, e.g. unknown options, vCPUs
+that don't match the CPU topology or aren't covered by the NUMA nodes, or vhostuser interfaces
+without a MAC address, and report all of them at once. Nothing is changed in Libvirt.
+
+With --launch-only, a config file is checked for launch options only.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := cmd.Flags().GetString("config")
+		if err != nil {
+			return fmt.Errorf("failed to parse config argument: %v", err)
+		}
+
+		file, err := cmd.Flags().GetString("file")
+		if err != nil {
+			return fmt.Errorf("failed to parse file argument: %v", err)
+		}
+
+		launchOnly, err := cmd.Flags().GetBool("launch-only")
+		if err != nil {
+			return fmt.Errorf("failed to parse launch-only argument: %v", err)
+		}
+
+		if (conf == "") == (file == "") {
+			return fmt.Errorf("expected either a config file or a topology file")
+		}
+
+		if file != "" {
+			// topologies are validated while loaded
+			_, err := virgo.LoadTopology(file)
+			return err
+		}
+
+		sets, err := cmd.Flags().GetStringArray("set")
+		if err != nil {
+			return fmt.Errorf("failed to parse set argument: %v", err)
+		}
+
+		pc, gc, err := virgo.LoadConf(conf, sets)
+		if err != nil {
+			return err
+		}
+		if launchOnly {
+			pc = nil
+		}
+		return validateConf(conf, pc, gc)
+	},
+}
+
+// validateConf returns an error listing all the problems of the provisioning
+// and launch options loaded from the config file conf; pc may be nil when only
+// launching.
+func validateConf(conf string, pc *virgo.ProvisionConf, gc *virgo.GuestConf) error {
+	var problems []string
+	errs := []error{gc.Validate()}
+	if pc != nil {
+		errs = append([]error{pc.Validate()}, errs...)
+	}
+	for _, err := range errs {
+		if err, ok := err.(*virgo.ConfError); ok {
+			problems = append(problems, err.Problems...)
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid config file %s:\n  - %s", conf, strings.Join(problems, "\n  - "))
+}
+
+func init() {
+	validateCmd.Flags().StringP("config", "c", "", "config file containing provisioning and/or launch options")
+	validateCmd.Flags().StringArray("set", nil, "override a config option, e.g. --set guest_num_vcpus=16 (repeatable)")
+	validateCmd.Flags().StringP("file", "f", "", "topology file")
+	validateCmd.Flags().Bool("launch-only", false, "check the config file for launch options only")
+	rootCmd.AddCommand(validateCmd)
+}
@@ -3,6 +3,9 @@ module github.com/anastop/virgo
 go 1.12
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/digitalocean/go-libvirt v0.0.0-20190715144809-7b622097a793
 	github.com/spf13/cobra v0.0.5
+	golang.org/x/crypto v0.0.0-20190701094942-4def268fd1a4
+	gopkg.in/yaml.v2 v2.2.2
 )
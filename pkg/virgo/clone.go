@@ -0,0 +1,259 @@
+package virgo
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// CloneNames returns the names of count clones called name: name itself for a
+// single clone, or name-1 to name-count.
+func CloneNames(name string, count int) []string {
+	if count == 1 {
+		return []string{name}
+	}
+
+	var names []string
+	for i := 1; i <= count; i++ {
+		names = append(names, fmt.Sprintf("%s-%d", name, i))
+	}
+	return names
+}
+
+// sourceRootVol returns the volume backing the root disk of the domain d.
+func sourceRootVol(l *libvirt.Libvirt, d *DomainDesc) (libvirt.StorageVol, error) {
+	for _, disk := range d.Devices.Disks {
+		if disk.Target.Dev != rootDiskDev {
+			continue
+		}
+
+		if disk.Source.File != "" {
+			vol, err := l.StorageVolLookupByPath(disk.Source.File)
+			if err != nil {
+				return vol, fmt.Errorf("failed to lookup storage volume %s: %v", disk.Source.File, err)
+			}
+			return vol, nil
+		}
+
+		pool, err := l.StoragePoolLookupByName(disk.Source.Pool)
+		if err != nil {
+			return libvirt.StorageVol{}, fmt.Errorf("failed to lookup storage pool %s: %v", disk.Source.Pool, err)
+		}
+		vol, err := l.StorageVolLookupByName(pool, disk.Source.Volume)
+		if err != nil {
+			return vol, fmt.Errorf("failed to lookup storage volume %s under pool %s: %v", disk.Source.Volume, pool.Name, err)
+		}
+		return vol, nil
+	}
+	return libvirt.StorageVol{}, fmt.Errorf("domain %s has no root disk %s", d.Name, rootDiskDev)
+}
+
+// randomMAC returns a random MAC address with QEMU's locally administered prefix
+// 52:54:00, which libvirt uses for the addresses it generates as well.
+func randomMAC() (string, error) {
+	mac := net.HardwareAddr{0x52, 0x54, 0x00, 0, 0, 0}
+	if _, err := rand.Read(mac[3:]); err != nil {
+		return "", fmt.Errorf("failed to generate MAC address: %v", err)
+	}
+	return mac.String(), nil
+}
+
+// cloneGuestConf returns the configuration of the clone called name of the
+// guest launched from g: every network interface gets a fresh MAC address, and
+// the explicit CPU pins are dropped so that the clone doesn't share its source's
+// cores; auto pins are picked anew at launch.
+func cloneGuestConf(g *GuestConf, name string) (*GuestConf, error) {
+	c := *g
+	c.Name = name
+	c.SerialLogPath = ""
+	c.RootImgPath, c.ConfigIsoPath = "", ""
+
+	c.NetIfs = append([]NetIf{}, g.NetIfs...)
+	for i := range c.NetIfs {
+		mac, err := randomMAC()
+		if err != nil {
+			return nil, err
+		}
+		c.NetIfs[i].MacAddr = mac
+	}
+
+	if g.CPUTune != nil {
+		t := *g.CPUTune
+		t.VcpuPins, t.EmulatorPin, t.IOThreadPins = nil, "", nil
+		c.CPUTune = &t
+	}
+	return &c, nil
+}
+
+// LinkedClones returns the volumes of poolName, e.g. the root images of linked
+// clones, that are overlays on the root image of guest or on its snapshot
+// overlays, which thus can't be deleted.
+func LinkedClones(l *libvirt.Libvirt, guest, poolName string) ([]string, error) {
+	pool, err := l.StoragePoolLookupByName(PoolName(poolName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup storage pool %s: %v", PoolName(poolName), err)
+	}
+
+	vols, _, err := l.StoragePoolListAllVolumes(pool, 1, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list storage volumes of pool %s: %v", pool.Name, err)
+	}
+
+	own := func(name string) bool {
+		return name == RootImgName(guest) || strings.HasPrefix(name, SnapshotImgName(guest, ""))
+	}
+	ownPaths := map[string]bool{}
+	for _, vol := range vols {
+		if !own(vol.Name) {
+			continue
+		}
+		path, err := l.StorageVolGetPath(vol)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get path of storage volume %s: %v", vol.Name, err)
+		}
+		ownPaths[path] = true
+	}
+	if len(ownPaths) == 0 {
+		return nil, nil
+	}
+
+	var clones []string
+	for _, vol := range vols {
+		if own(vol.Name) {
+			continue
+		}
+		v, err := GetStorageVolDesc(l, vol)
+		if err != nil {
+			return nil, err
+		}
+		if v.BackingStore != nil && ownPaths[v.BackingStore.Path] {
+			clones = append(clones, vol.Name)
+		}
+	}
+	return clones, nil
+}
+
+// CheckPurge checks that the volumes of guest in poolName can be purged, i.e.
+// that they don't back any linked clones.
+func CheckPurge(l *libvirt.Libvirt, guest, poolName string) error {
+	clones, err := LinkedClones(l, guest, poolName)
+	if err != nil {
+		return err
+	}
+	if len(clones) > 0 {
+		return fmt.Errorf("the root image of %s backs the volumes %s of linked clones, which should be purged first", guest, strings.Join(clones, ", "))
+	}
+	return nil
+}
+
+// Clone launches a guest called name from the root image of the shut off guest
+// source, with the same configuration but for its name, MAC addresses and
+// explicit CPU pins.
+//
+// A linked clone's root image is a qcow2 overlay on the source's, which must thus
+// be kept as is; a full clone gets a copy of it, and is the only option for pools
+// that aren't file-based. Either way, the clone gets a fresh config iso, which sets
+// its hostname and a new instance-id and machine-id. For these to take effect, the
+// source should have been provisioned with KeepCloudInit set.
+func Clone(l *libvirt.Libvirt, source, name string, full bool) error {
+	if name == source {
+		return fmt.Errorf("clone %s should have a different name than its source", name)
+	}
+	if _, err := l.DomainLookupByName(name); err == nil {
+		return fmt.Errorf("domain %s already exists", name)
+	}
+
+	dom, err := l.DomainLookupByName(source)
+	if err != nil {
+		return fmt.Errorf("failed to lookup domain %s: %v", source, err)
+	}
+
+	d, err := GetDomainDesc(l, dom)
+	if err != nil {
+		return err
+	}
+	if !d.Managed() || d.Metadata.Virgo.GuestConf == "" {
+		return fmt.Errorf("domain %s was not launched by a virgo version that records its configuration", source)
+	}
+
+	g := &GuestConf{}
+	if err := json.Unmarshal([]byte(d.Metadata.Virgo.GuestConf), g); err != nil {
+		return fmt.Errorf("failed to unmarshal guest config of %s: %v", source, err)
+	}
+
+	state, _, err := l.DomainGetState(dom, 0)
+	if err != nil {
+		return fmt.Errorf("failed to get state of domain %s: %v", source, err)
+	}
+	if libvirt.DomainState(state) != libvirt.DomainShutoff {
+		return fmt.Errorf("domain %s should be shut off to be cloned, it's %s", source, domainStateString(libvirt.DomainState(state)))
+	}
+
+	pool, pdesc, err := EnsurePool(l, g.StoragePool)
+	if err != nil {
+		return fmt.Errorf("failed to get storage pool: %v", err)
+	}
+	if !full && !pdesc.FileBased() {
+		return fmt.Errorf("linked clones need a file-based storage pool, %s is of type %s", pool.Name, pdesc.Type)
+	}
+	for _, vol := range []string{RootImgName(name), ConfigIsoName(name)} {
+		if _, err := l.StorageVolLookupByName(pool, vol); err == nil {
+			return fmt.Errorf("storage volume %s already exists in pool %s; purge %s first", vol, pool.Name, name)
+		}
+	}
+
+	base, err := sourceRootVol(l, d)
+	if err != nil {
+		return err
+	}
+
+	_, capacity, _, err := l.StorageVolGetInfo(base)
+	if err != nil {
+		return fmt.Errorf("failed to get info of storage volume %s: %v", base.Name, err)
+	}
+
+	switch {
+	case !full:
+		_, err = createOverlay(l, pool, RootImgName(name), base, capacity)
+	case pdesc.FileBased():
+		_, err = createClone(l, pool, RootImgName(name), base, capacity, "qcow2")
+	default:
+		_, err = createClone(l, pool, RootImgName(name), base, capacity, "")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create root image: %v", err)
+	}
+
+	img, err := cloneConfigIsoImage(name)
+	if err != nil {
+		return fmt.Errorf("failed to create configuration iso image: %v", err)
+	}
+
+	if _, err := uploadVolume(l, pool, ConfigIsoName(name), "raw", bytes.NewReader(img), uint64(len(img)), nil); err != nil {
+		return fmt.Errorf("failed to create configuration iso volume: %v", err)
+	}
+
+	if err := l.StoragePoolRefresh(pool, 0); err != nil {
+		return fmt.Errorf("failed to refresh storage pool %s: %v", pool.Name, err)
+	}
+
+	g, err = cloneGuestConf(g, name)
+	if err != nil {
+		return err
+	}
+
+	g.RootImgPath, g.ConfigIsoPath, err = GuestImagePaths(l, pool.Name, name)
+	if err != nil {
+		return fmt.Errorf("failed to compute guest image paths: %v", err)
+	}
+
+	if err := LaunchGuest(l, g); err != nil {
+		return fmt.Errorf("failed to create guest: %v", err)
+	}
+	return nil
+}
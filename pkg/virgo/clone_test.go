@@ -0,0 +1,88 @@
+package virgo
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCloneNames(t *testing.T) {
+	if got := CloneNames("dpdk", 1); !reflect.DeepEqual(got, []string{"dpdk"}) {
+		t.Errorf("unexpected names %v for a single clone", got)
+	}
+	if got := CloneNames("dpdk", 3); !reflect.DeepEqual(got, []string{"dpdk-1", "dpdk-2", "dpdk-3"}) {
+		t.Errorf("unexpected names %v for 3 clones", got)
+	}
+}
+
+func TestCloneGuestConf(t *testing.T) {
+	g := &GuestConf{
+		Name:          "dpdk",
+		RootImgPath:   "/var/lib/libvirt/images/dpdk.virgo.img",
+		ConfigIsoPath: "/var/lib/libvirt/images/dpdk.virgo.iso",
+		SerialLogPath: "/var/lib/libvirt/images/dpdk.virgo.log",
+		NetIfs: []NetIf{
+			{Type: "bridge", Bridge: "br0", MacAddr: "52:54:00:00:00:01"},
+			{Type: "vhostuser", MacAddr: "de:ad:be:ef:00:01", UnixSocketPath: "/tmp/vhost0"},
+		},
+		CPUTune: &CPUTune{
+			Auto:        true,
+			HostNIC:     "ens1f0",
+			VcpuPins:    []VcpuPin{{Vcpu: 0, CPUSet: "10"}},
+			EmulatorPin: "8",
+			VcpuSched:   []VcpuSched{{Vcpus: "0", Scheduler: "fifo", Priority: 1}},
+		},
+	}
+
+	c, err := cloneGuestConf(g, "dpdk-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Name != "dpdk-1" || c.SerialLogPath != "" || c.RootImgPath != "" {
+		t.Errorf("unexpected clone config %+v", c)
+	}
+	for i, n := range c.NetIfs {
+		if n.MacAddr == g.NetIfs[i].MacAddr || !strings.HasPrefix(n.MacAddr, "52:54:00:") {
+			t.Errorf("net_ifs[%d]: expected a fresh MAC address, got %s", i, n.MacAddr)
+		}
+		if _, err := net.ParseMAC(n.MacAddr); err != nil {
+			t.Errorf("net_ifs[%d]: %v", i, err)
+		}
+	}
+	if c.NetIfs[0].MacAddr == c.NetIfs[1].MacAddr {
+		t.Errorf("interfaces share MAC address %s", c.NetIfs[0].MacAddr)
+	}
+
+	want := &CPUTune{Auto: true, HostNIC: "ens1f0", VcpuSched: g.CPUTune.VcpuSched}
+	if !reflect.DeepEqual(c.CPUTune, want) {
+		t.Errorf("expected explicit pins to be dropped, got %+v", c.CPUTune)
+	}
+
+	// the source's config is left as is
+	if g.NetIfs[1].MacAddr != "de:ad:be:ef:00:01" || len(g.CPUTune.VcpuPins) != 1 || g.Name != "dpdk" {
+		t.Errorf("source config modified: %+v", g)
+	}
+}
+
+func TestParseStorageVolDesc(t *testing.T) {
+	v, err := ParseStorageVolDesc(`<volume type='file'>
+  <name>dpdk-1.virgo.img</name>
+  <capacity unit='bytes'>10737418240</capacity>
+  <target>
+    <path>/var/lib/libvirt/images/dpdk-1.virgo.img</path>
+    <format type='qcow2'/>
+  </target>
+  <backingStore>
+    <path>/var/lib/libvirt/images/dpdk.virgo.img</path>
+    <format type='qcow2'/>
+  </backingStore>
+</volume>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Target.Format.Type != "qcow2" || v.BackingStore == nil || v.BackingStore.Path != "/var/lib/libvirt/images/dpdk.virgo.img" {
+		t.Errorf("unexpected volume %+v", v)
+	}
+}
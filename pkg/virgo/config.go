@@ -0,0 +1,183 @@
+package virgo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// confFile is the layout of config files, which hold provisioning and launch
+// options alike.
+type confFile struct {
+	*ProvisionConf
+	*GuestConf
+	// Name and StoragePool are options of both ProvisionConf and GuestConf.
+	Name        string `json:"name,omitempty"`
+	StoragePool string `json:"storage_pool,omitempty"`
+}
+
+func newConfFile() *confFile {
+	return &confFile{ProvisionConf: &ProvisionConf{}, GuestConf: &GuestConf{}}
+}
+
+// split returns the provisioning and launch options of the config file.
+func (c *confFile) split() (*ProvisionConf, *GuestConf) {
+	c.ProvisionConf.Name, c.GuestConf.Name = c.Name, c.Name
+	c.ProvisionConf.StoragePool, c.GuestConf.StoragePool = c.StoragePool, c.StoragePool
+	return c.ProvisionConf, c.GuestConf
+}
+
+// ConfFormat returns the format of the config file at path by its extension:
+// "yaml" for .yaml and .yml, "toml" for .toml, and "json" otherwise.
+func ConfFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".toml":
+		return "toml"
+	}
+	return "json"
+}
+
+// toJSON converts data of the given format to JSON, so that config files of
+// any format are decoded by the json tags of the config types.
+func toJSON(data []byte, format string) ([]byte, error) {
+	var v interface{}
+	switch format {
+	case "json":
+		return data, nil
+	case "yaml":
+		if err := yaml.UnmarshalStrict(data, &v); err != nil {
+			return nil, err
+		}
+		v = stringKeys(v)
+	case "toml":
+		m := map[string]interface{}{}
+		if _, err := toml.Decode(string(data), &m); err != nil {
+			return nil, err
+		}
+		v = m
+	default:
+		return nil, fmt.Errorf("unsupported config format %q, expected json, yaml or toml", format)
+	}
+	return json.Marshal(v)
+}
+
+// stringKeys converts the map[interface{}]interface{} values that YAML
+// mappings are decoded into to map[string]interface{}, recursively.
+func stringKeys(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for k, e := range v {
+			m[fmt.Sprint(k)] = stringKeys(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range v {
+			v[i] = stringKeys(e)
+		}
+	}
+	return v
+}
+
+// decodeStrict unmarshals data of the given format into v, rejecting unknown
+// fields, which are most likely typos.
+func decodeStrict(data []byte, format string, v interface{}) error {
+	data, err := toJSON(data, format)
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// ParseConf parses a config file of the given format (json, yaml or toml) into
+// its provisioning and launch options. Unknown options are rejected.
+func ParseConf(data []byte, format string) (*ProvisionConf, *GuestConf, error) {
+	c := newConfFile()
+	if err := decodeStrict(data, format, c); err != nil {
+		return nil, nil, fmt.Errorf("failed to unmarshal config: %v", err)
+	}
+	pc, gc := c.split()
+	return pc, gc, nil
+}
+
+// SchemaID is the URL of the JSON Schema of config files.
+const SchemaID = "https://raw.githubusercontent.com/anastop/virgo/master/virgo.schema.json"
+
+// typeSchema returns the JSON Schema of values of type t.
+func typeSchema(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Ptr:
+		return typeSchema(t.Elem())
+	case reflect.Struct:
+		props := map[string]interface{}{}
+		addProperties(props, t)
+		return map[string]interface{}{"type": "object", "properties": props, "additionalProperties": false}
+	}
+	panic(fmt.Sprintf("no JSON Schema for type %v", t))
+}
+
+// addProperties adds the JSON Schema of the fields of the struct type t to
+// props, by their json tags. Fields without a json tag are skipped, and the
+// fields of embedded structs are added as t's own.
+func addProperties(props map[string]interface{}, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			addProperties(props, ft)
+			continue
+		}
+
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		props[name] = typeSchema(f.Type)
+	}
+}
+
+// ConfSchema returns the JSON Schema of config files, generated from the json
+// tags of ProvisionConf and GuestConf.
+func ConfSchema() ([]byte, error) {
+	schema := typeSchema(reflect.TypeOf(confFile{}))
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["$id"] = SchemaID
+	schema["title"] = "virgo provisioning and launch options"
+
+	// extends is resolved before config files are decoded; see LoadConf
+	props := schema["properties"].(map[string]interface{})
+	props[extendsKey] = map[string]interface{}{
+		"oneOf": []interface{}{
+			map[string]interface{}{"type": "string"},
+			map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+		},
+	}
+
+	out, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal schema: %v", err)
+	}
+	return append(out, '\n'), nil
+}
@@ -0,0 +1,216 @@
+package virgo
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// DefaultURI is the libvirt URI used when no other URI is specified.
+const DefaultURI = "qemu:///system"
+
+const (
+	systemSocket   = "/var/run/libvirt/libvirt-sock"
+	defaultTCPPort = "16509"
+	dialTimeout    = 2 * time.Second
+)
+
+// DefaultConnectURI returns the URI set in LIBVIRT_DEFAULT_URI, or DefaultURI if unset.
+func DefaultConnectURI() string {
+	if uri := os.Getenv("LIBVIRT_DEFAULT_URI"); uri != "" {
+		return uri
+	}
+	return DefaultURI
+}
+
+// NewLibvirtConn opens a connection to the libvirt daemon identified by uri.
+// Supported URIs are of the form qemu:///system, qemu:///session,
+// qemu+unix:///system, qemu+tcp://host[:port]/system and
+// qemu+ssh://[user@]host[:port]/system. An empty uri means DefaultURI.
+func NewLibvirtConn(uri string) (*libvirt.Libvirt, error) {
+	u, c, err := dialConnectURI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	rpcconn := libvirt.New(c)
+	// libvirt requires that we call auth-list prior to connecting,
+	// even when no authentication is used.
+	if _, err := rpcconn.AuthList(); err != nil {
+		return nil, fmt.Errorf("failed to list auth types of libvirt daemon: %v", err)
+	}
+
+	if err := rpcconn.ConnectOpen(libvirt.OptString{connectName(u)}, 0); err != nil {
+		return nil, fmt.Errorf("failed to open connection with libvirt daemon: %v", err)
+	}
+
+	return rpcconn, nil
+}
+
+// dialConnectURI parses uri, DefaultURI if empty, and dials the libvirt daemon
+// that it identifies.
+func dialConnectURI(uri string) (*url.URL, net.Conn, error) {
+	if uri == "" {
+		uri = DefaultURI
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse connection URI %s: %v", uri, err)
+	}
+
+	c, err := dialURI(u)
+	if err != nil {
+		return nil, nil, err
+	}
+	return u, c, nil
+}
+
+// connectName returns the name of the connection to open with the daemon
+// identified by u.
+func connectName(u *url.URL) string {
+	return fmt.Sprintf("qemu://%s", u.Path)
+}
+
+func dialURI(u *url.URL) (net.Conn, error) {
+	driver, transport := u.Scheme, ""
+	if i := strings.Index(u.Scheme, "+"); i >= 0 {
+		driver, transport = u.Scheme[:i], u.Scheme[i+1:]
+	}
+	if driver != "qemu" {
+		return nil, fmt.Errorf("unsupported hypervisor driver %q in %s", driver, u)
+	}
+	if u.Path != "/system" && u.Path != "/session" {
+		return nil, fmt.Errorf("unsupported connection path %q in %s, expected /system or /session", u.Path, u)
+	}
+
+	switch transport {
+	case "", "unix":
+		if u.Host != "" && transport == "" {
+			return nil, fmt.Errorf("remote URI %s requires a transport, e.g. qemu+ssh or qemu+tcp", u)
+		}
+		sockpath, err := socketPath(u)
+		if err != nil {
+			return nil, err
+		}
+		c, err := net.DialTimeout("unix", sockpath, dialTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open libvirt socket %s: %v", sockpath, err)
+		}
+		return c, nil
+
+	case "tcp":
+		addr := u.Host
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), defaultTCPPort)
+		}
+		c, err := net.DialTimeout("tcp", addr, dialTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to libvirt daemon at %s: %v", addr, err)
+		}
+		return c, nil
+
+	case "ssh":
+		return dialSSH(u)
+	}
+
+	return nil, fmt.Errorf("unsupported transport %q in %s", transport, u)
+}
+
+// socketPath returns the path of the libvirt socket for a local URI.
+func socketPath(u *url.URL) (string, error) {
+	if s := u.Query().Get("socket"); s != "" {
+		return s, nil
+	}
+
+	if u.Path == "/system" {
+		return systemSocket, nil
+	}
+
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "libvirt", "libvirt-sock"), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to determine session socket path: %v", err)
+	}
+	return filepath.Join(home, ".cache", "libvirt", "libvirt-sock"), nil
+}
+
+// dialSSH tunnels the libvirt RPC protocol through an ssh session to the
+// remote host, where netcat relays it to the daemon's unix socket.
+func dialSSH(u *url.URL) (net.Conn, error) {
+	sockpath := u.Query().Get("socket")
+	if sockpath == "" {
+		sockpath = systemSocket
+		if u.Path == "/session" {
+			return nil, fmt.Errorf("session URIs over ssh require an explicit ?socket= path")
+		}
+	}
+
+	args := []string{"-T", "-e", "none", "-o", "BatchMode=yes"}
+	if u.Port() != "" {
+		args = append(args, "-p", u.Port())
+	}
+	if u.User != nil {
+		args = append(args, "-l", u.User.Username())
+	}
+	args = append(args, u.Hostname(), "nc", "-U", sockpath)
+
+	cmd := exec.Command("ssh", args...)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to execute %v: %v", cmd.Args, err)
+	}
+
+	return &cmdConn{cmd: cmd, r: stdout, w: stdin, host: u.Hostname()}, nil
+}
+
+// cmdConn adapts the standard streams of a running command to a net.Conn.
+type cmdConn struct {
+	cmd  *exec.Cmd
+	r    io.ReadCloser
+	w    io.WriteCloser
+	host string
+}
+
+type cmdAddr string
+
+func (a cmdAddr) Network() string { return "ssh" }
+func (a cmdAddr) String() string  { return string(a) }
+
+func (c *cmdConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *cmdConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+
+func (c *cmdConn) Close() error {
+	c.w.Close()
+	c.r.Close()
+	c.cmd.Process.Kill()
+	c.cmd.Wait()
+	return nil
+}
+
+func (c *cmdConn) LocalAddr() net.Addr                { return cmdAddr("localhost") }
+func (c *cmdConn) RemoteAddr() net.Addr               { return cmdAddr(c.host) }
+func (c *cmdConn) SetDeadline(t time.Time) error      { return nil }
+func (c *cmdConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *cmdConn) SetWriteDeadline(t time.Time) error { return nil }
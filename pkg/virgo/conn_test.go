@@ -0,0 +1,53 @@
+package virgo
+
+import (
+	"net/url"
+	"os"
+	"testing"
+)
+
+func TestSocketPath(t *testing.T) {
+	tests := []struct {
+		uri     string
+		runtime string
+		want    string
+	}{
+		{"qemu:///system", "/run/user/1000", "/var/run/libvirt/libvirt-sock"},
+		{"qemu:///session", "/run/user/1000", "/run/user/1000/libvirt/libvirt-sock"},
+		{"qemu+unix:///system?socket=/tmp/sock", "", "/tmp/sock"},
+	}
+
+	defer os.Setenv("XDG_RUNTIME_DIR", os.Getenv("XDG_RUNTIME_DIR"))
+
+	for _, tt := range tests {
+		os.Setenv("XDG_RUNTIME_DIR", tt.runtime)
+		u, err := url.Parse(tt.uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := socketPath(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("socketPath(%s) = %s, want %s", tt.uri, got, tt.want)
+		}
+	}
+}
+
+func TestDialURIErrors(t *testing.T) {
+	for _, uri := range []string{
+		"xen:///system",
+		"qemu:///foo",
+		"qemu://host/system",
+		"qemu+tls://host/system",
+	} {
+		u, err := url.Parse(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dialURI(u); err == nil {
+			t.Errorf("dialURI(%s) succeeded, want error", uri)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package virgo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// ConsoleEscape is the byte that detaches from a console, i.e. Ctrl-].
+const ConsoleEscape = 0x1d
+
+// The subset of libvirt's RPC protocol that consoles use. go-libvirt only
+// streams a console's output, so consoles run on a connection of their own,
+// which carries the guest's input as well.
+const (
+	remoteProgram = 0x20008086
+	remoteVersion = 1
+
+	procConnectOpen        = 1
+	procDomainLookupByName = 23
+	procAuthList           = 66
+	procDomainOpenConsole  = 201
+
+	packetCall   = 0
+	packetReply  = 1
+	packetStream = 3
+
+	statusOK       = 0
+	statusError    = 1
+	statusContinue = 2
+
+	// maxPacketSize is the largest packet that libvirt sends.
+	maxPacketSize = 4 << 20
+)
+
+type rpcHeader struct {
+	Program   uint32
+	Version   uint32
+	Procedure uint32
+	Type      uint32
+	Serial    uint32
+	Status    uint32
+}
+
+// rpcConn exchanges libvirt RPC packets over rw.
+type rpcConn struct {
+	rw     io.ReadWriter
+	mu     sync.Mutex
+	serial uint32
+}
+
+func (c *rpcConn) writePacket(h rpcHeader, payload []byte) error {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(4+binary.Size(h)+len(payload)))
+	binary.Write(&buf, binary.BigEndian, h)
+	buf.Write(payload)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.rw.Write(buf.Bytes())
+	return err
+}
+
+func (c *rpcConn) readPacket() (rpcHeader, []byte, error) {
+	var size uint32
+	var h rpcHeader
+	if err := binary.Read(c.rw, binary.BigEndian, &size); err != nil {
+		return h, nil, err
+	}
+	if int(size) < 4+binary.Size(h) || size > maxPacketSize {
+		return h, nil, fmt.Errorf("invalid RPC packet size %d", size)
+	}
+	if err := binary.Read(c.rw, binary.BigEndian, &h); err != nil {
+		return h, nil, err
+	}
+	payload := make([]byte, int(size)-4-binary.Size(h))
+	if _, err := io.ReadFull(c.rw, payload); err != nil {
+		return h, nil, err
+	}
+	return h, payload, nil
+}
+
+// call calls the procedure proc with the XDR encoded args, and returns the
+// serial of the call and the payload of its reply.
+func (c *rpcConn) call(proc uint32, args []byte) (uint32, []byte, error) {
+	c.serial++
+	serial := c.serial
+	h := rpcHeader{Program: remoteProgram, Version: remoteVersion, Procedure: proc, Type: packetCall, Serial: serial, Status: statusOK}
+	if err := c.writePacket(h, args); err != nil {
+		return 0, nil, err
+	}
+
+	for {
+		h, payload, err := c.readPacket()
+		if err != nil {
+			return 0, nil, err
+		}
+		if h.Type != packetReply || h.Serial != serial {
+			continue
+		}
+		if h.Status == statusError {
+			return 0, nil, decodeRemoteError(payload)
+		}
+		return serial, payload, nil
+	}
+}
+
+// sendStream sends data on the stream opened by the call of the procedure proc
+// with the given serial, with status statusContinue, or statusOK to finish it.
+func (c *rpcConn) sendStream(proc, serial, status uint32, data []byte) error {
+	h := rpcHeader{Program: remoteProgram, Version: remoteVersion, Procedure: proc, Type: packetStream, Serial: serial, Status: status}
+	return c.writePacket(h, data)
+}
+
+// xdrString returns the XDR encoding of s.
+func xdrString(s string) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(len(s)))
+	buf.WriteString(s)
+	buf.Write(make([]byte, (4-len(s)%4)%4))
+	return buf.Bytes()
+}
+
+// xdrOptString returns the XDR encoding of an optional string, which is null
+// if s is empty.
+func xdrOptString(s string) []byte {
+	if s == "" {
+		return xdrUint32(0)
+	}
+	return append(xdrUint32(1), xdrString(s)...)
+}
+
+func xdrUint32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+// decodeRemoteError returns the error of a libvirt error reply.
+func decodeRemoteError(payload []byte) error {
+	r := bytes.NewReader(payload)
+	var code, domain, hasMessage, length uint32
+	binary.Read(r, binary.BigEndian, &code)
+	binary.Read(r, binary.BigEndian, &domain)
+	if err := binary.Read(r, binary.BigEndian, &hasMessage); err != nil || hasMessage == 0 {
+		return fmt.Errorf("libvirt error %d", code)
+	}
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil || int(length) > r.Len() {
+		return fmt.Errorf("libvirt error %d", code)
+	}
+	message := make([]byte, length)
+	r.Read(message)
+	return fmt.Errorf("%s", message)
+}
+
+// Console attaches in and out to the serial console of a running guest, on
+// the libvirt daemon identified by uri, until ConsoleEscape is read from in or
+// the guest shuts down.
+func Console(l *libvirt.Libvirt, uri, guest string, in io.Reader, out io.Writer) error {
+	dom, err := l.DomainLookupByName(guest)
+	if err != nil {
+		return fmt.Errorf("failed to lookup domain %s: %v", guest, err)
+	}
+
+	state, _, err := l.DomainGetState(dom, 0)
+	if err != nil {
+		return fmt.Errorf("failed to get state of domain %s: %v", guest, err)
+	}
+	if libvirt.DomainState(state) != libvirt.DomainRunning {
+		return fmt.Errorf("domain %s is not running", guest)
+	}
+
+	u, c, err := dialConnectURI(uri)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	return console(c, connectName(u), guest, in, out)
+}
+
+// console opens the connection name over rw, and attaches in and out to the
+// serial console of guest.
+func console(rw io.ReadWriter, name, guest string, in io.Reader, out io.Writer) error {
+	c := &rpcConn{rw: rw}
+
+	// libvirt requires that we call auth-list prior to connecting
+	if _, _, err := c.call(procAuthList, nil); err != nil {
+		return fmt.Errorf("failed to list auth types of libvirt daemon: %v", err)
+	}
+	if _, _, err := c.call(procConnectOpen, append(xdrOptString(name), xdrUint32(0)...)); err != nil {
+		return fmt.Errorf("failed to open connection with libvirt daemon: %v", err)
+	}
+
+	// the reply is the domain that the console is opened on
+	_, dom, err := c.call(procDomainLookupByName, xdrString(guest))
+	if err != nil {
+		return fmt.Errorf("failed to lookup domain %s: %v", guest, err)
+	}
+
+	args := append(append(dom, xdrOptString("")...), xdrUint32(uint32(libvirt.DomainConsoleSafe))...)
+	serial, _, err := c.call(procDomainOpenConsole, args)
+	if err != nil {
+		return fmt.Errorf("failed to open console of domain %s: %v", guest, err)
+	}
+
+	outputErr := make(chan error, 1)
+	go func() {
+		outputErr <- forwardConsoleOutput(c, serial, out)
+	}()
+
+	inputErr := make(chan error, 1)
+	go func() {
+		inputErr <- forwardConsoleInput(c, serial, in)
+	}()
+
+	select {
+	case err = <-outputErr:
+	case err = <-inputErr:
+		if err != nil {
+			return err
+		}
+		// the daemon acknowledges the end of the stream
+		err = <-outputErr
+	}
+	if err != nil {
+		return fmt.Errorf("console stream of domain %s failed: %v", guest, err)
+	}
+	return nil
+}
+
+// forwardConsoleOutput copies the data of the console stream with the given
+// serial to out, until the stream ends.
+func forwardConsoleOutput(c *rpcConn, serial uint32, out io.Writer) error {
+	for {
+		h, payload, err := c.readPacket()
+		if err != nil {
+			return err
+		}
+		if h.Type != packetStream || h.Serial != serial {
+			continue
+		}
+
+		switch h.Status {
+		case statusContinue:
+			if _, err := out.Write(payload); err != nil {
+				return err
+			}
+		case statusError:
+			return decodeRemoteError(payload)
+		default:
+			return nil
+		}
+	}
+}
+
+// forwardConsoleInput sends in on the console stream with the given serial,
+// until ConsoleEscape is read or in ends, and then finishes the stream.
+func forwardConsoleInput(c *rpcConn, serial uint32, in io.Reader) error {
+	buf := make([]byte, 1024)
+	for {
+		n, err := in.Read(buf)
+		data := buf[:n]
+		i := bytes.IndexByte(data, ConsoleEscape)
+		if i >= 0 {
+			data = data[:i]
+		}
+		if len(data) > 0 {
+			if err := c.sendStream(procDomainOpenConsole, serial, statusContinue, data); err != nil {
+				return fmt.Errorf("failed to write to console: %v", err)
+			}
+		}
+		if i >= 0 || err == io.EOF {
+			return c.sendStream(procDomainOpenConsole, serial, statusOK, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package virgo
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeConsoleDaemon answers the calls that open the console of guest "foo" on
+// c, sends "login: " on the console, and returns what the client sent on the
+// console stream until the client finished it.
+func fakeConsoleDaemon(c net.Conn) (string, error) {
+	s := &rpcConn{rw: c}
+	dom := append(xdrString("foo"), make([]byte, 20)...)
+
+	var console uint32
+	for _, proc := range []uint32{procAuthList, procConnectOpen, procDomainLookupByName, procDomainOpenConsole} {
+		h, payload, err := s.readPacket()
+		if err != nil {
+			return "", err
+		}
+		if h.Type != packetCall || h.Procedure != proc {
+			return "", fmt.Errorf("got call of procedure %d, want %d", h.Procedure, proc)
+		}
+
+		var reply []byte
+		switch proc {
+		case procConnectOpen:
+			if want := append(xdrOptString("qemu:///system"), xdrUint32(0)...); !bytes.Equal(payload, want) {
+				return "", fmt.Errorf("connect-open args %x, want %x", payload, want)
+			}
+		case procDomainLookupByName:
+			if want := xdrString("foo"); !bytes.Equal(payload, want) {
+				return "", fmt.Errorf("lookup-by-name args %x, want %x", payload, want)
+			}
+			reply = dom
+		case procDomainOpenConsole:
+			if want := append(append(dom, xdrUint32(0)...), xdrUint32(2)...); !bytes.Equal(payload, want) {
+				return "", fmt.Errorf("open-console args %x, want %x", payload, want)
+			}
+			console = h.Serial
+		}
+
+		h.Type = packetReply
+		if err := s.writePacket(h, reply); err != nil {
+			return "", err
+		}
+	}
+
+	if err := s.sendStream(procDomainOpenConsole, console, statusContinue, []byte("login: ")); err != nil {
+		return "", err
+	}
+
+	var input bytes.Buffer
+	for {
+		h, payload, err := s.readPacket()
+		if err != nil {
+			return "", err
+		}
+		if h.Type != packetStream || h.Serial != console {
+			return "", fmt.Errorf("got packet of type %d and serial %d, want stream data of serial %d", h.Type, h.Serial, console)
+		}
+		if h.Status == statusOK {
+			break
+		}
+		input.Write(payload)
+	}
+
+	// the daemon acknowledges the end of the stream
+	return input.String(), s.sendStream(procDomainOpenConsole, console, statusOK, nil)
+}
+
+// promptWriter closes seen once prompt is written to it.
+type promptWriter struct {
+	bytes.Buffer
+	prompt string
+	seen   chan struct{}
+}
+
+func (w *promptWriter) Write(p []byte) (int, error) {
+	n, err := w.Buffer.Write(p)
+	if strings.Contains(w.String(), w.prompt) {
+		close(w.seen)
+		w.prompt = "\x00never"
+	}
+	return n, err
+}
+
+func TestConsole(t *testing.T) {
+	client, daemon := net.Pipe()
+	defer client.Close()
+
+	type result struct {
+		input string
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		input, err := fakeConsoleDaemon(daemon)
+		daemon.Close()
+		done <- result{input, err}
+	}()
+
+	// the input is only sent after the login prompt is output, so the output
+	// is complete when the console detaches
+	out := &promptWriter{prompt: "login: ", seen: make(chan struct{})}
+	pr, pw := io.Pipe()
+	go func() {
+		<-out.seen
+		pw.Write([]byte("root\rls -l\r\x1dnot sent"))
+	}()
+
+	if err := console(client, "qemu:///system", "foo", pr, out); err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if r.input != "root\rls -l\r" {
+		t.Errorf("got console input %q, want %q", r.input, "root\rls -l\r")
+	}
+}
+
+func TestDecodeRemoteError(t *testing.T) {
+	payload := append(append(append(xdrUint32(42), xdrUint32(10)...), xdrUint32(1)...), xdrString("domain is not running")...)
+	if err := decodeRemoteError(payload); err == nil || err.Error() != "domain is not running" {
+		t.Errorf("got error %v, want %q", err, "domain is not running")
+	}
+
+	if err := decodeRemoteError(append(xdrUint32(42), xdrUint32(10)...)); err == nil || err.Error() != "libvirt error 42" {
+		t.Errorf("got error %v, want %q", err, "libvirt error 42")
+	}
+}
@@ -0,0 +1,343 @@
+package virgo
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// CPUTune pins a guest's vCPUs, emulator and I/O threads to host CPUs, and sets
+// the scheduling policy of its vCPUs, e.g. for DPDK guests to run undisturbed.
+type CPUTune struct {
+	// Auto pins the vCPUs one-to-one to the isolated host CPUs (see the isolcpus
+	// kernel parameter) of the NUMA node that HostNIC is attached to, and the
+	// emulator and I/O threads to the node's other CPUs, when the guest is
+	// launched. Explicit pins take precedence.
+	Auto bool `json:"auto,omitempty"`
+	// HostNIC is the network device name or PCI address of the host NIC that
+	// the guest's vhostuser interfaces are switched to.
+	HostNIC      string        `json:"host_nic,omitempty"`
+	VcpuPins     []VcpuPin     `json:"vcpu_pins,omitempty"`
+	EmulatorPin  string        `json:"emulator_pin,omitempty"`
+	IOThreads    int           `json:"iothreads,omitempty"`
+	IOThreadPins []IOThreadPin `json:"iothread_pins,omitempty"`
+	VcpuSched    []VcpuSched   `json:"vcpu_sched,omitempty"`
+}
+
+// VcpuPin pins a vCPU to the host CPUs of a cpuset, e.g. "2" or "2-3".
+type VcpuPin struct {
+	Vcpu   int    `json:"vcpu"`
+	CPUSet string `json:"cpuset,omitempty"`
+}
+
+// IOThreadPin pins an I/O thread, numbered from 1, to the host CPUs of a cpuset.
+type IOThreadPin struct {
+	IOThread int    `json:"iothread"`
+	CPUSet   string `json:"cpuset,omitempty"`
+}
+
+// VcpuSched sets the scheduler of the vCPUs of a cpuset: fifo or rr, which are
+// realtime and take a priority from 1 to 99, batch or idle.
+type VcpuSched struct {
+	Vcpus     string `json:"vcpus,omitempty"`
+	Scheduler string `json:"scheduler,omitempty"`
+	Priority  int    `json:"priority,omitempty"`
+}
+
+// cputuneDesc returns the cputune element of t's pins and schedulers, or nil if
+// it has none.
+func cputuneDesc(t *CPUTune) *DomainCPUTune {
+	ct := &DomainCPUTune{}
+	for _, p := range t.VcpuPins {
+		ct.VCPUPins = append(ct.VCPUPins, DomainVCPUPin{VCPU: p.Vcpu, CPUSet: p.CPUSet})
+	}
+	if t.EmulatorPin != "" {
+		ct.EmulatorPin = &DomainEmulatorPin{CPUSet: t.EmulatorPin}
+	}
+	for _, p := range t.IOThreadPins {
+		ct.IOThreadPins = append(ct.IOThreadPins, DomainIOThreadPin{IOThread: p.IOThread, CPUSet: p.CPUSet})
+	}
+	for _, s := range t.VcpuSched {
+		ct.VCPUScheds = append(ct.VCPUScheds, DomainVCPUSched{VCPUs: s.Vcpus, Scheduler: s.Scheduler, Priority: s.Priority})
+	}
+
+	if len(ct.VCPUPins) == 0 && ct.EmulatorPin == nil && len(ct.IOThreadPins) == 0 && len(ct.VCPUScheds) == 0 {
+		return nil
+	}
+	return ct
+}
+
+// sysfsRoot is where sysfs is mounted; tests point it to a fake tree.
+var sysfsRoot = "/sys"
+
+// readCPUSet reads the cpuset in the sysfs file at path, which may be empty.
+func readCPUSet(path string) ([]int, error) {
+	data, err := ioutil.ReadFile(filepath.Join(sysfsRoot, path))
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(string(data)) == "" {
+		return nil, nil
+	}
+	return ParseCPUSet(strings.TrimSpace(string(data)))
+}
+
+// nicNUMANode returns the NUMA node of the host NIC called nic, or at the PCI
+// address nic. NICs without NUMA affinity, i.e. on single node hosts, are on 0.
+func nicNUMANode(nic string) (int, error) {
+	path := filepath.Join(sysfsRoot, "class", "net", nic, "device", "numa_node")
+	if strings.Contains(nic, ":") {
+		path = filepath.Join(sysfsRoot, "bus", "pci", "devices", nic, "numa_node")
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read NUMA node of host NIC %s: %v", nic, err)
+	}
+	node, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse NUMA node of host NIC %s: %v", nic, err)
+	}
+	if node < 0 {
+		node = 0
+	}
+	return node, nil
+}
+
+// nodeCPUs returns the host CPUs of NUMA node.
+func nodeCPUs(node int) ([]int, error) {
+	cpus, err := readCPUSet(filepath.Join("devices", "system", "node", fmt.Sprintf("node%d", node), "cpulist"))
+	if os.IsNotExist(err) && node == 0 {
+		// kernels without NUMA support have no node directories
+		cpus, err = readCPUSet(filepath.Join("devices", "system", "cpu", "online"))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CPUs of NUMA node %d: %v", node, err)
+	}
+	return cpus, nil
+}
+
+// cpus returns the host CPUs that t pins vCPUs, the emulator or I/O threads to.
+func (t *DomainCPUTune) cpus() ([]int, error) {
+	sets := []string{}
+	for _, p := range t.VCPUPins {
+		sets = append(sets, p.CPUSet)
+	}
+	if t.EmulatorPin != nil {
+		sets = append(sets, t.EmulatorPin.CPUSet)
+	}
+	for _, p := range t.IOThreadPins {
+		sets = append(sets, p.CPUSet)
+	}
+
+	var cpus []int
+	for _, s := range sets {
+		ids, err := ParseCPUSet(s)
+		if err != nil {
+			return nil, err
+		}
+		cpus = append(cpus, ids...)
+	}
+	return cpus, nil
+}
+
+// cpuPinMu serializes picking the CPUs of guests launched in parallel with the
+// start of their domains, so that no two of them pick the same CPUs.
+var cpuPinMu sync.Mutex
+
+// pinnedCPUs returns the host CPUs that running domains, other than guest, are
+// pinned to.
+func pinnedCPUs(l *libvirt.Libvirt, guest string) (map[int]bool, error) {
+	doms, _, err := l.ConnectListAllDomains(1, libvirt.ConnectListDomainsActive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list running domains: %v", err)
+	}
+
+	pinned := map[int]bool{}
+	for _, dom := range doms {
+		if dom.Name == guest {
+			continue
+		}
+		d, err := GetDomainDesc(l, dom)
+		if err != nil {
+			return nil, err
+		}
+		if d.CPUTune == nil {
+			continue
+		}
+		cpus, err := d.CPUTune.cpus()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CPU pins of domain %s: %v", dom.Name, err)
+		}
+		for _, cpu := range cpus {
+			pinned[cpu] = true
+		}
+	}
+	return pinned, nil
+}
+
+// autoCPUTune returns t with the pins that Auto picks for a guest of numVcpus
+// vCPUs added to its explicit ones, reading the host's CPUs and NICs in sysfs.
+// The host CPUs in taken, i.e. pinned by other guests, are left alone.
+func autoCPUTune(t *CPUTune, numVcpus int, taken map[int]bool) (*CPUTune, error) {
+	node, err := nicNUMANode(t.HostNIC)
+	if err != nil {
+		return nil, err
+	}
+
+	cpus, err := nodeCPUs(node)
+	if err != nil {
+		return nil, err
+	}
+
+	isolated, err := readCPUSet(filepath.Join("devices", "system", "cpu", "isolated"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read isolated CPUs: %v", err)
+	}
+	isIsolated := map[int]bool{}
+	for _, cpu := range isolated {
+		isIsolated[cpu] = true
+	}
+
+	r := *t
+	r.Auto = false
+	r.VcpuPins = append([]VcpuPin{}, t.VcpuPins...)
+	r.IOThreadPins = append([]IOThreadPin{}, t.IOThreadPins...)
+
+	pinned := map[int]bool{}
+	used := map[int]bool{}
+	for _, p := range t.VcpuPins {
+		pinned[p.Vcpu] = true
+		ids, err := ParseCPUSet(p.CPUSet)
+		if err != nil {
+			return nil, fmt.Errorf("vcpu_pins: %v", err)
+		}
+		for _, id := range ids {
+			used[id] = true
+		}
+	}
+
+	var free, housekeeping []int
+	for _, cpu := range cpus {
+		switch {
+		case !isIsolated[cpu]:
+			housekeeping = append(housekeeping, cpu)
+		case !used[cpu] && !taken[cpu]:
+			free = append(free, cpu)
+		}
+	}
+
+	needed := numVcpus - len(pinned)
+	if needed > len(free) {
+		return nil, fmt.Errorf("NUMA node %d of host NIC %s has %d free isolated CPUs (%s), but %d vCPUs need pinning",
+			node, t.HostNIC, len(free), FormatCPUSet(free), needed)
+	}
+
+	for vcpu := 0; vcpu < numVcpus; vcpu++ {
+		if pinned[vcpu] {
+			continue
+		}
+		r.VcpuPins = append(r.VcpuPins, VcpuPin{Vcpu: vcpu, CPUSet: strconv.Itoa(free[0])})
+		free = free[1:]
+	}
+	sort.Slice(r.VcpuPins, func(i, j int) bool { return r.VcpuPins[i].Vcpu < r.VcpuPins[j].Vcpu })
+
+	if len(housekeeping) == 0 {
+		// all of the node's CPUs are isolated; use the ones left over
+		housekeeping = free
+	}
+	if len(housekeeping) == 0 {
+		return nil, fmt.Errorf("NUMA node %d of host NIC %s has no CPUs left for the emulator and I/O threads", node, t.HostNIC)
+	}
+
+	if r.EmulatorPin == "" {
+		r.EmulatorPin = FormatCPUSet(housekeeping)
+	}
+
+	iothreadPinned := map[int]bool{}
+	for _, p := range t.IOThreadPins {
+		iothreadPinned[p.IOThread] = true
+	}
+	for id := 1; id <= t.IOThreads; id++ {
+		if !iothreadPinned[id] {
+			r.IOThreadPins = append(r.IOThreadPins, IOThreadPin{IOThread: id, CPUSet: FormatCPUSet(housekeeping)})
+		}
+	}
+	sort.Slice(r.IOThreadPins, func(i, j int) bool { return r.IOThreadPins[i].IOThread < r.IOThreadPins[j].IOThread })
+
+	return &r, nil
+}
+
+// validate checks t for problems, given that the guest has numVcpus vCPUs.
+func (t *CPUTune) validate(e *ConfError, numVcpus int) {
+	if t.Auto && t.HostNIC == "" {
+		e.add("guest_cputune: host_nic is required for auto pinning")
+	}
+
+	vcpus := map[int]bool{}
+	for i, p := range t.VcpuPins {
+		field := fmt.Sprintf("guest_cputune.vcpu_pins[%d]", i)
+		if p.Vcpu < 0 || (numVcpus > 0 && p.Vcpu >= numVcpus) {
+			e.add("%s: vCPU %d is out of range, the guest has %d vCPUs", field, p.Vcpu, numVcpus)
+		} else if vcpus[p.Vcpu] {
+			e.add("%s: vCPU %d is already pinned", field, p.Vcpu)
+		}
+		vcpus[p.Vcpu] = true
+		if _, err := ParseCPUSet(p.CPUSet); err != nil {
+			e.add("%s: cpuset: %v", field, err)
+		}
+	}
+
+	if t.EmulatorPin != "" {
+		if _, err := ParseCPUSet(t.EmulatorPin); err != nil {
+			e.add("guest_cputune.emulator_pin: %v", err)
+		}
+	}
+
+	if t.IOThreads < 0 {
+		e.add("guest_cputune.iothreads should not be negative, got %d", t.IOThreads)
+	}
+	iothreads := map[int]bool{}
+	for i, p := range t.IOThreadPins {
+		field := fmt.Sprintf("guest_cputune.iothread_pins[%d]", i)
+		if p.IOThread < 1 || p.IOThread > t.IOThreads {
+			e.add("%s: I/O thread %d is out of range, the guest has %d I/O threads, numbered from 1", field, p.IOThread, t.IOThreads)
+		} else if iothreads[p.IOThread] {
+			e.add("%s: I/O thread %d is already pinned", field, p.IOThread)
+		}
+		iothreads[p.IOThread] = true
+		if _, err := ParseCPUSet(p.CPUSet); err != nil {
+			e.add("%s: cpuset: %v", field, err)
+		}
+	}
+
+	for i, s := range t.VcpuSched {
+		field := fmt.Sprintf("guest_cputune.vcpu_sched[%d]", i)
+		ids, err := ParseCPUSet(s.Vcpus)
+		if err != nil {
+			e.add("%s: vcpus: %v", field, err)
+		} else if numVcpus > 0 && len(ids) > 0 && ids[len(ids)-1] >= numVcpus {
+			e.add("%s: vCPU %d is out of range, the guest has %d vCPUs", field, ids[len(ids)-1], numVcpus)
+		}
+
+		switch s.Scheduler {
+		case "fifo", "rr":
+			if s.Priority < 1 || s.Priority > 99 {
+				e.add("%s: priority should be from 1 to 99 for the %s scheduler, got %d", field, s.Scheduler, s.Priority)
+			}
+		case "batch", "idle":
+			if s.Priority != 0 {
+				e.add("%s: priority is only supported by the fifo and rr schedulers", field)
+			}
+		default:
+			e.add("%s: scheduler %q is unsupported, expected fifo, rr, batch or idle", field, s.Scheduler)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package virgo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeSysfs writes the sysfs files of a host with two NUMA nodes of 8 CPUs,
+// 2-7 and 10-15 of which are isolated, and NIC ens1f0 on node 1.
+func fakeSysfs(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "virgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		"devices/system/node/node0/cpulist":      "0-7\n",
+		"devices/system/node/node1/cpulist":      "8-15\n",
+		"devices/system/cpu/isolated":            "2-7,10-15\n",
+		"class/net/ens1f0/device/numa_node":      "1\n",
+		"bus/pci/devices/0000:03:00.0/numa_node": "-1\n",
+	}
+	for path, data := range files {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestAutoCPUTune(t *testing.T) {
+	dir := fakeSysfs(t)
+	defer os.RemoveAll(dir)
+
+	root := sysfsRoot
+	defer func() { sysfsRoot = root }()
+	sysfsRoot = dir
+
+	tune := &CPUTune{
+		Auto:      true,
+		HostNIC:   "ens1f0",
+		VcpuPins:  []VcpuPin{{Vcpu: 1, CPUSet: "10"}},
+		IOThreads: 1,
+	}
+	got, err := autoCPUTune(tune, 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &CPUTune{
+		HostNIC:      "ens1f0",
+		VcpuPins:     []VcpuPin{{Vcpu: 0, CPUSet: "11"}, {Vcpu: 1, CPUSet: "10"}, {Vcpu: 2, CPUSet: "12"}},
+		EmulatorPin:  "8-9",
+		IOThreads:    1,
+		IOThreadPins: []IOThreadPin{{IOThread: 1, CPUSet: "8-9"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if !tune.Auto || len(tune.VcpuPins) != 1 {
+		t.Errorf("auto pinning should leave the config as is, got %+v", tune)
+	}
+
+	// NICs without NUMA affinity are on node 0
+	got, err = autoCPUTune(&CPUTune{Auto: true, HostNIC: "0000:03:00.0"}, 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.VcpuPins[0].CPUSet != "2" || got.VcpuPins[1].CPUSet != "3" || got.EmulatorPin != "0-1" {
+		t.Errorf("unexpected pins on node 0: %+v", got)
+	}
+
+	if _, err := autoCPUTune(&CPUTune{Auto: true, HostNIC: "ens1f0"}, 8, nil); err == nil || !strings.Contains(err.Error(), "6 free isolated CPUs (10-15)") {
+		t.Errorf("expected not enough isolated CPUs error, got %v", err)
+	}
+
+	// CPUs pinned by other guests, e.g. another guest on the same NIC, are skipped
+	got, err = autoCPUTune(&CPUTune{Auto: true, HostNIC: "ens1f0"}, 2, map[int]bool{10: true, 11: true, 8: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.VcpuPins[0].CPUSet != "12" || got.VcpuPins[1].CPUSet != "13" || got.EmulatorPin != "8-9" {
+		t.Errorf("unexpected pins next to another guest: %+v", got)
+	}
+	if _, err := autoCPUTune(&CPUTune{Auto: true, HostNIC: "ens1f0"}, 3, map[int]bool{10: true, 11: true, 12: true, 13: true}); err == nil ||
+		!strings.Contains(err.Error(), "2 free isolated CPUs (14-15)") {
+		t.Errorf("expected not enough isolated CPUs error, got %v", err)
+	}
+	if _, err := autoCPUTune(&CPUTune{Auto: true, HostNIC: "ens1f1"}, 1, nil); err == nil {
+		t.Errorf("expected error for NIC without NUMA node")
+	}
+}
+
+func TestDomainCPUTuneCPUs(t *testing.T) {
+	ct := &DomainCPUTune{
+		VCPUPins:     []DomainVCPUPin{{VCPU: 0, CPUSet: "10"}, {VCPU: 1, CPUSet: "11-12"}},
+		EmulatorPin:  &DomainEmulatorPin{CPUSet: "8"},
+		IOThreadPins: []DomainIOThreadPin{{IOThread: 1, CPUSet: "9"}},
+	}
+	cpus, err := ct.cpus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{10, 11, 12, 8, 9}; !reflect.DeepEqual(cpus, want) {
+		t.Errorf("got %v, want %v", cpus, want)
+	}
+}
+
+func TestCPUTuneValidate(t *testing.T) {
+	tune := &CPUTune{
+		Auto:         true,
+		VcpuPins:     []VcpuPin{{Vcpu: 0, CPUSet: "2"}, {Vcpu: 0, CPUSet: "3"}, {Vcpu: 4, CPUSet: "x"}},
+		IOThreadPins: []IOThreadPin{{IOThread: 1, CPUSet: "0"}},
+		VcpuSched: []VcpuSched{
+			{Vcpus: "0-3", Scheduler: "fifo"},
+			{Vcpus: "0", Scheduler: "batch", Priority: 1},
+			{Vcpus: "0", Scheduler: "deadline"},
+			{Vcpus: "1", Scheduler: "rr", Priority: 50},
+		},
+	}
+	e := &ConfError{}
+	tune.validate(e, 4)
+
+	want := []string{
+		"host_nic is required",
+		"vcpu_pins[1]: vCPU 0 is already pinned",
+		"vcpu_pins[2]: vCPU 4 is out of range",
+		"vcpu_pins[2]: cpuset",
+		"iothread_pins[0]: I/O thread 1 is out of range",
+		"vcpu_sched[0]: priority should be from 1 to 99",
+		"vcpu_sched[1]: priority is only supported",
+		"vcpu_sched[2]: scheduler \"deadline\" is unsupported",
+	}
+	if len(e.Problems) != len(want) {
+		t.Fatalf("expected %d problems, got %q", len(want), e.Problems)
+	}
+	for i, w := range want {
+		if !strings.Contains(e.Problems[i], w) {
+			t.Errorf("expected problem %q, got %q", w, e.Problems[i])
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package virgo
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// Statuses of preflight checks.
+const (
+	CheckPass = "pass"
+	CheckFail = "fail"
+	CheckSkip = "skip"
+)
+
+// Check is the outcome of a preflight check of the host.
+type Check struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// checks collects the outcomes of preflight checks.
+type checks []Check
+
+func (c *checks) pass(name, format string, args ...interface{}) {
+	*c = append(*c, Check{Name: name, Status: CheckPass, Detail: fmt.Sprintf(format, args...)})
+}
+
+func (c *checks) fail(name, format string, args ...interface{}) {
+	*c = append(*c, Check{Name: name, Status: CheckFail, Detail: fmt.Sprintf(format, args...)})
+}
+
+func (c *checks) skip(name, format string, args ...interface{}) {
+	*c = append(*c, Check{Name: name, Status: CheckSkip, Detail: fmt.Sprintf(format, args...)})
+}
+
+// PreflightError lists the preflight checks that failed.
+type PreflightError struct {
+	Failed []Check
+}
+
+func (e *PreflightError) Error() string {
+	var s []string
+	for _, c := range e.Failed {
+		s = append(s, fmt.Sprintf("%s: %s", c.Name, c.Detail))
+	}
+	return fmt.Sprintf("preflight checks failed (see virgo doctor): %s", strings.Join(s, "; "))
+}
+
+// PreflightErr returns a *PreflightError with the failed checks of cs, or nil
+// if none failed.
+func PreflightErr(cs []Check) error {
+	e := &PreflightError{}
+	for _, c := range cs {
+		if c.Status == CheckFail {
+			e.Failed = append(e.Failed, c)
+		}
+	}
+	if len(e.Failed) == 0 {
+		return nil
+	}
+	return e
+}
+
+// isLocal reports whether the libvirt daemon that l is connected to runs on
+// this host, whose files can thus be checked directly.
+func isLocal(l *libvirt.Libvirt) bool {
+	remote, err := l.ConnectGetHostname()
+	if err != nil {
+		return false
+	}
+	local, err := os.Hostname()
+	return err == nil && local == remote
+}
+
+// Preflight checks that the host can provision a guest with the options p and
+// launch it with the options g; either may be nil to skip its checks. Files,
+// e.g. vhostuser socket directories, are only checked on local hosts.
+func Preflight(l *libvirt.Libvirt, p *ProvisionConf, g *GuestConf) []Check {
+	var cs checks
+	local := isLocal(l)
+
+	caps, err := GetCapabilities(l)
+	if err != nil {
+		cs.fail("capabilities", "%v", err)
+	} else {
+		checkKVM(&cs, caps)
+	}
+
+	if p != nil {
+		checkBinary(&cs, "openssl", p.Passwd != "" && !p.DisablePasswdAuth)
+		checkPool(&cs, l, p.StoragePool, p.RootImgGB)
+	}
+
+	if g != nil {
+		if caps != nil {
+			checkHugepages(&cs, l, caps, g)
+		}
+		for i := range g.NetIfs {
+			checkNetIf(&cs, l, &g.NetIfs[i], local)
+		}
+	}
+
+	return cs
+}
+
+// checkKVM checks that the host runs x86_64 KVM guests with virgo's emulator.
+func checkKVM(cs *checks, caps *HostCapabilities) {
+	var emulators []string
+	for _, guest := range caps.Guests {
+		if guest.OSType != "hvm" || guest.Arch.Name != "x86_64" {
+			continue
+		}
+		for _, d := range guest.Arch.Domains {
+			if d.Type != "kvm" {
+				continue
+			}
+			emulator := d.Emulator
+			if emulator == "" {
+				emulator = guest.Arch.Emulator
+			}
+			emulators = append(emulators, emulator)
+		}
+	}
+
+	if len(emulators) == 0 {
+		cs.fail("kvm", "the host does not support x86_64 KVM guests; check that /dev/kvm exists and is accessible")
+		return
+	}
+	cs.pass("kvm", "x86_64 KVM guests are supported")
+
+	for _, e := range emulators {
+		if e == qemuEmulator {
+			cs.pass("emulator", "%s", qemuEmulator)
+			return
+		}
+	}
+	cs.fail("emulator", "%s is not among the host's KVM emulators (%s)", qemuEmulator, strings.Join(emulators, ", "))
+}
+
+// checkBinary checks that the local binary name is in PATH, if it's needed.
+func checkBinary(cs *checks, name string, needed bool) {
+	check := "binary " + name
+	if !needed {
+		cs.skip(check, "not needed")
+		return
+	}
+	path, err := exec.LookPath(name)
+	if err != nil {
+		cs.fail(check, "%s not found in PATH", name)
+		return
+	}
+	cs.pass(check, "%s", path)
+}
+
+// checkPool checks that the storage pool has room for a root image of rootImgGB.
+func checkPool(cs *checks, l *libvirt.Libvirt, name string, rootImgGB int) {
+	name = PoolName(name)
+	check := "pool " + name
+
+	pool, err := l.StoragePoolLookupByName(name)
+	if err != nil {
+		cs.skip(check, "does not exist, it will be created as a directory pool")
+		return
+	}
+
+	state, _, _, available, err := l.StoragePoolGetInfo(pool)
+	if err != nil {
+		cs.fail(check, "failed to get info: %v", err)
+		return
+	}
+	if libvirt.StoragePoolState(state) != libvirt.StoragePoolRunning {
+		cs.pass(check, "inactive, it will be started")
+		return
+	}
+
+	needed := gbToBytes(rootImgGB)
+	if available < needed {
+		cs.fail(check, "%.1f GiB available, root_img_gb is %d", float64(available)/float64(1<<30), rootImgGB)
+		return
+	}
+	cs.pass(check, "%.1f GiB available", float64(available)/float64(1<<30))
+}
+
+// checkHugepages checks that the host NUMA nodes that g's memory is bound to,
+// or all of them if it's not bound, have enough free hugepages for it.
+func checkHugepages(cs *checks, l *libvirt.Libvirt, caps *HostCapabilities, g *GuestConf) {
+	pageSize := hugepageBytes(g)
+	if pageSize == 0 {
+		return
+	}
+	check := fmt.Sprintf("hugepages %d%s", g.HugepageSize, g.HugepageSizeUnit)
+
+	cells := len(caps.Cells)
+	if cells == 0 {
+		cells = 1
+	}
+	free, err := l.NodeGetFreePages([]uint32{uint32(pageSize >> 10)}, 0, uint32(cells), 0)
+	if err != nil {
+		cs.fail(check, "failed to get free hugepages: %v", err)
+		return
+	}
+
+	checkFreeHugepages(cs, check, g, free, ownHugepages(l, g.Name, pageSize))
+}
+
+// ownHugepages returns the number of hugepages of size bytes that a running
+// instance of guest holds, which are freed when it's relaunched.
+func ownHugepages(l *libvirt.Libvirt, guest string, size int) int {
+	dom, err := l.DomainLookupByName(guest)
+	if err != nil {
+		return 0
+	}
+	active, err := l.DomainIsActive(dom)
+	if err != nil || active == 0 {
+		return 0
+	}
+	d, err := GetDomainDesc(l, dom)
+	if err != nil {
+		return 0
+	}
+	return d.hugepages(size)
+}
+
+// checkFreeHugepages checks g's memory against the free hugepages of its size
+// on each host NUMA node, along with the own hugepages held by a running
+// instance of g. Since the nodes these are on aren't tracked, they're credited
+// to whichever bindings fall short first.
+func checkFreeHugepages(cs *checks, check string, g *GuestConf, free []uint64, own int) {
+	pageSize := hugepageBytes(g)
+	cells := len(free)
+
+	bindings := memoryBindings(g)
+	if len(bindings) == 0 {
+		bindings = []memoryBinding{{field: "guest", nodeSet: fmt.Sprintf("0-%d", cells-1), memoryMB: g.MemoryMB}}
+	}
+
+	var report []string
+	ok := true
+	for _, b := range bindings {
+		nodes, err := ParseCPUSet(b.nodeSet)
+		if err != nil {
+			cs.fail(check, "%s: node_set: %v", b.field, err)
+			return
+		}
+
+		pages := 0
+		for _, n := range nodes {
+			if n < len(free) {
+				pages += int(free[n])
+			}
+		}
+		needed := b.memoryMB << 20 / pageSize
+		detail := fmt.Sprintf("nodes %s have %d free, %d needed", b.nodeSet, pages, needed)
+		credit := needed - pages
+		if credit > own {
+			credit = own
+		}
+		if credit > 0 {
+			own -= credit
+			pages += credit
+			detail += fmt.Sprintf(", %d of them held by the running guest", credit)
+		}
+		report = append(report, detail)
+		// preferred memory may be allocated on other nodes
+		if pages < needed && b.mode != "preferred" {
+			ok = false
+		}
+	}
+
+	if ok {
+		cs.pass(check, "%s", strings.Join(report, "; "))
+	} else {
+		cs.fail(check, "%s", strings.Join(report, "; "))
+	}
+}
+
+// checkHostIf checks that the host has a network interface called name, which
+// should be a bridge if bridge is set.
+func checkHostIf(cs *checks, l *libvirt.Libvirt, check, name string, bridge, local bool) {
+	if local {
+		path := filepath.Join(sysfsRoot, "class", "net", name)
+		if bridge {
+			path = filepath.Join(path, "bridge")
+		}
+		if _, err := os.Stat(path); err != nil {
+			cs.fail(check, "no such interface on the host")
+			return
+		}
+		cs.pass(check, "exists")
+		return
+	}
+	if _, err := l.InterfaceLookupByName(name); err != nil {
+		cs.fail(check, "no such interface on the host: %v", err)
+		return
+	}
+	cs.pass(check, "exists")
+}
+
+// checkNetIf checks that the host side of the network interface n exists.
+func checkNetIf(cs *checks, l *libvirt.Libvirt, n *NetIf, local bool) {
+	switch n.Type {
+	case "bridge":
+		checkHostIf(cs, l, "bridge "+n.Bridge, n.Bridge, true, local)
+
+	case "direct":
+		checkHostIf(cs, l, "direct dev "+n.Dev, n.Dev, false, local)
+
+	case "network":
+		check := "network " + n.Network
+		net, err := l.NetworkLookupByName(n.Network)
+		if err != nil {
+			cs.fail(check, "no such libvirt network")
+			return
+		}
+		active, err := l.NetworkIsActive(net)
+		if err != nil {
+			cs.fail(check, "failed to get state: %v", err)
+			return
+		}
+		if active == 0 {
+			cs.fail(check, "inactive")
+			return
+		}
+		cs.pass(check, "active")
+
+	case "vhostuser":
+		dir := filepath.Dir(n.UnixSocketPath)
+		check := "vhostuser socket dir " + dir
+		if !local {
+			cs.skip(check, "not checked on remote hosts")
+			return
+		}
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			cs.fail(check, "does not exist; is the vswitch running?")
+			return
+		}
+		cs.pass(check, "exists")
+	}
+}
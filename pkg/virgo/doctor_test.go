@@ -0,0 +1,96 @@
+package virgo
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckKVM(t *testing.T) {
+	caps, err := ParseCapabilities(testCapabilities)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cs checks
+	checkKVM(&cs, caps)
+	if err := PreflightErr(cs); err != nil || len(cs) != 2 {
+		t.Errorf("unexpected checks %+v", cs)
+	}
+
+	caps.Guests[0].Arch.Emulator = "/usr/libexec/qemu-kvm"
+	cs = nil
+	checkKVM(&cs, caps)
+	err = PreflightErr(cs)
+	if err == nil || !strings.Contains(err.Error(), "emulator: /usr/bin/qemu-system-x86_64 is not among the host's KVM emulators (/usr/libexec/qemu-kvm)") {
+		t.Errorf("expected emulator failure, got %v", err)
+	}
+
+	caps.Guests[0].Arch.Domains = []HostGuestDomain{{Type: "qemu"}}
+	cs = nil
+	checkKVM(&cs, caps)
+	if len(cs) != 1 || cs[0].Name != "kvm" || cs[0].Status != CheckFail {
+		t.Errorf("expected kvm failure, got %+v", cs)
+	}
+}
+
+func TestCheckFreeHugepages(t *testing.T) {
+	g := &GuestConf{
+		MemoryMB: 3072,
+		NUMANodes: []NUMANode{
+			{Id: 0, Cpus: "0-1", MemoryMB: 2048},
+			{Id: 1, Cpus: "2-3", MemoryMB: 1024},
+		},
+		HugepageSupport:  true,
+		HugepageSize:     2,
+		HugepageSizeUnit: "M",
+	}
+	free := []uint64{1536, 256}
+
+	tests := []struct {
+		tune   *NUMATune
+		status string
+		detail string
+	}{
+		{nil, CheckPass, "nodes 0-1 have 1792 free, 1536 needed"},
+		{&NUMATune{NodeSet: "1"}, CheckFail, "nodes 1 have 256 free, 1536 needed"},
+		{&NUMATune{Mode: "preferred", NodeSet: "1"}, CheckPass, "nodes 1 have 256 free, 1536 needed"},
+		{&NUMATune{MemNodes: []MemNode{{CellID: 0, NodeSet: "0"}, {CellID: 1, NodeSet: "1"}}}, CheckFail, "nodes 0 have 1536 free, 1024 needed; nodes 1 have 256 free, 512 needed"},
+	}
+	for i, tt := range tests {
+		g.NUMATune = tt.tune
+		var cs checks
+		checkFreeHugepages(&cs, "hugepages", g, free, 0)
+		if len(cs) != 1 || cs[0].Status != tt.status || cs[0].Detail != tt.detail {
+			t.Errorf("%d: expected %s %q, got %+v", i, tt.status, tt.detail, cs)
+		}
+	}
+
+	// the hugepages of a running instance of the guest are freed on relaunch
+	g.NUMATune = &NUMATune{NodeSet: "1"}
+	var cs checks
+	checkFreeHugepages(&cs, "hugepages", g, free, 1536)
+	if len(cs) != 1 || cs[0].Status != CheckPass || cs[0].Detail != "nodes 1 have 256 free, 1536 needed, 1280 of them held by the running guest" {
+		t.Errorf("expected own hugepages to be credited, got %+v", cs)
+	}
+}
+
+func TestDomainDescHugepages(t *testing.T) {
+	d, err := ParseDomainDesc(`<domain type='kvm'>
+  <name>vm1</name>
+  <memory unit='KiB'>4194304</memory>
+  <memoryBacking>
+    <hugepages>
+      <page size='2048' unit='KiB'/>
+    </hugepages>
+  </memoryBacking>
+</domain>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := d.hugepages(2 << 20); n != 2048 {
+		t.Errorf("expected 2048 hugepages of 2M, got %d", n)
+	}
+	if n := d.hugepages(1 << 30); n != 0 {
+		t.Errorf("expected no hugepages of 1G, got %d", n)
+	}
+}
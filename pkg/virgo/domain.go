@@ -0,0 +1,534 @@
+package virgo
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// DomainDesc models the subset of libvirt's domain XML that virgo manages.
+type DomainDesc struct {
+	XMLName       xml.Name             `xml:"domain"`
+	Type          string               `xml:"type,attr"`
+	Name          string               `xml:"name"`
+	UUID          string               `xml:"uuid,omitempty"`
+	Metadata      *DomainMetadata      `xml:"metadata"`
+	Memory        DomainMemory         `xml:"memory"`
+	CurrentMemory DomainMemory         `xml:"currentMemory"`
+	MemoryBacking *DomainMemoryBacking `xml:"memoryBacking"`
+	VCPU          DomainVCPU           `xml:"vcpu"`
+	IOThreads     int                  `xml:"iothreads,omitempty"`
+	CPUTune       *DomainCPUTune       `xml:"cputune"`
+	NUMATune      *DomainNUMATune      `xml:"numatune"`
+	OS            DomainOS             `xml:"os"`
+	Features      DomainFeatures       `xml:"features"`
+	CPU           DomainCPU            `xml:"cpu"`
+	OnPoweroff    string               `xml:"on_poweroff,omitempty"`
+	OnReboot      string               `xml:"on_reboot,omitempty"`
+	OnCrash       string               `xml:"on_crash,omitempty"`
+	Devices       DomainDevices        `xml:"devices"`
+}
+
+// rootDiskDev is the target device of guests' root disk.
+const rootDiskDev = "vda"
+
+// qemuEmulator is the emulator binary of guests.
+const qemuEmulator = "/usr/bin/qemu-system-x86_64"
+
+// MetadataNS is the XML namespace of the metadata element that marks domains
+// as managed by virgo.
+const MetadataNS = "https://github.com/anastop/virgo"
+
+type DomainMetadata struct {
+	Virgo *VirgoMetadata `xml:"https://github.com/anastop/virgo virgo"`
+}
+
+// VirgoMetadata is stored in the domains that virgo launches.
+type VirgoMetadata struct {
+	Pool string `xml:"pool,attr,omitempty"`
+	// GuestConf is the JSON encoded GuestConf the domain was launched from,
+	// which clones of the domain are launched from as well.
+	GuestConf string `xml:"guest_conf,omitempty"`
+}
+
+// Managed reports whether the domain was launched by virgo.
+func (d *DomainDesc) Managed() bool {
+	return d.Metadata != nil && d.Metadata.Virgo != nil
+}
+
+// unitBytes returns the bytes of value in unit, which defaults to KiB.
+func unitBytes(value int, unit string) int {
+	if unit == "" {
+		unit = "KiB"
+	}
+	return value * hugepageUnits[strings.ToLower(unit)]
+}
+
+// hugepages returns the number of hugepages of size bytes that back the memory
+// of d, if any.
+func (d *DomainDesc) hugepages(size int) int {
+	if d.MemoryBacking == nil {
+		return 0
+	}
+	for _, p := range d.MemoryBacking.Hugepages {
+		if unitBytes(p.Size, p.Unit) == size {
+			return unitBytes(d.Memory.Value, d.Memory.Unit) / size
+		}
+	}
+	return 0
+}
+
+type DomainMemory struct {
+	Value int    `xml:",chardata"`
+	Unit  string `xml:"unit,attr,omitempty"`
+}
+
+type DomainHugepage struct {
+	Size    int    `xml:"size,attr"`
+	Unit    string `xml:"unit,attr,omitempty"`
+	NodeSet string `xml:"nodeset,attr,omitempty"`
+}
+
+type DomainMemoryBacking struct {
+	Hugepages []DomainHugepage `xml:"hugepages>page"`
+}
+
+type DomainVCPU struct {
+	Value     int    `xml:",chardata"`
+	Placement string `xml:"placement,attr,omitempty"`
+}
+
+type DomainVCPUPin struct {
+	VCPU   int    `xml:"vcpu,attr"`
+	CPUSet string `xml:"cpuset,attr"`
+}
+
+type DomainEmulatorPin struct {
+	CPUSet string `xml:"cpuset,attr"`
+}
+
+type DomainIOThreadPin struct {
+	IOThread int    `xml:"iothread,attr"`
+	CPUSet   string `xml:"cpuset,attr"`
+}
+
+type DomainVCPUSched struct {
+	VCPUs     string `xml:"vcpus,attr"`
+	Scheduler string `xml:"scheduler,attr"`
+	Priority  int    `xml:"priority,attr,omitempty"`
+}
+
+type DomainCPUTune struct {
+	VCPUPins     []DomainVCPUPin     `xml:"vcpupin"`
+	EmulatorPin  *DomainEmulatorPin  `xml:"emulatorpin"`
+	IOThreadPins []DomainIOThreadPin `xml:"iothreadpin"`
+	VCPUScheds   []DomainVCPUSched   `xml:"vcpusched"`
+}
+
+type DomainNUMATuneMemory struct {
+	Mode    string `xml:"mode,attr,omitempty"`
+	NodeSet string `xml:"nodeset,attr,omitempty"`
+}
+
+type DomainMemNode struct {
+	CellID  int    `xml:"cellid,attr"`
+	Mode    string `xml:"mode,attr,omitempty"`
+	NodeSet string `xml:"nodeset,attr"`
+}
+
+type DomainNUMATune struct {
+	Memory   *DomainNUMATuneMemory `xml:"memory"`
+	MemNodes []DomainMemNode       `xml:"memnode"`
+}
+
+type DomainOSType struct {
+	Value   string `xml:",chardata"`
+	Arch    string `xml:"arch,attr,omitempty"`
+	Machine string `xml:"machine,attr,omitempty"`
+}
+
+type DomainBoot struct {
+	Dev string `xml:"dev,attr"`
+}
+
+type DomainOS struct {
+	Type  DomainOSType `xml:"type"`
+	Boots []DomainBoot `xml:"boot"`
+}
+
+type DomainFeatures struct {
+	ACPI *struct{} `xml:"acpi"`
+	APIC *struct{} `xml:"apic"`
+}
+
+type DomainCPUModel struct {
+	Value    string `xml:",chardata"`
+	Fallback string `xml:"fallback,attr,omitempty"`
+}
+
+type DomainCPUTopology struct {
+	Sockets int `xml:"sockets,attr"`
+	Cores   int `xml:"cores,attr"`
+	Threads int `xml:"threads,attr"`
+}
+
+type DomainNUMACell struct {
+	ID        int    `xml:"id,attr"`
+	CPUs      string `xml:"cpus,attr"`
+	Memory    int    `xml:"memory,attr"`
+	Unit      string `xml:"unit,attr,omitempty"`
+	MemAccess string `xml:"memAccess,attr,omitempty"`
+}
+
+type DomainNUMA struct {
+	Cells []DomainNUMACell `xml:"cell"`
+}
+
+type DomainCPU struct {
+	Mode     string             `xml:"mode,attr,omitempty"`
+	Model    *DomainCPUModel    `xml:"model"`
+	Topology *DomainCPUTopology `xml:"topology"`
+	NUMA     *DomainNUMA        `xml:"numa"`
+}
+
+type DomainAddress struct {
+	Type     string `xml:"type,attr"`
+	Domain   string `xml:"domain,attr,omitempty"`
+	Bus      string `xml:"bus,attr,omitempty"`
+	Slot     string `xml:"slot,attr,omitempty"`
+	Function string `xml:"function,attr,omitempty"`
+}
+
+type DomainDiskDriver struct {
+	Name     string `xml:"name,attr"`
+	Type     string `xml:"type,attr"`
+	IOThread int    `xml:"iothread,attr,omitempty"`
+}
+
+type DomainDiskSource struct {
+	File   string `xml:"file,attr,omitempty"`
+	Pool   string `xml:"pool,attr,omitempty"`
+	Volume string `xml:"volume,attr,omitempty"`
+}
+
+type DomainDiskTarget struct {
+	Dev string `xml:"dev,attr"`
+	Bus string `xml:"bus,attr,omitempty"`
+}
+
+type DomainDisk struct {
+	Type     string           `xml:"type,attr"`
+	Device   string           `xml:"device,attr"`
+	Driver   DomainDiskDriver `xml:"driver"`
+	Source   DomainDiskSource `xml:"source"`
+	Target   DomainDiskTarget `xml:"target"`
+	ReadOnly *struct{}        `xml:"readonly"`
+	Address  *DomainAddress   `xml:"address"`
+}
+
+type DomainInterfaceMAC struct {
+	Address string `xml:"address,attr"`
+}
+
+type DomainInterfaceSource struct {
+	Bridge    string `xml:"bridge,attr,omitempty"`
+	Network   string `xml:"network,attr,omitempty"`
+	PortGroup string `xml:"portgroup,attr,omitempty"`
+	Dev       string `xml:"dev,attr,omitempty"`
+	Type      string `xml:"type,attr,omitempty"`
+	Path      string `xml:"path,attr,omitempty"`
+	Mode      string `xml:"mode,attr,omitempty"`
+}
+
+type DomainInterfaceModel struct {
+	Type string `xml:"type,attr"`
+}
+
+type DomainInterfaceDriverHost struct {
+	MrgRxbuf string `xml:"mrg_rxbuf,attr,omitempty"`
+}
+
+type DomainInterfaceDriver struct {
+	Queues int                        `xml:"queues,attr,omitempty"`
+	Host   *DomainInterfaceDriverHost `xml:"host"`
+}
+
+type DomainInterface struct {
+	Type    string                 `xml:"type,attr"`
+	MAC     *DomainInterfaceMAC    `xml:"mac"`
+	Source  *DomainInterfaceSource `xml:"source"`
+	Model   *DomainInterfaceModel  `xml:"model"`
+	Driver  *DomainInterfaceDriver `xml:"driver"`
+	Address *DomainAddress         `xml:"address"`
+}
+
+type DomainChardevTarget struct {
+	Type string `xml:"type,attr,omitempty"`
+	Port int    `xml:"port,attr"`
+}
+
+type DomainChardevLog struct {
+	File   string `xml:"file,attr"`
+	Append string `xml:"append,attr,omitempty"`
+}
+
+type DomainChardevSource struct {
+	Path string `xml:"path,attr,omitempty"`
+}
+
+type DomainChardev struct {
+	Type   string               `xml:"type,attr"`
+	Source *DomainChardevSource `xml:"source"`
+	Target DomainChardevTarget  `xml:"target"`
+	Log    *DomainChardevLog    `xml:"log"`
+}
+
+type DomainDevices struct {
+	Emulator   string            `xml:"emulator,omitempty"`
+	Disks      []DomainDisk      `xml:"disk"`
+	Interfaces []DomainInterface `xml:"interface"`
+	Serials    []DomainChardev   `xml:"serial"`
+	Consoles   []DomainChardev   `xml:"console"`
+}
+
+func pciAddress(slot int) *DomainAddress {
+	return &DomainAddress{
+		Type:     "pci",
+		Domain:   "0x0000",
+		Bus:      "0x00",
+		Slot:     fmt.Sprintf("0x%02x", slot),
+		Function: "0x0",
+	}
+}
+
+// guestDisk returns a virtio disk backed by the file at path, or if path is empty,
+// by the volume called volume in g's storage pool, which is then always raw.
+func guestDisk(g *GuestConf, path, volume, format, dev string, slot int) DomainDisk {
+	d := DomainDisk{
+		Type:    "file",
+		Device:  "disk",
+		Driver:  DomainDiskDriver{Name: "qemu", Type: format},
+		Source:  DomainDiskSource{File: path},
+		Target:  DomainDiskTarget{Dev: dev, Bus: "virtio"},
+		Address: pciAddress(slot),
+	}
+	if path == "" {
+		d.Type = "volume"
+		d.Driver.Type = "raw"
+		d.Source = DomainDiskSource{Pool: PoolName(g.StoragePool), Volume: volume}
+	}
+	return d
+}
+
+// ParsePCIAddress parses a PCI address of the form [domain:]bus:slot.function,
+// in hex, e.g. 0000:00:0a.0.
+func ParsePCIAddress(s string) (*DomainAddress, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) == 2 {
+		parts = append([]string{"0"}, parts...)
+	}
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid PCI address %q, expected e.g. 0000:00:0a.0", s)
+	}
+	slotFunc := strings.Split(parts[2], ".")
+	if len(slotFunc) != 2 {
+		return nil, fmt.Errorf("invalid PCI address %q, expected e.g. 0000:00:0a.0", s)
+	}
+
+	var ids []uint64
+	for i, field := range []string{parts[0], parts[1], slotFunc[0], slotFunc[1]} {
+		max := []uint64{0xffff, 0xff, 0x1f, 0x7}[i]
+		id, err := strconv.ParseUint(field, 16, 16)
+		if err != nil || id > max {
+			return nil, fmt.Errorf("invalid PCI address %q, expected e.g. 0000:00:0a.0", s)
+		}
+		ids = append(ids, id)
+	}
+
+	return &DomainAddress{
+		Type:     "pci",
+		Domain:   fmt.Sprintf("0x%04x", ids[0]),
+		Bus:      fmt.Sprintf("0x%02x", ids[1]),
+		Slot:     fmt.Sprintf("0x%02x", ids[2]),
+		Function: fmt.Sprintf("0x%x", ids[3]),
+	}, nil
+}
+
+func netIfDesc(n *NetIf) (DomainInterface, error) {
+	iface := DomainInterface{Type: n.Type}
+	switch n.Type {
+	case "bridge":
+		iface.Source = &DomainInterfaceSource{Bridge: n.Bridge}
+	case "network":
+		iface.Source = &DomainInterfaceSource{Network: n.Network, PortGroup: n.PortGroup}
+	case "direct":
+		mode := n.Mode
+		if mode == "" {
+			mode = "vepa"
+		}
+		iface.Source = &DomainInterfaceSource{Dev: n.Dev, Mode: mode}
+	case "user":
+	case "vhostuser":
+		iface.Source = &DomainInterfaceSource{Type: "unix", Path: n.UnixSocketPath, Mode: "client"}
+		iface.Driver = &DomainInterfaceDriver{
+			Queues: n.Queues,
+			Host:   &DomainInterfaceDriverHost{MrgRxbuf: "on"},
+		}
+	default:
+		return DomainInterface{}, fmt.Errorf("unsupported network interface type %q", n.Type)
+	}
+
+	if n.MacAddr != "" {
+		iface.MAC = &DomainInterfaceMAC{Address: n.MacAddr}
+	}
+
+	model := n.Model
+	if model == "" {
+		model = "virtio"
+	}
+	iface.Model = &DomainInterfaceModel{Type: model}
+
+	if n.Queues > 0 && iface.Driver == nil {
+		iface.Driver = &DomainInterfaceDriver{Queues: n.Queues}
+	}
+
+	if n.PCIAddress != "" {
+		addr, err := ParsePCIAddress(n.PCIAddress)
+		if err != nil {
+			return DomainInterface{}, err
+		}
+		iface.Address = addr
+	}
+
+	return iface, nil
+}
+
+// NewDomainDesc returns the domain description of guest g.
+func NewDomainDesc(g *GuestConf) (*DomainDesc, error) {
+	conf, err := json.Marshal(g)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal guest config: %v", err)
+	}
+
+	// the cloud-init seed is read-only, as QEMU refuses internal snapshots of
+	// guests with writable raw disks
+	seed := guestDisk(g, g.ConfigIsoPath, ConfigIsoName(g.Name), "raw", "vdb", 8)
+	seed.ReadOnly = &struct{}{}
+
+	d := &DomainDesc{
+		Type:          "kvm",
+		Name:          g.Name,
+		Metadata:      &DomainMetadata{Virgo: &VirgoMetadata{Pool: PoolName(g.StoragePool), GuestConf: string(conf)}},
+		Memory:        DomainMemory{Value: g.MemoryMB, Unit: "MiB"},
+		CurrentMemory: DomainMemory{Value: g.MemoryMB, Unit: "MiB"},
+		VCPU:          DomainVCPU{Value: g.NumVcpus, Placement: "static"},
+		OS: DomainOS{
+			Type:  DomainOSType{Value: "hvm", Arch: "x86_64", Machine: "pc"},
+			Boots: []DomainBoot{{Dev: "hd"}},
+		},
+		Features: DomainFeatures{ACPI: &struct{}{}, APIC: &struct{}{}},
+		CPU: DomainCPU{
+			Mode:  "host-model",
+			Model: &DomainCPUModel{Fallback: "allow"},
+			Topology: &DomainCPUTopology{
+				Sockets: g.NumSockets,
+				Cores:   g.NumCoresPerSocket,
+				Threads: g.NumThreadsPerCore,
+			},
+		},
+		OnPoweroff: "destroy",
+		OnReboot:   "restart",
+		OnCrash:    "destroy",
+		Devices: DomainDevices{
+			Emulator: qemuEmulator,
+			Disks: []DomainDisk{
+				guestDisk(g, g.RootImgPath, RootImgName(g.Name), "qcow2", rootDiskDev, 7),
+				seed,
+			},
+			Serials:  []DomainChardev{{Type: "pty", Target: DomainChardevTarget{Port: 0}}},
+			Consoles: []DomainChardev{{Type: "pty", Target: DomainChardevTarget{Type: "serial", Port: 0}}},
+		},
+	}
+
+	if g.SerialLogPath != "" {
+		d.Devices.Serials[0].Log = &DomainChardevLog{File: g.SerialLogPath, Append: "on"}
+	}
+	if g.HugepageSupport {
+		d.MemoryBacking = &DomainMemoryBacking{
+			Hugepages: []DomainHugepage{{Size: g.HugepageSize, Unit: g.HugepageSizeUnit, NodeSet: g.HugepageNodeSet}},
+		}
+	}
+
+	if len(g.NUMANodes) > 0 {
+		d.CPU.NUMA = &DomainNUMA{}
+		for _, n := range g.NUMANodes {
+			cell := DomainNUMACell{ID: n.Id, CPUs: n.Cpus, Memory: n.MemoryMB, Unit: "MiB"}
+			if g.HugepageSupport {
+				cell.MemAccess = "shared"
+			}
+			d.CPU.NUMA.Cells = append(d.CPU.NUMA.Cells, cell)
+		}
+	}
+
+	if t := g.CPUTune; t != nil {
+		d.IOThreads = t.IOThreads
+		if t.IOThreads > 0 {
+			// the root disk is served by the first I/O thread
+			d.Devices.Disks[0].Driver.IOThread = 1
+		}
+		d.CPUTune = cputuneDesc(t)
+	}
+
+	if g.NUMATune != nil {
+		d.NUMATune = numatuneDesc(g.NUMATune)
+	}
+
+	for i := range g.NetIfs {
+		iface, err := netIfDesc(&g.NetIfs[i])
+		if err != nil {
+			return nil, fmt.Errorf("guest_net_ifs[%d]: %v", i, err)
+		}
+		d.Devices.Interfaces = append(d.Devices.Interfaces, iface)
+	}
+
+	return d, nil
+}
+
+// Marshal returns the indented XML document of d.
+func (d *DomainDesc) Marshal() (string, error) {
+	out, err := xml.MarshalIndent(d, "", "    ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal domain %s: %v", d.Name, err)
+	}
+	return string(out), nil
+}
+
+// ParseDomainDesc parses a libvirt domain XML document.
+func ParseDomainDesc(s string) (*DomainDesc, error) {
+	d := &DomainDesc{}
+	if err := xml.Unmarshal([]byte(s), d); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal domain's XML: %v", err)
+	}
+	return d, nil
+}
+
+// GetDomainDesc returns the description of an existing domain.
+func GetDomainDesc(l *libvirt.Libvirt, dom libvirt.Domain) (*DomainDesc, error) {
+	xmldesc, err := l.DomainGetXMLDesc(dom, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get domain's %s XML: %v", dom.Name, err)
+	}
+	return ParseDomainDesc(xmldesc)
+}
+
+func domXML(g *GuestConf) (string, error) {
+	d, err := NewDomainDesc(g)
+	if err != nil {
+		return "", err
+	}
+	return d.Marshal()
+}
@@ -0,0 +1,191 @@
+package virgo
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+var domainTests = []struct {
+	name string
+	conf GuestConf
+}{
+	{
+		name: "minimal",
+		conf: GuestConf{
+			Name:              "foo",
+			MemoryMB:          1024,
+			NumVcpus:          1,
+			NumSockets:        1,
+			NumCoresPerSocket: 1,
+			NumThreadsPerCore: 1,
+			RootImgPath:       "/var/lib/libvirt/images/foo.virgo.img",
+			ConfigIsoPath:     "/var/lib/libvirt/images/foo.virgo.iso",
+		},
+	},
+	{
+		name: "volume",
+		conf: GuestConf{
+			Name:              "foo",
+			StoragePool:       "vg0",
+			MemoryMB:          1024,
+			NumVcpus:          1,
+			NumSockets:        1,
+			NumCoresPerSocket: 1,
+			NumThreadsPerCore: 1,
+		},
+	},
+	{
+		name: "nfv",
+		conf: GuestConf{
+			Name:              "foo",
+			MemoryMB:          8192,
+			NumVcpus:          8,
+			NumSockets:        2,
+			NumCoresPerSocket: 2,
+			NumThreadsPerCore: 2,
+			NUMANodes: []NUMANode{
+				{Id: 0, Cpus: "0-3", MemoryMB: 4096},
+				{Id: 1, Cpus: "4-7", MemoryMB: 4096},
+			},
+			HugepageSupport:  true,
+			HugepageSize:     2,
+			HugepageSizeUnit: "M",
+			HugepageNodeSet:  "0,1",
+			NUMATune: &NUMATune{
+				MemNodes: []MemNode{
+					{CellID: 0, NodeSet: "0"},
+					{CellID: 1, Mode: "preferred", NodeSet: "1"},
+				},
+			},
+			RootImgPath:   "/var/lib/libvirt/images/foo.virgo.img",
+			ConfigIsoPath: "/var/lib/libvirt/images/foo.virgo.iso",
+			SerialLogPath: "/var/lib/libvirt/images/foo.virgo.log",
+			NetIfs: []NetIf{
+				{Type: "bridge", Bridge: "virbr0"},
+				{
+					Type:           "vhostuser",
+					MacAddr:        "de:ad:be:ef:01:23",
+					UnixSocketPath: "/usr/local/var/run/openvswitch/dpdkvhostuser1",
+					Queues:         2,
+				},
+			},
+		},
+	},
+	{
+		name: "networks",
+		conf: GuestConf{
+			Name:              "foo",
+			MemoryMB:          1024,
+			NumVcpus:          1,
+			NumSockets:        1,
+			NumCoresPerSocket: 1,
+			NumThreadsPerCore: 1,
+			RootImgPath:       "/var/lib/libvirt/images/foo.virgo.img",
+			ConfigIsoPath:     "/var/lib/libvirt/images/foo.virgo.iso",
+			NetIfs: []NetIf{
+				{Type: "network", Network: "default", PortGroup: "lab", MacAddr: "52:54:00:00:00:01", PCIAddress: "0000:00:0a.0"},
+				{Type: "direct", Dev: "ens1f0", Mode: "bridge", Queues: 4},
+				{Type: "direct", Dev: "ens1f1", Model: "e1000"},
+				{Type: "user", PCIAddress: "00:0b.0"},
+			},
+		},
+	},
+	{
+		name: "pinned",
+		conf: GuestConf{
+			Name:              "foo",
+			MemoryMB:          4096,
+			NumVcpus:          4,
+			NumSockets:        1,
+			NumCoresPerSocket: 4,
+			NumThreadsPerCore: 1,
+			RootImgPath:       "/var/lib/libvirt/images/foo.virgo.img",
+			ConfigIsoPath:     "/var/lib/libvirt/images/foo.virgo.iso",
+			CPUTune: &CPUTune{
+				VcpuPins: []VcpuPin{
+					{Vcpu: 0, CPUSet: "2"},
+					{Vcpu: 1, CPUSet: "3"},
+					{Vcpu: 2, CPUSet: "4"},
+					{Vcpu: 3, CPUSet: "5"},
+				},
+				EmulatorPin:  "0-1",
+				IOThreads:    1,
+				IOThreadPins: []IOThreadPin{{IOThread: 1, CPUSet: "0-1"}},
+				VcpuSched:    []VcpuSched{{Vcpus: "1-3", Scheduler: "fifo", Priority: 1}},
+			},
+		},
+	},
+}
+
+func TestDomainDescGolden(t *testing.T) {
+	for _, tt := range domainTests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := domXML(&tt.conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			golden := filepath.Join("testdata", "domain-"+tt.name+".xml")
+			if *update {
+				if err := ioutil.WriteFile(golden, []byte(got+"\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got+"\n" != string(want) {
+				t.Errorf("domain XML differs from %s (run with -update to refresh):\n%s", golden, got)
+			}
+		})
+	}
+}
+
+func TestDomainDescRoundTrip(t *testing.T) {
+	for _, tt := range domainTests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := NewDomainDesc(&tt.conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s, err := d.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			parsed, err := ParseDomainDesc(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed.XMLName = d.XMLName
+
+			if !reflect.DeepEqual(d, parsed) {
+				t.Errorf("round trip mismatch:\n got %+v\nwant %+v", parsed, d)
+			}
+		})
+	}
+}
+
+func TestDomainDescErrors(t *testing.T) {
+	g := &GuestConf{Name: "foo", NetIfs: []NetIf{{Type: "bridge", Bridge: "virbr0"}, {Type: "macvtap"}}}
+	if _, err := NewDomainDesc(g); err == nil || !strings.Contains(err.Error(), "guest_net_ifs[1]") {
+		t.Errorf("expected error for unsupported interface type, got %v", err)
+	}
+
+	s, err := domXML(&GuestConf{Name: "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(s, "<numa>") {
+		t.Errorf("domain without NUMA nodes contains a <numa> element:\n%s", s)
+	}
+}
@@ -0,0 +1,314 @@
+package virgo
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// checksumFiles are the checksum files looked up next to a cloud image, in order of preference.
+var checksumFiles = []struct {
+	name    string
+	newHash func() hash.Hash
+}{
+	{"SHA256SUMS", sha256.New},
+	{"SHA512SUMS", sha512.New},
+}
+
+// DefaultCacheDir returns the directory where downloaded cloud images are cached:
+// /var/cache/virgo for root, $XDG_CACHE_HOME/virgo or ~/.cache/virgo otherwise.
+func DefaultCacheDir() string {
+	if os.Geteuid() == 0 {
+		return "/var/cache/virgo"
+	}
+	if dir := os.Getenv("XDG_CACHE_HOME"); dir != "" {
+		return filepath.Join(dir, "virgo")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "virgo")
+	}
+	return filepath.Join(home, ".cache", "virgo")
+}
+
+// Downloader fetches cloud images over HTTP(S) or from file:// URLs into a cache
+// directory, resuming partial downloads and verifying them against the
+// SHA256SUMS or SHA512SUMS file published next to the image, if any.
+type Downloader struct {
+	CacheDir string
+	// Progress receives a progress bar and warnings; nil disables them.
+	Progress io.Writer
+	Client   *http.Client
+}
+
+func (d *Downloader) client() *http.Client {
+	if d.Client != nil {
+		return d.Client
+	}
+	return http.DefaultClient
+}
+
+func (d *Downloader) logf(format string, args ...interface{}) {
+	if d.Progress != nil {
+		fmt.Fprintf(d.Progress, format, args...)
+	}
+}
+
+// cacheName returns the name of the file that image name found under baseURL
+// is cached in, which is keyed by its URL like BaseImgName, so that images of
+// the same name from different releases don't collide.
+func cacheName(baseURL, name string) string {
+	sum := sha256.Sum256([]byte(baseURL + name))
+	return fmt.Sprintf("%s.%x", path.Base(name), sum[:4])
+}
+
+// Fetch returns the local path of image name found under baseURL, downloading
+// it into the cache directory if needed. Images of file:// URLs are used in place.
+// A cached image that fails verification is downloaded again, once.
+func (d *Downloader) Fetch(baseURL, name string) (string, error) {
+	baseu, err := url.Parse(baseURL)
+	if err != nil {
+		return "", err
+	}
+	imgu, err := url.Parse(name)
+	if err != nil {
+		return "", err
+	}
+	u := baseu.ResolveReference(imgu)
+
+	switch u.Scheme {
+	case "file":
+		if err := d.verify(u, u.Path); err != nil {
+			return "", err
+		}
+		return u.Path, nil
+	case "http", "https":
+	default:
+		return "", fmt.Errorf("unsupported URL scheme %q in %s", u.Scheme, u)
+	}
+
+	if err := os.MkdirAll(d.CacheDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create cache directory %s: %v", d.CacheDir, err)
+	}
+	dst := filepath.Join(d.CacheDir, cacheName(baseURL, name))
+
+	for retried := false; ; retried = true {
+		if _, err := os.Stat(dst); err != nil {
+			if err := d.download(u.String(), dst); err != nil {
+				return "", err
+			}
+		}
+
+		err := d.verify(u, dst)
+		if err == nil {
+			return dst, nil
+		}
+		os.Remove(dst)
+		if retried {
+			return "", err
+		}
+		d.logf("warning: %v, downloading %s again\n", err, u)
+	}
+}
+
+// download fetches rawurl into dst via a .part file, resuming from where a previous
+// attempt stopped if the server supports range requests.
+func (d *Downloader) download(rawurl, dst string) error {
+	part := dst + ".part"
+	f, err := os.OpenFile(part, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := d.client().Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %v", rawurl, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// the server ignored our range request; start over
+		offset = 0
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the partial file is stale; start over
+		f.Close()
+		if err := os.Remove(part); err != nil {
+			return err
+		}
+		return d.download(rawurl, dst)
+	default:
+		return fmt.Errorf("failed to download %s: %s", rawurl, resp.Status)
+	}
+
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+
+	var w io.Writer = f
+	if d.Progress != nil {
+		pw := &progressWriter{out: d.Progress, name: path.Base(req.URL.Path), done: offset, total: total}
+		w = io.MultiWriter(f, pw)
+		defer pw.finish()
+	}
+
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return fmt.Errorf("failed to download %s: %v", rawurl, err)
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(part, dst)
+}
+
+// verify checks the file at dst against the checksum listed for image u in the
+// checksum files next to it. Images without published checksums are not verified.
+func (d *Downloader) verify(u *url.URL, dst string) error {
+	name := path.Base(u.Path)
+	for _, cf := range checksumFiles {
+		sums, err := d.fetchChecksums(u.ResolveReference(&url.URL{Path: cf.name}))
+		if err != nil {
+			continue
+		}
+
+		want, ok := sums[name]
+		if !ok {
+			d.logf("warning: %s is not listed in %s, skipping verification\n", name, cf.name)
+			return nil
+		}
+
+		got, err := fileChecksum(dst, cf.newHash())
+		if err != nil {
+			return err
+		}
+		if got != want {
+			return fmt.Errorf("checksum mismatch for %s: got %s, %s lists %s", name, got, cf.name, want)
+		}
+		return nil
+	}
+
+	d.logf("warning: no checksum file found for %s, skipping verification\n", u)
+	return nil
+}
+
+// fetchChecksums retrieves a checksum file and maps each file name to its checksum.
+func (d *Downloader) fetchChecksums(u *url.URL) (map[string]string, error) {
+	var r io.ReadCloser
+	if u.Scheme == "file" {
+		f, err := os.Open(u.Path)
+		if err != nil {
+			return nil, err
+		}
+		r = f
+	} else {
+		resp, err := d.client().Get(u.String())
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("failed to fetch %s: %s", u, resp.Status)
+		}
+		r = resp.Body
+	}
+	defer r.Close()
+
+	return parseChecksums(r)
+}
+
+// parseChecksums parses the output of sha256sum and friends, in text or binary mode.
+func parseChecksums(r io.Reader) (map[string]string, error) {
+	sums := map[string]string{}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		sums[strings.TrimPrefix(fields[1], "*")] = strings.ToLower(fields[0])
+	}
+	return sums, s.Err()
+}
+
+func fileChecksum(p string, h hash.Hash) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to compute checksum of %s: %v", p, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// progressWriter renders a single-line progress bar for the bytes written to it.
+type progressWriter struct {
+	out     io.Writer
+	name    string
+	done    int64
+	total   int64
+	lastPct int64
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.done += int64(len(b))
+	if p.total <= 0 {
+		return len(b), nil
+	}
+	if pct := p.done * 100 / p.total; pct != p.lastPct {
+		p.lastPct = pct
+		p.render()
+	}
+	return len(b), nil
+}
+
+func (p *progressWriter) render() {
+	const width = 40
+	if p.total <= 0 {
+		fmt.Fprintf(p.out, "\r%s: %d MiB", p.name, p.done>>20)
+		return
+	}
+	n := int(p.done * width / p.total)
+	fmt.Fprintf(p.out, "\r%s [%s%s] %3d%% %d/%d MiB", p.name,
+		strings.Repeat("=", n), strings.Repeat(" ", width-n), p.done*100/p.total, p.done>>20, p.total>>20)
+}
+
+func (p *progressWriter) finish() {
+	p.render()
+	fmt.Fprintln(p.out)
+}
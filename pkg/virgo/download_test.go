@@ -0,0 +1,174 @@
+package virgo
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// imageServer serves img and the checksum file sums, and records the image
+// requests.
+type imageServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+func newImageServer(img []byte, sums string) *imageServer {
+	s := &imageServer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/release/img.qcow2", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests = append(s.requests, r)
+		s.mu.Unlock()
+		http.ServeContent(w, r, "img.qcow2", time.Time{}, bytes.NewReader(img))
+	})
+	mux.HandleFunc("/release/SHA256SUMS", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, sums)
+	})
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+func TestDownloaderFetch(t *testing.T) {
+	img := bytes.Repeat([]byte("virgo"), 1<<16)
+	sum := sha256.Sum256(img)
+
+	tests := []struct {
+		name     string
+		sums     string
+		partial  int
+		cached   []byte
+		wantErr  bool
+		requests int
+		rangeHdr string
+	}{
+		{name: "verified", sums: hex.EncodeToString(sum[:]) + " *img.qcow2\n", requests: 1},
+		{name: "resumed", sums: hex.EncodeToString(sum[:]) + " *img.qcow2\n", partial: 1000, requests: 1, rangeHdr: "bytes=1000-"},
+		{name: "cached", sums: hex.EncodeToString(sum[:]) + " *img.qcow2\n", cached: img, requests: 0},
+		{name: "corrupt cache", sums: hex.EncodeToString(sum[:]) + " *img.qcow2\n", cached: img[:1000], requests: 1},
+		{name: "mismatch", sums: fmt.Sprintf("%064x *img.qcow2\n", 0), wantErr: true, requests: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newImageServer(img, tt.sums)
+			defer srv.Close()
+
+			dir, err := ioutil.TempDir("", "virgo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			baseURL := srv.URL + "/release/"
+			cached := filepath.Join(dir, cacheName(baseURL, "img.qcow2"))
+			if tt.partial > 0 {
+				if err := ioutil.WriteFile(cached+".part", img[:tt.partial], 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.cached != nil {
+				if err := ioutil.WriteFile(cached, tt.cached, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			d := &Downloader{CacheDir: dir}
+			p, err := d.Fetch(baseURL, "img.qcow2")
+
+			if len(srv.requests) != tt.requests {
+				t.Errorf("got %d image requests, want %d", len(srv.requests), tt.requests)
+			}
+			if len(srv.requests) > 0 {
+				if got := srv.requests[0].Header.Get("Range"); got != tt.rangeHdr {
+					t.Errorf("got Range header %q, want %q", got, tt.rangeHdr)
+				}
+			}
+
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected checksum error")
+				}
+				if _, err := os.Stat(cached); err == nil {
+					t.Error("corrupt image left in cache")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p != cached {
+				t.Errorf("got path %s, want %s", p, cached)
+			}
+
+			got, err := ioutil.ReadFile(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, img) {
+				t.Errorf("downloaded image differs from served image")
+			}
+		})
+	}
+}
+
+func TestCacheName(t *testing.T) {
+	a := cacheName("https://cloud-images.ubuntu.com/releases/bionic/release/", "ubuntu-18.04-server-cloudimg-amd64.img")
+	b := cacheName("https://cloud-images.ubuntu.com/releases/bionic/release-20190722/", "ubuntu-18.04-server-cloudimg-amd64.img")
+	if a == b {
+		t.Errorf("images of different URLs share cache file %s", a)
+	}
+	if !strings.HasPrefix(a, "ubuntu-18.04-server-cloudimg-amd64.img.") {
+		t.Errorf("unexpected cache file %s", a)
+	}
+}
+
+func TestDownloaderFetchFileURL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	img := []byte("air-gapped image")
+	sum := sha256.Sum256(img)
+	if err := ioutil.WriteFile(filepath.Join(dir, "img.qcow2"), img, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "SHA256SUMS"), []byte(hex.EncodeToString(sum[:])+"  img.qcow2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Downloader{CacheDir: filepath.Join(dir, "cache")}
+	p, err := d.Fetch("file://"+dir+"/", "img.qcow2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != filepath.Join(dir, "img.qcow2") {
+		t.Errorf("got path %s, want image used in place", p)
+	}
+}
+
+func TestProgressWriter(t *testing.T) {
+	var out bytes.Buffer
+	pw := &progressWriter{out: &out, name: "img.qcow2", total: 4 << 20}
+	for i := 0; i < 4; i++ {
+		pw.Write(make([]byte, 1<<20))
+	}
+	pw.finish()
+
+	if !strings.Contains(out.String(), "img.qcow2 ["+strings.Repeat("=", 40)+"] 100% 4/4 MiB\n") {
+		t.Errorf("unexpected progress output %q", out.String())
+	}
+}
@@ -0,0 +1,243 @@
+package virgo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// This file implements a minimal ISO9660 writer with Joliet extensions, just
+// enough to build NoCloud seed images: a single root directory holding a few
+// small regular files. Joliet keeps the file names cloud-init expects (e.g.
+// "user-data") intact, while the primary volume carries 8.3 fallbacks.
+
+const sectorSize = 2048
+
+// Fixed layout of the image, in sectors.
+const (
+	pvdSector       = 16
+	svdSector       = 17
+	termSector      = 18
+	lPathSector     = 19
+	mPathSector     = 20
+	jlPathSector    = 21
+	jmPathSector    = 22
+	rootSector      = 23
+	jolietSector    = 24
+	firstFileSector = 25
+)
+
+type isoFile struct {
+	Name string
+	Data []byte
+}
+
+// isoImage returns an ISO9660 image with Joliet extensions labeled volID,
+// containing files in its root directory.
+func isoImage(volID string, files []isoFile, now time.Time) ([]byte, error) {
+	files = append([]isoFile(nil), files...)
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+
+	extents := make([]uint32, len(files))
+	next := uint32(firstFileSector)
+	for i, f := range files {
+		extents[i] = next
+		next += sectors(len(f.Data))
+	}
+	totalSectors := next
+
+	img := make([]byte, int(totalSectors)*sectorSize)
+
+	root, err := dirExtent(files, extents, rootSector, primaryName, now)
+	if err != nil {
+		return nil, err
+	}
+	joliet, err := dirExtent(files, extents, jolietSector, jolietName, now)
+	if err != nil {
+		return nil, err
+	}
+	copy(img[rootSector*sectorSize:], root)
+	copy(img[jolietSector*sectorSize:], joliet)
+
+	copy(img[pvdSector*sectorSize:], volumeDescriptor(1, volID, totalSectors, lPathSector, mPathSector, rootSector, now))
+	copy(img[svdSector*sectorSize:], volumeDescriptor(2, volID, totalSectors, jlPathSector, jmPathSector, jolietSector, now))
+
+	term := img[termSector*sectorSize:]
+	term[0] = 255
+	copy(term[1:], "CD001")
+	term[6] = 1
+
+	copy(img[lPathSector*sectorSize:], pathTable(rootSector, binary.LittleEndian))
+	copy(img[mPathSector*sectorSize:], pathTable(rootSector, binary.BigEndian))
+	copy(img[jlPathSector*sectorSize:], pathTable(jolietSector, binary.LittleEndian))
+	copy(img[jmPathSector*sectorSize:], pathTable(jolietSector, binary.BigEndian))
+
+	for i, f := range files {
+		copy(img[int(extents[i])*sectorSize:], f.Data)
+	}
+
+	return img, nil
+}
+
+func sectors(n int) uint32 {
+	return uint32((n + sectorSize - 1) / sectorSize)
+}
+
+// primaryName maps name to an ISO9660 level 1 file identifier, e.g. "USER_DAT.;1".
+func primaryName(name string) []byte {
+	mapped := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '.':
+			return r
+		}
+		return '_'
+	}, name)
+
+	base, ext := mapped, ""
+	if i := strings.LastIndex(mapped, "."); i >= 0 {
+		base, ext = mapped[:i], mapped[i+1:]
+	}
+	base = strings.Replace(base, ".", "_", -1)
+	if len(base) > 8 {
+		base = base[:8]
+	}
+	if len(ext) > 3 {
+		ext = ext[:3]
+	}
+	return []byte(base + "." + ext + ";1")
+}
+
+// jolietName maps name to a UCS-2 big-endian Joliet file identifier.
+func jolietName(name string) []byte {
+	return ucs2(name)
+}
+
+func ucs2(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(u))
+	for i, c := range u {
+		binary.BigEndian.PutUint16(b[2*i:], c)
+	}
+	return b
+}
+
+func bothEndian32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b, v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
+
+func bothEndian16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b, v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
+
+// dirRecord returns a directory record pointing to an extent of size bytes.
+func dirRecord(id []byte, extent, size uint32, dir bool, now time.Time) []byte {
+	n := 33 + len(id)
+	if n%2 == 1 {
+		n++
+	}
+	r := make([]byte, n)
+	r[0] = byte(n)
+	bothEndian32(r[2:], extent)
+	bothEndian32(r[10:], size)
+
+	t := now.UTC()
+	r[18] = byte(t.Year() - 1900)
+	r[19] = byte(t.Month())
+	r[20] = byte(t.Day())
+	r[21] = byte(t.Hour())
+	r[22] = byte(t.Minute())
+	r[23] = byte(t.Second())
+
+	if dir {
+		r[25] = 2
+	}
+	bothEndian16(r[28:], 1)
+	r[32] = byte(len(id))
+	copy(r[33:], id)
+	return r
+}
+
+// dirExtent returns the single-sector root directory at sector self, listing files.
+func dirExtent(files []isoFile, extents []uint32, self uint32, name func(string) []byte, now time.Time) ([]byte, error) {
+	var b bytes.Buffer
+	b.Write(dirRecord([]byte{0}, self, sectorSize, true, now))
+	b.Write(dirRecord([]byte{1}, self, sectorSize, true, now))
+	for i, f := range files {
+		b.Write(dirRecord(name(f.Name), extents[i], uint32(len(f.Data)), false, now))
+	}
+	if b.Len() > sectorSize {
+		return nil, fmt.Errorf("too many files for a single-sector directory")
+	}
+	return b.Bytes(), nil
+}
+
+// pathTable returns a path table holding just the root directory at sector root.
+func pathTable(root uint32, order binary.ByteOrder) []byte {
+	t := make([]byte, 10)
+	t[0] = 1
+	order.PutUint32(t[2:], root)
+	order.PutUint16(t[6:], 1)
+	return t
+}
+
+func decDateTime(t time.Time) []byte {
+	return []byte(t.UTC().Format("20060102150405") + "00\x00")
+}
+
+// volumeDescriptor returns a primary (typ 1) or Joliet supplementary (typ 2) volume descriptor.
+func volumeDescriptor(typ byte, volID string, totalSectors, lPath, mPath, root uint32, now time.Time) []byte {
+	d := make([]byte, sectorSize)
+	d[0] = typ
+	copy(d[1:], "CD001")
+	d[6] = 1
+
+	str := func(off, n int, s string) {
+		var b []byte
+		pad := []byte{' '}
+		if typ == 2 {
+			b, pad = ucs2(s), []byte{0, ' '}
+		} else {
+			b = []byte(s)
+		}
+		for i := 0; i < n; i += len(pad) {
+			copy(d[off+i:off+n], pad)
+		}
+		copy(d[off:off+n], b)
+	}
+
+	str(8, 32, "")
+	str(40, 32, volID)
+	bothEndian32(d[80:], totalSectors)
+	if typ == 2 {
+		// UCS-2 level 3
+		copy(d[88:], "%/E")
+	}
+	bothEndian16(d[120:], 1)
+	bothEndian16(d[124:], 1)
+	bothEndian16(d[128:], sectorSize)
+	bothEndian32(d[132:], 10)
+	binary.LittleEndian.PutUint32(d[140:], lPath)
+	binary.BigEndian.PutUint32(d[148:], mPath)
+	copy(d[156:], dirRecord([]byte{0}, root, sectorSize, true, now))
+	str(190, 128, "")
+	str(318, 128, "")
+	str(446, 128, "")
+	str(574, 128, "VIRGO")
+	str(702, 37, "")
+	str(739, 37, "")
+	str(776, 37, "")
+	copy(d[813:], decDateTime(now))
+	copy(d[830:], decDateTime(now))
+	copy(d[847:], "0000000000000000\x00")
+	copy(d[864:], decDateTime(now))
+	d[881] = 1
+	return d
+}
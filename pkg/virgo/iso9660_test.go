@@ -0,0 +1,75 @@
+package virgo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+func TestIsoImage(t *testing.T) {
+	files := []isoFile{
+		{Name: "user-data", Data: []byte("#cloud-config\n")},
+		{Name: "meta-data", Data: bytes.Repeat([]byte("x"), 3000)},
+	}
+
+	img, err := isoImage("cidata", files, time.Date(2019, 7, 1, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(img)%sectorSize != 0 {
+		t.Fatalf("image size %d is not a multiple of the sector size", len(img))
+	}
+
+	pvd := img[pvdSector*sectorSize:]
+	if pvd[0] != 1 || string(pvd[1:6]) != "CD001" || string(pvd[40:46]) != "cidata" {
+		t.Fatalf("invalid primary volume descriptor")
+	}
+	if got := binary.LittleEndian.Uint32(pvd[80:]); int(got)*sectorSize != len(img) {
+		t.Errorf("volume space size %d does not match image size %d", got, len(img))
+	}
+
+	svd := img[svdSector*sectorSize:]
+	if svd[0] != 2 || string(svd[88:91]) != "%/E" {
+		t.Fatalf("invalid Joliet supplementary volume descriptor")
+	}
+
+	// walk the Joliet root directory and read back the files
+	root := binary.LittleEndian.Uint32(svd[156+2:])
+	dir := img[int(root)*sectorSize : int(root+1)*sectorSize]
+	got := map[string][]byte{}
+	for off := 0; off < len(dir) && dir[off] != 0; off += int(dir[off]) {
+		r := dir[off:]
+		id := r[33 : 33+int(r[32])]
+		if r[25]&2 != 0 {
+			continue
+		}
+		u := make([]uint16, len(id)/2)
+		for i := range u {
+			u[i] = binary.BigEndian.Uint16(id[2*i:])
+		}
+		extent := binary.LittleEndian.Uint32(r[2:])
+		size := binary.LittleEndian.Uint32(r[10:])
+		got[string(utf16.Decode(u))] = img[int(extent)*sectorSize : int(extent)*sectorSize+int(size)]
+	}
+
+	for _, f := range files {
+		if !bytes.Equal(got[f.Name], f.Data) {
+			t.Errorf("file %s: got %d bytes, want %d", f.Name, len(got[f.Name]), len(f.Data))
+		}
+	}
+}
+
+func TestPrimaryName(t *testing.T) {
+	for name, want := range map[string]string{
+		"user-data":      "USER_DAT.;1",
+		"network-config": "NETWORK_.;1",
+		"vendor.data.gz": "VENDOR_D.GZ;1",
+	} {
+		if got := string(primaryName(name)); got != want {
+			t.Errorf("primaryName(%s) = %s, want %s", name, got, want)
+		}
+	}
+}
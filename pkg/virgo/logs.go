@@ -0,0 +1,70 @@
+package virgo
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// GuestSerialLogPath returns the file that guest's serial console is logged to.
+func GuestSerialLogPath(l *libvirt.Libvirt, guest string) (string, error) {
+	dom, err := l.DomainLookupByName(guest)
+	if err != nil {
+		return "", fmt.Errorf("failed to lookup domain %s: %v", guest, err)
+	}
+
+	d, err := GetDomainDesc(l, dom)
+	if err != nil {
+		return "", err
+	}
+
+	for _, s := range d.Devices.Serials {
+		if s.Log != nil && s.Log.File != "" {
+			return s.Log.File, nil
+		}
+	}
+	return "", fmt.Errorf("serial console logging is not enabled for domain %s", guest)
+}
+
+// TailFile copies the file at path to w. If follow is set, it keeps copying
+// data appended to the file until stop is closed, starting over if the file
+// gets truncated.
+func TailFile(path string, w io.Writer, follow bool, stop <-chan struct{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var offset int64
+	for {
+		n, err := io.Copy(w, f)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", path, err)
+		}
+		offset += n
+
+		if !follow {
+			return nil
+		}
+
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(pollInterval):
+		}
+
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if fi.Size() < offset {
+			if offset, err = f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package virgo
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTailFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "virgo-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := f.WriteString("Booting\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := TailFile(f.Name(), &out, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "Booting\n" {
+		t.Errorf("got %q, want %q", out.String(), "Booting\n")
+	}
+
+	stop := make(chan struct{})
+	done := make(chan error)
+	pr := &lockedBuffer{}
+	go func() { done <- TailFile(f.Name(), pr, true, stop) }()
+
+	if _, err := f.WriteString("virgo-provision-status=0\n"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !bytes.Contains(pr.Bytes(), []byte("virgo-provision-status=0")) {
+		if time.Now().After(deadline) {
+			t.Fatalf("appended data not followed, got %q", pr.Bytes())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got := string(pr.Bytes()); got != "Booting\nvirgo-provision-status=0\n" {
+		t.Errorf("got %q after following the log", got)
+	}
+}
@@ -0,0 +1,408 @@
+package virgo
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// NetworkConf describes a libvirt virtual network that virgo creates, e.g. for
+// the guests of a topology to be wired to with network interfaces.
+type NetworkConf struct {
+	Name string `json:"name"`
+	// Mode is nat (the default), route or isolated.
+	Mode string `json:"mode,omitempty"`
+	// ForwardDev restricts the forwarding of nat and route networks to a host NIC.
+	ForwardDev string `json:"forward_dev,omitempty"`
+	// Bridge is the name of the network's bridge, picked by libvirt if empty.
+	Bridge string `json:"bridge,omitempty"`
+	// Address is the host's address on the network, with its prefix length,
+	// e.g. 192.168.100.1/24.
+	Address string `json:"address,omitempty"`
+	// DHCPRange is the range of addresses that DHCP hands out, e.g.
+	// 192.168.100.100-192.168.100.200.
+	DHCPRange string     `json:"dhcp_range,omitempty"`
+	DHCPHosts []DHCPHost `json:"dhcp_hosts,omitempty"`
+}
+
+// DHCPHost is a static DHCP entry, giving the guest interface with MAC address
+// MacAddr the address IP and the hostname Name.
+type DHCPHost struct {
+	MacAddr string `json:"mac_addr,omitempty"`
+	IP      string `json:"ip,omitempty"`
+	Name    string `json:"name,omitempty"`
+}
+
+// NetworkDesc models the subset of libvirt's network XML that virgo manages.
+type NetworkDesc struct {
+	XMLName  xml.Name        `xml:"network"`
+	Name     string          `xml:"name"`
+	UUID     string          `xml:"uuid,omitempty"`
+	Metadata *DomainMetadata `xml:"metadata"`
+	Forward  *NetworkForward `xml:"forward"`
+	Bridge   *NetworkBridge  `xml:"bridge"`
+	IPs      []NetworkIP     `xml:"ip"`
+}
+
+type NetworkForward struct {
+	Mode string `xml:"mode,attr,omitempty"`
+	Dev  string `xml:"dev,attr,omitempty"`
+}
+
+type NetworkBridge struct {
+	Name  string `xml:"name,attr,omitempty"`
+	STP   string `xml:"stp,attr,omitempty"`
+	Delay string `xml:"delay,attr,omitempty"`
+}
+
+type NetworkDHCPRange struct {
+	Start string `xml:"start,attr"`
+	End   string `xml:"end,attr"`
+}
+
+type NetworkDHCPHost struct {
+	MAC  string `xml:"mac,attr,omitempty"`
+	Name string `xml:"name,attr,omitempty"`
+	IP   string `xml:"ip,attr"`
+}
+
+type NetworkDHCP struct {
+	Ranges []NetworkDHCPRange `xml:"range"`
+	Hosts  []NetworkDHCPHost  `xml:"host"`
+}
+
+type NetworkIP struct {
+	Address string       `xml:"address,attr"`
+	Prefix  int          `xml:"prefix,attr,omitempty"`
+	Netmask string       `xml:"netmask,attr,omitempty"`
+	DHCP    *NetworkDHCP `xml:"dhcp"`
+}
+
+// Managed reports whether the network was created by virgo.
+func (d *NetworkDesc) Managed() bool {
+	return d.Metadata != nil && d.Metadata.Virgo != nil
+}
+
+// Mode returns the forward mode of the network, or isolated if it has none.
+func (d *NetworkDesc) Mode() string {
+	if d.Forward == nil {
+		return "isolated"
+	}
+	if d.Forward.Mode == "" {
+		// libvirt's default
+		return "nat"
+	}
+	return d.Forward.Mode
+}
+
+// CIDR returns the address and prefix length of the network's first IP, if any.
+func (d *NetworkDesc) CIDR() string {
+	if len(d.IPs) == 0 {
+		return ""
+	}
+	ip := d.IPs[0]
+	prefix := ip.Prefix
+	if ip.Netmask != "" {
+		if mask := net.ParseIP(ip.Netmask).To4(); mask != nil {
+			prefix, _ = net.IPMask(mask).Size()
+		}
+	}
+	return fmt.Sprintf("%s/%d", ip.Address, prefix)
+}
+
+// dhcpRange parses a DHCP range of the form start-end.
+func dhcpRange(s string) (start, end net.IP, err error) {
+	if i := strings.Index(s, "-"); i >= 0 {
+		start, end = net.ParseIP(s[:i]).To4(), net.ParseIP(s[i+1:]).To4()
+	}
+	if start == nil || end == nil {
+		return nil, nil, fmt.Errorf("invalid DHCP range %q, expected e.g. 192.168.100.100-192.168.100.200", s)
+	}
+	return start, end, nil
+}
+
+// Validate checks the network options for problems, which are all reported in
+// the returned *ConfError.
+func (n *NetworkConf) Validate() error {
+	e := &ConfError{}
+
+	if n.Name == "" {
+		e.add("name is required")
+	}
+
+	switch n.Mode {
+	case "", "nat", "route":
+		if n.Address == "" {
+			e.add("address is required for nat and route networks")
+		}
+	case "isolated":
+		if n.ForwardDev != "" {
+			e.add("forward_dev is not supported for isolated networks")
+		}
+	default:
+		e.add("mode %q is unsupported, expected nat, route or isolated", n.Mode)
+	}
+
+	var subnet *net.IPNet
+	if n.Address != "" {
+		ip, ipnet, err := net.ParseCIDR(n.Address)
+		if err != nil || ip.To4() == nil {
+			e.add("address %q is invalid, expected e.g. 192.168.100.1/24", n.Address)
+		} else {
+			subnet = ipnet
+		}
+	}
+
+	inSubnet := func(field string, ip net.IP) {
+		if subnet != nil && !subnet.Contains(ip) {
+			e.add("%s %s is not in %s", field, ip, subnet)
+		}
+	}
+
+	if n.DHCPRange != "" || len(n.DHCPHosts) > 0 {
+		if n.Address == "" {
+			e.add("dhcp_range and dhcp_hosts require an address")
+		}
+	}
+
+	if n.DHCPRange != "" {
+		start, end, err := dhcpRange(n.DHCPRange)
+		if err != nil {
+			e.add("dhcp_range: %v", err)
+		} else {
+			inSubnet("dhcp_range start", start)
+			inSubnet("dhcp_range end", end)
+			if bytes.Compare(start, end) > 0 {
+				e.add("dhcp_range %q ends before it starts", n.DHCPRange)
+			}
+		}
+	}
+
+	macs, ips := map[string]bool{}, map[string]bool{}
+	for i, h := range n.DHCPHosts {
+		field := fmt.Sprintf("dhcp_hosts[%d]", i)
+		if h.MacAddr == "" && h.Name == "" {
+			e.add("%s: either mac_addr or name is required", field)
+		}
+		if h.MacAddr != "" {
+			if _, err := net.ParseMAC(h.MacAddr); err != nil {
+				e.add("%s: mac_addr %q is invalid", field, h.MacAddr)
+			} else if macs[h.MacAddr] {
+				e.add("%s: duplicate mac_addr %s", field, h.MacAddr)
+			}
+			macs[h.MacAddr] = true
+		}
+
+		ip := net.ParseIP(h.IP).To4()
+		if ip == nil {
+			e.add("%s: ip %q is invalid", field, h.IP)
+			continue
+		}
+		inSubnet(field+": ip", ip)
+		if ips[ip.String()] {
+			e.add("%s: duplicate ip %s", field, ip)
+		}
+		ips[ip.String()] = true
+	}
+
+	return e.err()
+}
+
+// NewNetworkDesc returns the description of the network n.
+func NewNetworkDesc(n *NetworkConf) (*NetworkDesc, error) {
+	d := &NetworkDesc{
+		Name:     n.Name,
+		Metadata: &DomainMetadata{Virgo: &VirgoMetadata{}},
+		Bridge:   &NetworkBridge{Name: n.Bridge, STP: "on", Delay: "0"},
+	}
+
+	switch n.Mode {
+	case "", "nat":
+		d.Forward = &NetworkForward{Mode: "nat", Dev: n.ForwardDev}
+	case "route":
+		d.Forward = &NetworkForward{Mode: "route", Dev: n.ForwardDev}
+	case "isolated":
+	default:
+		return nil, fmt.Errorf("unsupported network mode %q", n.Mode)
+	}
+
+	if n.Address == "" {
+		return d, nil
+	}
+
+	ip, ipnet, err := net.ParseCIDR(n.Address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid network address %q: %v", n.Address, err)
+	}
+	prefix, _ := ipnet.Mask.Size()
+	nip := NetworkIP{Address: ip.String(), Prefix: prefix}
+
+	if n.DHCPRange != "" || len(n.DHCPHosts) > 0 {
+		nip.DHCP = &NetworkDHCP{}
+		if n.DHCPRange != "" {
+			start, end, err := dhcpRange(n.DHCPRange)
+			if err != nil {
+				return nil, err
+			}
+			nip.DHCP.Ranges = []NetworkDHCPRange{{Start: start.String(), End: end.String()}}
+		}
+		for _, h := range n.DHCPHosts {
+			nip.DHCP.Hosts = append(nip.DHCP.Hosts, NetworkDHCPHost{MAC: h.MacAddr, Name: h.Name, IP: h.IP})
+		}
+	}
+	d.IPs = []NetworkIP{nip}
+
+	return d, nil
+}
+
+// Marshal returns the indented XML document of d.
+func (d *NetworkDesc) Marshal() (string, error) {
+	out, err := xml.MarshalIndent(d, "", "    ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal network %s: %v", d.Name, err)
+	}
+	return string(out), nil
+}
+
+// ParseNetworkDesc parses a libvirt network XML document.
+func ParseNetworkDesc(s string) (*NetworkDesc, error) {
+	d := &NetworkDesc{}
+	if err := xml.Unmarshal([]byte(s), d); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal network's XML: %v", err)
+	}
+	return d, nil
+}
+
+// GetNetworkDesc returns the description of an existing network.
+func GetNetworkDesc(l *libvirt.Libvirt, nw libvirt.Network) (*NetworkDesc, error) {
+	xmldesc, err := l.NetworkGetXMLDesc(nw, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get network's %s XML: %v", nw.Name, err)
+	}
+	return ParseNetworkDesc(xmldesc)
+}
+
+// CreateNetwork defines the network n, marked as created by virgo, and starts
+// it, setting it to autostart along with the host.
+func CreateNetwork(l *libvirt.Libvirt, n *NetworkConf) error {
+	if _, err := l.NetworkLookupByName(n.Name); err == nil {
+		return fmt.Errorf("network %s already exists", n.Name)
+	}
+
+	d, err := NewNetworkDesc(n)
+	if err != nil {
+		return err
+	}
+	xmlStr, err := d.Marshal()
+	if err != nil {
+		return err
+	}
+
+	nw, err := l.NetworkDefineXML(xmlStr)
+	if err != nil {
+		return fmt.Errorf("failed to define network %s from xml: %v", n.Name, err)
+	}
+
+	if err := l.NetworkCreate(nw); err != nil {
+		l.NetworkUndefine(nw)
+		return fmt.Errorf("failed to start network %s: %v", n.Name, err)
+	}
+
+	if err := l.NetworkSetAutostart(nw, 1); err != nil {
+		return fmt.Errorf("failed to set network %s to autostart: %v", n.Name, err)
+	}
+	return nil
+}
+
+// NetworkInfo is the summary of a libvirt network.
+type NetworkInfo struct {
+	Name      string `json:"name"`
+	Mode      string `json:"mode"`
+	Bridge    string `json:"bridge,omitempty"`
+	Address   string `json:"address,omitempty"`
+	Active    bool   `json:"active"`
+	Autostart bool   `json:"autostart"`
+	Managed   bool   `json:"managed"`
+}
+
+// ListNetworks returns the networks created by virgo, or all networks if all
+// is set, sorted by name.
+func ListNetworks(l *libvirt.Libvirt, all bool) ([]NetworkInfo, error) {
+	nws, _, err := l.ConnectListAllNetworks(1, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list networks: %v", err)
+	}
+
+	var infos []NetworkInfo
+	for _, nw := range nws {
+		d, err := GetNetworkDesc(l, nw)
+		if err != nil {
+			return nil, err
+		}
+		if !all && !d.Managed() {
+			continue
+		}
+
+		active, err := l.NetworkIsActive(nw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get state of network %s: %v", nw.Name, err)
+		}
+		autostart, err := l.NetworkGetAutostart(nw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get autostart of network %s: %v", nw.Name, err)
+		}
+
+		info := NetworkInfo{
+			Name:      d.Name,
+			Mode:      d.Mode(),
+			Address:   d.CIDR(),
+			Active:    active != 0,
+			Autostart: autostart != 0,
+			Managed:   d.Managed(),
+		}
+		if d.Bridge != nil {
+			info.Bridge = d.Bridge.Name
+		}
+		infos = append(infos, info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+// DeleteNetwork stops and undefines the network called name, which should have
+// been created by virgo.
+func DeleteNetwork(l *libvirt.Libvirt, name string) error {
+	nw, err := l.NetworkLookupByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to lookup network %s: %v", name, err)
+	}
+
+	d, err := GetNetworkDesc(l, nw)
+	if err != nil {
+		return err
+	}
+	if !d.Managed() {
+		return fmt.Errorf("network %s was not created by virgo", name)
+	}
+
+	active, err := l.NetworkIsActive(nw)
+	if err != nil {
+		return fmt.Errorf("failed to get state of network %s: %v", name, err)
+	}
+	if active != 0 {
+		if err := l.NetworkDestroy(nw); err != nil {
+			return fmt.Errorf("failed to stop network %s: %v", name, err)
+		}
+	}
+
+	if err := l.NetworkUndefine(nw); err != nil {
+		return fmt.Errorf("failed to undefine network %s: %v", name, err)
+	}
+	return nil
+}
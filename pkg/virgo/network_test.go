@@ -0,0 +1,150 @@
+package virgo
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewNetworkDesc(t *testing.T) {
+	n := &NetworkConf{
+		Name:      "lab",
+		Bridge:    "virbr10",
+		Address:   "192.168.100.1/24",
+		DHCPRange: "192.168.100.100-192.168.100.200",
+		DHCPHosts: []DHCPHost{{MacAddr: "52:54:00:00:00:10", IP: "192.168.100.10", Name: "vm1"}},
+	}
+	d, err := NewNetworkDesc(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := d.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		`<forward mode="nat"></forward>`,
+		`<bridge name="virbr10" stp="on" delay="0"></bridge>`,
+		`<ip address="192.168.100.1" prefix="24">`,
+		`<range start="192.168.100.100" end="192.168.100.200"></range>`,
+		`<host mac="52:54:00:00:00:10" name="vm1" ip="192.168.100.10"></host>`,
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("expected %s in:\n%s", want, s)
+		}
+	}
+
+	// the description should round-trip, marked as created by virgo
+	p, err := ParseNetworkDesc(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Managed() || p.Mode() != "nat" || p.CIDR() != "192.168.100.1/24" {
+		t.Errorf("unexpected parsed network %+v", p)
+	}
+
+	d, err = NewNetworkDesc(&NetworkConf{Name: "internal", Mode: "isolated"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Forward != nil || len(d.IPs) != 0 || d.Mode() != "isolated" {
+		t.Errorf("unexpected isolated network %+v", d)
+	}
+
+	d, err = NewNetworkDesc(&NetworkConf{Name: "routed", Mode: "route", ForwardDev: "eno1", Address: "10.0.0.1/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Forward == nil || d.Forward.Mode != "route" || d.Forward.Dev != "eno1" || d.IPs[0].DHCP != nil {
+		t.Errorf("unexpected routed network %+v", d)
+	}
+}
+
+func TestParseNetworkDesc(t *testing.T) {
+	d, err := ParseNetworkDesc(`<network>
+  <name>default</name>
+  <uuid>6b1a9bb4-4d3f-4e5c-9bc2-3c2dfeb44c55</uuid>
+  <forward mode='nat'>
+    <nat>
+      <port start='1024' end='65535'/>
+    </nat>
+  </forward>
+  <bridge name='virbr0' stp='on' delay='0'/>
+  <mac address='52:54:00:8d:3a:1e'/>
+  <ip address='192.168.122.1' netmask='255.255.255.0'>
+    <dhcp>
+      <range start='192.168.122.2' end='192.168.122.254'/>
+    </dhcp>
+  </ip>
+</network>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Managed() {
+		t.Error("network not created by virgo reported as managed")
+	}
+	if d.Mode() != "nat" || d.CIDR() != "192.168.122.1/24" || d.Bridge.Name != "virbr0" {
+		t.Errorf("unexpected network %s, mode %s, address %s", d.Name, d.Mode(), d.CIDR())
+	}
+}
+
+func TestNetworkConfValidate(t *testing.T) {
+	n := &NetworkConf{
+		Name:       "lab",
+		Mode:       "isolated",
+		ForwardDev: "eno1",
+		Address:    "192.168.100.1/24",
+		DHCPRange:  "192.168.100.200-192.168.100.100",
+		DHCPHosts: []DHCPHost{
+			{MacAddr: "52:54:00:00:00:10", IP: "192.168.100.10"},
+			{MacAddr: "52:54:00:00:00:10", IP: "192.168.101.10"},
+			{IP: "192.168.100.10"},
+		},
+	}
+	err := n.Validate()
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	want := []string{
+		"forward_dev is not supported for isolated networks",
+		`dhcp_range "192.168.100.200-192.168.100.100" ends before it starts`,
+		"dhcp_hosts[1]: duplicate mac_addr 52:54:00:00:00:10",
+		"dhcp_hosts[1]: ip 192.168.101.10 is not in 192.168.100.0/24",
+		"dhcp_hosts[2]: either mac_addr or name is required",
+		"dhcp_hosts[2]: duplicate ip 192.168.100.10",
+	}
+	problems := err.(*ConfError).Problems
+	if len(problems) != len(want) {
+		t.Fatalf("expected %d problems, got %q", len(want), problems)
+	}
+	for i, w := range want {
+		if problems[i] != w {
+			t.Errorf("expected problem %q, got %q", w, problems[i])
+		}
+	}
+
+	n = &NetworkConf{Name: "lab", DHCPRange: "192.168.100.100"}
+	if err := n.Validate(); err == nil || !strings.Contains(err.Error(), "address is required for nat and route networks") ||
+		!strings.Contains(err.Error(), `invalid DHCP range "192.168.100.100"`) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestParseTopologyNetworks(t *testing.T) {
+	tests := []struct {
+		networks string
+		err      string
+	}{
+		{`[{"name": "a", "mode": "bridge"}]`, `networks[0]: invalid network a: mode "bridge" is unsupported, expected nat, route or isolated`},
+		{`[{"name": "a", "mode": "isolated"}, {"name": "a", "mode": "isolated"}]`, "networks[1]: duplicate network a"},
+	}
+
+	for _, test := range tests {
+		topo := `{"networks": ` + test.networks + `, "guests": []}`
+		_, err := ParseTopology([]byte(topo), "json", ".")
+		if err == nil || err.Error() != test.err {
+			t.Errorf("expected error %q for %s, got %v", test.err, topo, err)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package virgo
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// NUMATune binds the memory of a guest, or of each of its NUMA nodes, to host
+// NUMA nodes, e.g. for hugepages to be allocated on the socket of the NIC.
+type NUMATune struct {
+	// Mode is strict (the default), preferred or interleave.
+	Mode string `json:"mode,omitempty"`
+	// NodeSet is the set of host nodes that the guest's memory is bound to.
+	NodeSet string `json:"node_set,omitempty"`
+	// MemNodes bind guest NUMA nodes to host nodes individually.
+	MemNodes []MemNode `json:"mem_nodes,omitempty"`
+}
+
+// MemNode binds the memory of the guest NUMA node CellID to host nodes.
+type MemNode struct {
+	CellID  int    `json:"cell_id"`
+	Mode    string `json:"mode,omitempty"`
+	NodeSet string `json:"node_set,omitempty"`
+}
+
+// numatuneMode returns mode, or the default strict mode if it's empty.
+func numatuneMode(mode string) string {
+	if mode == "" {
+		return "strict"
+	}
+	return mode
+}
+
+// numatuneDesc returns the numatune element of t.
+func numatuneDesc(t *NUMATune) *DomainNUMATune {
+	nt := &DomainNUMATune{}
+	if t.NodeSet != "" {
+		nt.Memory = &DomainNUMATuneMemory{Mode: numatuneMode(t.Mode), NodeSet: t.NodeSet}
+	}
+	for _, n := range t.MemNodes {
+		nt.MemNodes = append(nt.MemNodes, DomainMemNode{CellID: n.CellID, Mode: numatuneMode(n.Mode), NodeSet: n.NodeSet})
+	}
+	return nt
+}
+
+// validateNodeSet checks a host node set of the given mode; preferred mode takes
+// a single node.
+func validateNodeSet(e *ConfError, field, mode, nodeSet string) {
+	switch mode {
+	case "", "strict", "preferred", "interleave":
+	default:
+		e.add("%s: mode %q is unsupported, expected strict, preferred or interleave", field, mode)
+	}
+
+	nodes, err := ParseCPUSet(nodeSet)
+	if err != nil {
+		e.add("%s: node_set: %v", field, err)
+		return
+	}
+	if mode == "preferred" && len(nodes) != 1 {
+		e.add("%s: node_set should be a single node in preferred mode, got %q", field, nodeSet)
+	}
+}
+
+func (g *GuestConf) validateNUMATune(e *ConfError) {
+	t := g.NUMATune
+	if t == nil {
+		return
+	}
+
+	if t.NodeSet == "" && len(t.MemNodes) == 0 {
+		e.add("guest_numatune: either node_set or mem_nodes is required")
+	}
+	if t.NodeSet != "" {
+		validateNodeSet(e, "guest_numatune", t.Mode, t.NodeSet)
+	} else if t.Mode != "" {
+		e.add("guest_numatune: mode is set, but node_set is not")
+	}
+
+	ids := map[int]bool{}
+	for _, n := range g.NUMANodes {
+		ids[n.Id] = true
+	}
+	bound := map[int]bool{}
+	for i, n := range t.MemNodes {
+		field := fmt.Sprintf("guest_numatune.mem_nodes[%d]", i)
+		if !ids[n.CellID] {
+			e.add("%s: cell_id %d is not in guest_numa_nodes", field, n.CellID)
+		} else if bound[n.CellID] {
+			e.add("%s: NUMA node %d is already bound", field, n.CellID)
+		}
+		bound[n.CellID] = true
+
+		if n.Mode == "interleave" {
+			// libvirt only interleaves the guest's memory as a whole
+			e.add("%s: interleave mode is only supported for the whole guest", field)
+			continue
+		}
+		validateNodeSet(e, field, n.Mode, n.NodeSet)
+	}
+}
+
+// HostCapabilities models the subset of libvirt's capabilities XML that virgo
+// checks guests against.
+type HostCapabilities struct {
+	XMLName xml.Name       `xml:"capabilities"`
+	Cells   []HostNUMACell `xml:"host>topology>cells>cell"`
+	Guests  []HostGuest    `xml:"guest"`
+}
+
+type HostGuestDomain struct {
+	Type     string `xml:"type,attr"`
+	Emulator string `xml:"emulator,omitempty"`
+}
+
+type HostGuestArch struct {
+	Name     string            `xml:"name,attr"`
+	Emulator string            `xml:"emulator"`
+	Domains  []HostGuestDomain `xml:"domain"`
+}
+
+type HostGuest struct {
+	OSType string        `xml:"os_type"`
+	Arch   HostGuestArch `xml:"arch"`
+}
+
+type HostPages struct {
+	Size  int    `xml:"size,attr"`
+	Unit  string `xml:"unit,attr"`
+	Count int    `xml:",chardata"`
+}
+
+type HostNUMACell struct {
+	ID     int          `xml:"id,attr"`
+	Memory DomainMemory `xml:"memory"`
+	Pages  []HostPages  `xml:"pages"`
+}
+
+// ParseCapabilities parses a libvirt capabilities XML document.
+func ParseCapabilities(s string) (*HostCapabilities, error) {
+	c := &HostCapabilities{}
+	if err := xml.Unmarshal([]byte(s), c); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal capabilities XML: %v", err)
+	}
+	return c, nil
+}
+
+// GetCapabilities returns the capabilities of the host that l is connected to.
+func GetCapabilities(l *libvirt.Libvirt) (*HostCapabilities, error) {
+	s, err := l.ConnectGetCapabilities()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host capabilities: %v", err)
+	}
+	return ParseCapabilities(s)
+}
+
+// hugepages returns the number of hugepages of size bytes that cell has.
+func (c *HostNUMACell) hugepages(size int) int {
+	for _, p := range c.Pages {
+		scale, ok := hugepageUnits[strings.ToLower(p.Unit)]
+		if ok && p.Size*scale == size {
+			return p.Count
+		}
+	}
+	return 0
+}
+
+// memoryBinding is the memory of a guest, or of one of its NUMA nodes, that's
+// bound to a set of host NUMA nodes.
+type memoryBinding struct {
+	field    string
+	mode     string
+	nodeSet  string
+	memoryMB int
+}
+
+// memoryBindings returns the memory bindings of g's numatune, if any.
+func memoryBindings(g *GuestConf) []memoryBinding {
+	t := g.NUMATune
+	if t == nil {
+		return nil
+	}
+
+	var bindings []memoryBinding
+	boundMB := 0
+	for i, n := range t.MemNodes {
+		memoryMB := 0
+		for _, cell := range g.NUMANodes {
+			if cell.Id == n.CellID {
+				memoryMB = cell.MemoryMB
+			}
+		}
+		boundMB += memoryMB
+		bindings = append(bindings, memoryBinding{fmt.Sprintf("guest_numatune.mem_nodes[%d]", i), n.Mode, n.NodeSet, memoryMB})
+	}
+	if t.NodeSet != "" {
+		bindings = append(bindings, memoryBinding{"guest_numatune", t.Mode, t.NodeSet, g.MemoryMB - boundMB})
+	}
+	return bindings
+}
+
+// hugepageBytes returns the size of g's hugepages in bytes, or 0 if g isn't
+// backed by hugepages or their size is invalid.
+func hugepageBytes(g *GuestConf) int {
+	if !g.HugepageSupport {
+		return 0
+	}
+	unit := g.HugepageSizeUnit
+	if unit == "" {
+		// libvirt's default
+		unit = "KiB"
+	}
+	return g.HugepageSize * hugepageUnits[strings.ToLower(unit)]
+}
+
+// checkHostNUMA checks g's numatune against the host capabilities c: the host
+// nodes it binds to should exist and, when g is backed by hugepages in strict
+// mode, have enough of them for the memory bound to them.
+func checkHostNUMA(c *HostCapabilities, g *GuestConf) error {
+	t := g.NUMATune
+	if t == nil {
+		return nil
+	}
+
+	cells := map[int]*HostNUMACell{}
+	for i := range c.Cells {
+		cells[c.Cells[i].ID] = &c.Cells[i]
+	}
+
+	pageSize := hugepageBytes(g)
+
+	e := &ConfError{}
+	for _, b := range memoryBindings(g) {
+		nodes, err := ParseCPUSet(b.nodeSet)
+		if err != nil {
+			e.add("%s: node_set: %v", b.field, err)
+			continue
+		}
+
+		pages, missing := 0, false
+		for _, n := range nodes {
+			cell, ok := cells[n]
+			if !ok {
+				e.add("%s: host NUMA node %d does not exist, the host has %d", b.field, n, len(c.Cells))
+				missing = true
+				break
+			}
+			if pageSize > 0 {
+				pages += cell.hugepages(pageSize)
+			}
+		}
+
+		if !missing && pageSize > 0 && numatuneMode(b.mode) == "strict" && pages*pageSize < b.memoryMB<<20 {
+			e.add("%s: host NUMA nodes %s have %d hugepages of %d%s, %d are needed",
+				b.field, b.nodeSet, pages, g.HugepageSize, g.HugepageSizeUnit, b.memoryMB<<20/pageSize)
+		}
+	}
+
+	return e.err()
+}
@@ -0,0 +1,118 @@
+package virgo
+
+import (
+	"strings"
+	"testing"
+)
+
+const testCapabilities = `<capabilities>
+  <host>
+    <uuid>4c4c4544-0044-3010-8052-b4c04f4e3132</uuid>
+    <topology>
+      <cells num='2'>
+        <cell id='0'>
+          <memory unit='KiB'>65842588</memory>
+          <pages unit='KiB' size='4'>15887719</pages>
+          <pages unit='KiB' size='2048'>1024</pages>
+          <pages unit='KiB' size='1048576'>0</pages>
+        </cell>
+        <cell id='1'>
+          <memory unit='KiB'>66060188</memory>
+          <pages unit='KiB' size='4'>16253511</pages>
+          <pages unit='KiB' size='2048'>512</pages>
+          <pages unit='KiB' size='1048576'>0</pages>
+        </cell>
+      </cells>
+    </topology>
+  </host>
+  <guest>
+    <os_type>hvm</os_type>
+    <arch name='x86_64'>
+      <wordsize>64</wordsize>
+      <emulator>/usr/bin/qemu-system-x86_64</emulator>
+      <domain type='qemu'/>
+      <domain type='kvm'/>
+    </arch>
+  </guest>
+</capabilities>`
+
+func TestCheckHostNUMA(t *testing.T) {
+	caps, err := ParseCapabilities(testCapabilities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(caps.Cells) != 2 || caps.Cells[1].hugepages(2<<20) != 512 {
+		t.Fatalf("unexpected capabilities %+v", caps)
+	}
+
+	g := &GuestConf{
+		MemoryMB: 3072,
+		NUMANodes: []NUMANode{
+			{Id: 0, Cpus: "0-1", MemoryMB: 2048},
+			{Id: 1, Cpus: "2-3", MemoryMB: 1024},
+		},
+		HugepageSupport:  true,
+		HugepageSize:     2,
+		HugepageSizeUnit: "M",
+		NUMATune: &NUMATune{
+			MemNodes: []MemNode{{CellID: 0, NodeSet: "0"}, {CellID: 1, NodeSet: "1"}},
+		},
+	}
+	if err := checkHostNUMA(caps, g); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// cell 1 needs 1024 hugepages, which node 1 doesn't have
+	g.NUMATune.MemNodes = []MemNode{{CellID: 0, NodeSet: "1"}, {CellID: 1, NodeSet: "2"}}
+	err = checkHostNUMA(caps, g)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	problems := err.(*ConfError).Problems
+	if len(problems) != 2 ||
+		!strings.Contains(problems[0], "have 512 hugepages of 2M, 1024 are needed") ||
+		!strings.Contains(problems[1], "host NUMA node 2 does not exist") {
+		t.Errorf("unexpected problems %q", problems)
+	}
+
+	// preferred mode may fall back to other nodes
+	g.NUMATune = &NUMATune{Mode: "preferred", NodeSet: "1"}
+	if err := checkHostNUMA(caps, g); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestNUMATuneValidate(t *testing.T) {
+	g := &GuestConf{
+		NUMANodes: []NUMANode{{Id: 0}, {Id: 1}},
+		NUMATune: &NUMATune{
+			Mode:    "preferred",
+			NodeSet: "0-1",
+			MemNodes: []MemNode{
+				{CellID: 0, NodeSet: "0"},
+				{CellID: 0, Mode: "strict", NodeSet: "1"},
+				{CellID: 2, Mode: "interleave", NodeSet: "0-1"},
+				{CellID: 1, Mode: "bind", NodeSet: ""},
+			},
+		},
+	}
+	e := &ConfError{}
+	g.validateNUMATune(e)
+
+	want := []string{
+		"guest_numatune: node_set should be a single node in preferred mode",
+		"mem_nodes[1]: NUMA node 0 is already bound",
+		"mem_nodes[2]: cell_id 2 is not in guest_numa_nodes",
+		"mem_nodes[2]: interleave mode is only supported for the whole guest",
+		"mem_nodes[3]: mode \"bind\" is unsupported",
+		"mem_nodes[3]: node_set: empty cpuset",
+	}
+	if len(e.Problems) != len(want) {
+		t.Fatalf("expected %d problems, got %q", len(want), e.Problems)
+	}
+	for i, w := range want {
+		if !strings.Contains(e.Problems[i], w) {
+			t.Errorf("expected problem %q, got %q", w, e.Problems[i])
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package virgo
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"text/template"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// filePoolTypes are the storage pool types whose volumes are plain files under
+// the pool's target path, and can thus be qcow2 overlays written by virgo.
+var filePoolTypes = map[string]bool{"dir": true, "fs": true, "netfs": true}
+
+// FileBased reports whether the pool's volumes are files under its target path.
+func (d *StoragePoolDesc) FileBased() bool {
+	return filePoolTypes[d.Type]
+}
+
+var dirPoolTmpl = `
+<pool type='dir'>
+    <name>{{.Name}}</name>
+    <target>
+        <path>{{.Path}}</path>
+    </target>
+</pool>
+`
+
+func dirPoolXML(name, path string) (string, error) {
+	t, err := template.New("pooltmpl").Parse(dirPoolTmpl)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse template: %v", err)
+	}
+
+	var xml bytes.Buffer
+	if err := t.Execute(&xml, struct{ Name, Path string }{name, path}); err != nil {
+		return "", fmt.Errorf("failed to execute template: %v", err)
+	}
+
+	return xml.String(), nil
+}
+
+// PoolName returns name, or DefaultPool() if name is empty.
+func PoolName(name string) string {
+	if name == "" {
+		return DefaultPool()
+	}
+	return name
+}
+
+// poolDir returns the directory of a dir-type pool created by virgo: under
+// /var/lib/libvirt/virgo for the system daemon, and under the user's
+// ~/.local/share/libvirt/virgo for the session daemon.
+func poolDir(l *libvirt.Libvirt, name string) (string, error) {
+	uri, err := l.ConnectGetUri()
+	if err != nil {
+		return "", fmt.Errorf("failed to get connection URI: %v", err)
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse connection URI %s: %v", uri, err)
+	}
+
+	if u.Path != "/session" {
+		return filepath.Join("/var/lib/libvirt/virgo", name), nil
+	}
+
+	home, err := homeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to determine home directory: %v", err)
+	}
+	return filepath.Join(home, ".local", "share", "libvirt", "virgo", name), nil
+}
+
+var poolMu sync.Mutex
+
+// EnsurePool returns the storage pool called name, or DefaultPool() if name is
+// empty, along with its description. If the pool doesn't exist, a dir-type pool
+// is defined and built; if it's inactive, it's started.
+func EnsurePool(l *libvirt.Libvirt, name string) (libvirt.StoragePool, *StoragePoolDesc, error) {
+	name = PoolName(name)
+
+	// guests provisioned in parallel mustn't define the same pool twice
+	poolMu.Lock()
+	defer poolMu.Unlock()
+
+	pool, err := l.StoragePoolLookupByName(name)
+	if err != nil {
+		path, err := poolDir(l, name)
+		if err != nil {
+			return pool, nil, err
+		}
+
+		xmlStr, err := dirPoolXML(name, path)
+		if err != nil {
+			return pool, nil, err
+		}
+
+		if pool, err = l.StoragePoolDefineXML(xmlStr, 0); err != nil {
+			return pool, nil, fmt.Errorf("failed to define storage pool %s from xml: %v", name, err)
+		}
+
+		if err := l.StoragePoolBuild(pool, libvirt.StoragePoolBuildNew); err != nil {
+			return pool, nil, fmt.Errorf("failed to build storage pool %s: %v", name, err)
+		}
+
+		if err := l.StoragePoolSetAutostart(pool, 1); err != nil {
+			return pool, nil, fmt.Errorf("failed to set storage pool %s to autostart: %v", name, err)
+		}
+	}
+
+	active, err := l.StoragePoolIsActive(pool)
+	if err != nil {
+		return pool, nil, fmt.Errorf("failed to check if storage pool %s is active: %v", name, err)
+	}
+	if active == 0 {
+		if err := l.StoragePoolCreate(pool, 0); err != nil {
+			return pool, nil, fmt.Errorf("failed to start storage pool %s: %v", name, err)
+		}
+	}
+
+	pdesc, err := GetStoragePoolDesc(l, pool)
+	if err != nil {
+		return pool, nil, fmt.Errorf("failed to get storage pool's %s description: %v", name, err)
+	}
+
+	return pool, pdesc, nil
+}
+
+// GuestPool returns the storage pool of guest's volumes, as recorded when it
+// was launched, or DefaultPool() if unknown.
+func GuestPool(l *libvirt.Libvirt, guest string) string {
+	dom, err := l.DomainLookupByName(guest)
+	if err != nil {
+		return DefaultPool()
+	}
+
+	d, err := GetDomainDesc(l, dom)
+	if err != nil || !d.Managed() {
+		return DefaultPool()
+	}
+	return PoolName(d.Metadata.Virgo.Pool)
+}
@@ -0,0 +1,25 @@
+package virgo
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestDirPoolXML(t *testing.T) {
+	s, err := dirPoolXML("lab", "/var/lib/libvirt/virgo/lab")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &StoragePoolDesc{}
+	if err := xml.Unmarshal([]byte(s), d); err != nil {
+		t.Fatalf("invalid pool XML %s: %v", s, err)
+	}
+	if d.Name != "lab" || d.Target.Path != "/var/lib/libvirt/virgo/lab" || !d.FileBased() {
+		t.Errorf("unexpected pool %+v from XML %s", d, s)
+	}
+
+	if (&StoragePoolDesc{Type: "logical"}).FileBased() {
+		t.Error("logical pool reported as file-based")
+	}
+}
@@ -0,0 +1,300 @@
+package virgo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// extendsKey is the config file key naming the configs that a config extends.
+const extendsKey = "extends"
+
+// profileExts are the extensions that profiles are looked up with, in order.
+var profileExts = []string{".yaml", ".yml", ".toml", ".json"}
+
+// ProfilesDir returns the directory of named config profiles,
+// $XDG_CONFIG_HOME/virgo/profiles or ~/.config/virgo/profiles.
+func ProfilesDir() (string, error) {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "virgo", "profiles"), nil
+	}
+
+	home, err := homeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to determine home directory: %v", err)
+	}
+	return filepath.Join(home, ".config", "virgo", "profiles"), nil
+}
+
+// extendsPath returns the path of the config that a config in dir extends by
+// ref: ref is a path relative to dir if it has a directory or an extension,
+// otherwise it's the name of a profile.
+func extendsPath(ref, dir string) (string, error) {
+	if strings.ContainsRune(ref, filepath.Separator) || filepath.Ext(ref) != "" {
+		if filepath.IsAbs(ref) {
+			return ref, nil
+		}
+		return filepath.Join(dir, ref), nil
+	}
+
+	profiles, err := ProfilesDir()
+	if err != nil {
+		return "", err
+	}
+	for _, ext := range profileExts {
+		path := filepath.Join(profiles, ref+ext)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("profile %s not found in %s", ref, profiles)
+}
+
+// readConfMap reads the config file at path into a generic map, whose values
+// are those of its JSON equivalent.
+func readConfMap(path string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file %s: %v", path, err)
+	}
+
+	data, err = toJSON(data, ConfFormat(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+
+	m := map[string]interface{}{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&m); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal config file %s: %v", path, err)
+	}
+	return m, nil
+}
+
+// loadConfMap reads the config file at path into a generic map, deep-merged
+// over the configs it extends, in the order they're listed. visiting holds the
+// configs being loaded, to detect cycles.
+func loadConfMap(path string, visiting map[string]bool) (map[string]interface{}, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if visiting[abs] {
+		return nil, fmt.Errorf("config %s extends itself", path)
+	}
+	visiting[abs] = true
+	defer delete(visiting, abs)
+
+	m, err := readConfMap(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []string
+	switch ext := m[extendsKey].(type) {
+	case nil:
+	case string:
+		refs = []string{ext}
+	case []interface{}:
+		for _, ref := range ext {
+			s, ok := ref.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s: %s should list config paths or profile names", path, extendsKey)
+			}
+			refs = append(refs, s)
+		}
+	default:
+		return nil, fmt.Errorf("%s: %s should be a config path or profile name, or a list of them", path, extendsKey)
+	}
+	delete(m, extendsKey)
+
+	merged := map[string]interface{}{}
+	for _, ref := range refs {
+		basePath, err := extendsPath(ref, filepath.Dir(path))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+
+		base, err := loadConfMap(basePath, visiting)
+		if err != nil {
+			return nil, err
+		}
+		merged = mergeConfMaps(merged, base)
+	}
+	return mergeConfMaps(merged, m), nil
+}
+
+// mergeConfMaps merges over into base, recursing into the maps they both
+// have under the same key. Any other value of over, including lists, replaces
+// that of base.
+func mergeConfMaps(base, over map[string]interface{}) map[string]interface{} {
+	for k, v := range over {
+		bm, ok1 := base[k].(map[string]interface{})
+		om, ok2 := v.(map[string]interface{})
+		if ok1 && ok2 {
+			base[k] = mergeConfMaps(bm, om)
+			continue
+		}
+		base[k] = v
+	}
+	return base
+}
+
+// setConfValue applies an override of the form key=value to the config map m.
+// The key may be a dotted path into nested options, with list indices, e.g.
+// guest_numa_nodes.0.cpus. The value is parsed as YAML, e.g. 16, true or
+// [{type: bridge, bridge: virbr0}], unless the option is a string.
+func setConfValue(m map[string]interface{}, set string) error {
+	i := strings.Index(set, "=")
+	if i <= 0 {
+		return fmt.Errorf("invalid override %q, expected key=value", set)
+	}
+	keys, raw := strings.Split(set[:i], "."), set[i+1:]
+
+	// the schema tells which options are strings, whose values are taken as is
+	schema := typeSchema(reflect.TypeOf(confFile{}))
+	for _, key := range keys {
+		if schema == nil {
+			break
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			schema = items
+			continue
+		}
+		props, _ := schema["properties"].(map[string]interface{})
+		schema, _ = props[key].(map[string]interface{})
+	}
+
+	var value interface{} = raw
+	if schema == nil || schema["type"] != "string" {
+		if err := yaml.Unmarshal([]byte(raw), &value); err != nil {
+			return fmt.Errorf("invalid value in override %q: %v", set, err)
+		}
+		value = stringKeys(value)
+	}
+
+	var parent interface{} = m
+	for n, key := range keys {
+		last := n == len(keys)-1
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			if last {
+				p[key] = value
+				return nil
+			}
+			if _, ok := p[key]; !ok {
+				p[key] = map[string]interface{}{}
+			}
+			parent = p[key]
+		case []interface{}:
+			idx, err := strconv.Atoi(key)
+			if err != nil || idx < 0 || idx >= len(p) {
+				return fmt.Errorf("invalid override %q: no element %s in %s", set, key, strings.Join(keys[:n], "."))
+			}
+			if last {
+				p[idx] = value
+				return nil
+			}
+			parent = p[idx]
+		default:
+			return fmt.Errorf("invalid override %q: %s is not a map or list", set, strings.Join(keys[:n], "."))
+		}
+	}
+	return nil
+}
+
+// LoadConf reads and parses the config file at path, whose format is given by
+// its extension (see ConfFormat), merged over the configs or profiles it
+// extends, and with the key=value overrides of sets applied.
+func LoadConf(path string, sets []string) (*ProvisionConf, *GuestConf, error) {
+	m, err := loadConfMap(path, map[string]bool{})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, set := range sets {
+		if err := setConfValue(m, set); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal config: %v", err)
+	}
+
+	pc, gc, err := ParseConf(data, "json")
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return pc, gc, nil
+}
+
+// decodeNumbers returns v with its json.Numbers replaced by int64s, or float64s
+// for non-integers.
+func decodeNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = decodeNumbers(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = decodeNumbers(e)
+		}
+	}
+	return v
+}
+
+// RenderConf returns the config file of the given format (json, yaml or toml)
+// holding the provisioning and launch options pc and gc.
+func RenderConf(pc *ProvisionConf, gc *GuestConf, format string) ([]byte, error) {
+	c := &confFile{ProvisionConf: pc, GuestConf: gc, Name: gc.Name, StoragePool: gc.StoragePool}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal config: %v", err)
+	}
+
+	switch format {
+	case "json":
+		return append(data, '\n'), nil
+	case "yaml", "toml":
+	default:
+		return nil, fmt.Errorf("unsupported config format %q, expected json, yaml or toml", format)
+	}
+
+	// numbers are kept as such, for integers not to be encoded as floats
+	var m interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&m); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal config: %v", err)
+	}
+	m = decodeNumbers(m)
+
+	if format == "yaml" {
+		return yaml.Marshal(m)
+	}
+
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(m); err != nil {
+		return nil, fmt.Errorf("failed to encode config: %v", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,130 @@
+package virgo
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfExtends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	xdg := os.Getenv("XDG_CONFIG_HOME")
+	defer os.Setenv("XDG_CONFIG_HOME", xdg)
+	os.Setenv("XDG_CONFIG_HOME", dir)
+
+	profiles := filepath.Join(dir, "virgo", "profiles")
+	if err := os.MkdirAll(profiles, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		filepath.Join(profiles, "dpdk.yaml"): `
+guest_hugepage_support: true
+guest_hugepage_size: 2
+guest_hugepage_size_unit: M
+guest_net_ifs:
+  - {type: vhostuser, mac_addr: "de:ad:be:ef:01:23", unix_socket_path: /tmp/vhu1}
+  - {type: vhostuser, mac_addr: "de:ad:be:ef:01:24", unix_socket_path: /tmp/vhu2}
+`,
+		filepath.Join(dir, "base.json"): validConf,
+		filepath.Join(dir, "vm.toml"): `
+extends = ["base.json", "dpdk"]
+guest_memory_mb = 8192
+guest_numa_nodes = [
+  {id = 0, cpus = "0-3", memory_mb = 4096},
+  {id = 1, cpus = "4-7", memory_mb = 4096},
+]
+`,
+		filepath.Join(dir, "loop.yaml"):  "extends: loop2.yaml\n",
+		filepath.Join(dir, "loop2.yaml"): "extends: loop.yaml\n",
+	}
+	for path, data := range files {
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pc, gc, err := LoadConf(filepath.Join(dir, "vm.toml"), []string{
+		"guest_num_vcpus=16",
+		"guest_num_cores_per_socket=4",
+		"guest_numa_nodes.1.cpus=4-15",
+		"guest_net_ifs.0.mac_addr=de:ad:be:ef:00:01",
+		"passwd=1234",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pc.User != "guest" || pc.Passwd != "1234" || gc.StoragePool != "default" {
+		t.Errorf("unexpected provisioning options %+v", pc)
+	}
+	if gc.MemoryMB != 8192 || gc.NumVcpus != 16 || gc.NumCoresPerSocket != 4 || !gc.HugepageSupport {
+		t.Errorf("unexpected launch options %+v", gc)
+	}
+	if len(gc.NetIfs) != 2 || gc.NetIfs[0].Type != "vhostuser" || gc.NetIfs[0].MacAddr != "de:ad:be:ef:00:01" {
+		t.Errorf("expected the profile's interfaces to replace the base's, got %+v", gc.NetIfs)
+	}
+	if len(gc.NUMANodes) != 2 || gc.NUMANodes[1].Cpus != "4-15" || gc.NUMANodes[1].MemoryMB != 4096 {
+		t.Errorf("unexpected NUMA nodes %+v", gc.NUMANodes)
+	}
+	if err := gc.Validate(); err != nil {
+		t.Errorf("unexpected guest config problems: %v", err)
+	}
+
+	if _, _, err := LoadConf(filepath.Join(dir, "loop.yaml"), nil); err == nil || !strings.Contains(err.Error(), "extends itself") {
+		t.Errorf("expected extends cycle error, got %v", err)
+	}
+
+	for _, set := range []string{"guest_num_vcpus", "guest_memroy_mb=1", "guest_numa_nodes.5.cpus=0", "guest_num_vcpus=many"} {
+		if _, _, err := LoadConf(filepath.Join(dir, "vm.toml"), []string{set}); err == nil {
+			t.Errorf("expected error for override %s", set)
+		}
+	}
+}
+
+func TestRenderConf(t *testing.T) {
+	pc, gc, err := ParseConf([]byte(validConf), "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []string{"json", "yaml", "toml"} {
+		data, err := RenderConf(pc, gc, format)
+		if err != nil {
+			t.Errorf("failed to render %s config: %v", format, err)
+			continue
+		}
+
+		pc2, gc2, err := ParseConf(data, format)
+		if err != nil {
+			t.Errorf("failed to parse rendered %s config: %v", format, err)
+			continue
+		}
+		if pc2.CloudImgName != pc.CloudImgName || gc2.NumVcpus != gc.NumVcpus || len(gc2.NetIfs) != len(gc.NetIfs) || gc2.StoragePool != gc.StoragePool {
+			t.Errorf("rendered %s config differs: %+v %+v", format, pc2, gc2)
+		}
+	}
+
+	// integers are rendered as such, not as floats
+	want := map[string]string{
+		"yaml": fmt.Sprintf("guest_num_vcpus: %d\n", gc.NumVcpus),
+		"toml": fmt.Sprintf("guest_num_vcpus = %d\n", gc.NumVcpus),
+	}
+	for format, w := range want {
+		data, err := RenderConf(pc, gc, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), w) {
+			t.Errorf("rendered %s config lacks %q:\n%s", format, w, data)
+		}
+	}
+}
@@ -0,0 +1,719 @@
+package virgo
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// SnapshotDesc models the subset of libvirt's domain snapshot XML that virgo uses.
+type SnapshotDesc struct {
+	XMLName      xml.Name        `xml:"domainsnapshot"`
+	Name         string          `xml:"name"`
+	Description  string          `xml:"description,omitempty"`
+	State        string          `xml:"state,omitempty"`
+	CreationTime int64           `xml:"creationTime,omitempty"`
+	Parent       *SnapshotParent `xml:"parent"`
+	Memory       *SnapshotMemory `xml:"memory"`
+	Disks        []SnapshotDisk  `xml:"disks>disk"`
+}
+
+type SnapshotParent struct {
+	Name string `xml:"name"`
+}
+
+type SnapshotMemory struct {
+	Snapshot string `xml:"snapshot,attr"`
+}
+
+type SnapshotDiskDriver struct {
+	Type string `xml:"type,attr"`
+}
+
+type SnapshotDiskSource struct {
+	File string `xml:"file,attr"`
+}
+
+type SnapshotDisk struct {
+	Name     string              `xml:"name,attr"`
+	Snapshot string              `xml:"snapshot,attr,omitempty"`
+	Driver   *SnapshotDiskDriver `xml:"driver"`
+	Source   *SnapshotDiskSource `xml:"source"`
+}
+
+// External reports whether the snapshot keeps the root disk's state in an
+// external overlay, rather than inside the root image itself.
+func (s *SnapshotDesc) External() bool {
+	for _, d := range s.Disks {
+		if d.Name == rootDiskDev {
+			return d.Snapshot == "external"
+		}
+	}
+	return false
+}
+
+// SnapshotInfo summarizes a snapshot of a guest.
+type SnapshotInfo struct {
+	Name     string    `json:"name"`
+	Parent   string    `json:"parent,omitempty"`
+	State    string    `json:"state"`
+	Created  time.Time `json:"created"`
+	External bool      `json:"external"`
+	Current  bool      `json:"current"`
+}
+
+// SnapshotImgName returns the name of the overlay volume that an external
+// snapshot of guest redirects the guest's root disk to.
+func SnapshotImgName(guest, snapshot string) string {
+	return fmt.Sprintf("%s.virgo.snap.%s", guest, snapshot)
+}
+
+// checkInternalSnapshot checks that the root disk of the domain d can hold
+// internal snapshots, i.e. that it's qcow2; e.g. volumes of non file-based pools
+// are raw.
+func checkInternalSnapshot(d *DomainDesc) error {
+	for _, disk := range d.Devices.Disks {
+		if disk.Target.Dev != rootDiskDev {
+			continue
+		}
+		if disk.Driver.Type != "qcow2" {
+			return fmt.Errorf("the root disk of domain %s is %s, but internal snapshots need a qcow2 one", d.Name, disk.Driver.Type)
+		}
+		return nil
+	}
+	return fmt.Errorf("domain %s has no root disk %s", d.Name, rootDiskDev)
+}
+
+// newSnapshotDesc returns the description of a snapshot of the domain d. Only
+// the root disk is snapshotted; for an external snapshot, its new overlay is
+// overlayPath.
+func newSnapshotDesc(d *DomainDesc, name string, external bool, overlayPath string) *SnapshotDesc {
+	s := &SnapshotDesc{Name: name}
+	if external {
+		s.Memory = &SnapshotMemory{Snapshot: "no"}
+	}
+
+	for _, disk := range d.Devices.Disks {
+		sd := SnapshotDisk{Name: disk.Target.Dev, Snapshot: "no"}
+		if disk.Target.Dev == rootDiskDev {
+			sd.Snapshot = "internal"
+			if external {
+				sd.Snapshot = "external"
+				sd.Driver = &SnapshotDiskDriver{Type: "qcow2"}
+				sd.Source = &SnapshotDiskSource{File: overlayPath}
+			}
+		}
+		s.Disks = append(s.Disks, sd)
+	}
+	return s
+}
+
+// Marshal returns the indented XML document of s.
+func (s *SnapshotDesc) Marshal() (string, error) {
+	out, err := xml.MarshalIndent(s, "", "    ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal snapshot %s: %v", s.Name, err)
+	}
+	return string(out), nil
+}
+
+// ParseSnapshotDesc parses a libvirt domain snapshot XML document.
+func ParseSnapshotDesc(s string) (*SnapshotDesc, error) {
+	d := &SnapshotDesc{}
+	if err := xml.Unmarshal([]byte(s), d); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal snapshot's XML: %v", err)
+	}
+	return d, nil
+}
+
+// GetSnapshotDesc returns the description of an existing snapshot.
+func GetSnapshotDesc(l *libvirt.Libvirt, snap libvirt.DomainSnapshot) (*SnapshotDesc, error) {
+	xmldesc, err := l.DomainSnapshotGetXMLDesc(snap, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get snapshot's %s XML: %v", snap.Name, err)
+	}
+	return ParseSnapshotDesc(xmldesc)
+}
+
+// lookupSnapshot returns the snapshot of dom called name, or its current
+// snapshot if name is empty.
+func lookupSnapshot(l *libvirt.Libvirt, dom libvirt.Domain, name string) (libvirt.DomainSnapshot, error) {
+	if name == "" {
+		snap, err := l.DomainSnapshotCurrent(dom, 0)
+		if err != nil {
+			return snap, fmt.Errorf("failed to get current snapshot of domain %s: %v", dom.Name, err)
+		}
+		return snap, nil
+	}
+
+	snap, err := l.DomainSnapshotLookupByName(dom, name, 0)
+	if err != nil {
+		return snap, fmt.Errorf("failed to lookup snapshot %s of domain %s: %v", name, dom.Name, err)
+	}
+	return snap, nil
+}
+
+// snapshotPoolPath returns the storage pool of guest and its target path, where
+// external snapshot overlays are created. The pool must be file-based.
+func snapshotPoolPath(l *libvirt.Libvirt, guest string) (libvirt.StoragePool, string, error) {
+	poolName := GuestPool(l, guest)
+	pool, err := l.StoragePoolLookupByName(poolName)
+	if err != nil {
+		return pool, "", fmt.Errorf("failed to lookup storage pool %s: %v", poolName, err)
+	}
+
+	pdesc, err := GetStoragePoolDesc(l, pool)
+	if err != nil {
+		return pool, "", err
+	}
+	if !pdesc.FileBased() || pdesc.Target.Path == "" {
+		return pool, "", fmt.Errorf("external snapshots need a file-based storage pool, %s is of type %s", poolName, pdesc.Type)
+	}
+	return pool, pdesc.Target.Path, nil
+}
+
+// CreateSnapshot creates a snapshot of guest called name, or named after the
+// current time if name is empty, and returns its name. An internal snapshot is
+// kept inside the guest's qcow2 root image, along with the guest's memory if
+// it's running. An external snapshot is disk-only: the root image is frozen,
+// and the guest's writes go to a new overlay volume in its storage pool.
+func CreateSnapshot(l *libvirt.Libvirt, guest, name string, external bool) (string, error) {
+	dom, err := l.DomainLookupByName(guest)
+	if err != nil {
+		return "", fmt.Errorf("failed to lookup domain %s: %v", guest, err)
+	}
+
+	d, err := GetDomainDesc(l, dom)
+	if err != nil {
+		return "", err
+	}
+
+	if name == "" {
+		name = time.Now().Format("20060102-150405")
+	}
+
+	var flags libvirt.DomainSnapshotCreateFlags
+	var pool libvirt.StoragePool
+	var overlayPath string
+	if !external {
+		if err := checkInternalSnapshot(d); err != nil {
+			return "", err
+		}
+	} else {
+		var dir string
+		if pool, dir, err = snapshotPoolPath(l, guest); err != nil {
+			return "", err
+		}
+		overlayPath = filepath.Join(dir, SnapshotImgName(guest, name))
+
+		flags = libvirt.DomainSnapshotCreateDiskOnly
+		if state, _, err := l.DomainGetState(dom, 0); err == nil && libvirt.DomainState(state) == libvirt.DomainRunning {
+			flags |= libvirt.DomainSnapshotCreateAtomic
+		}
+	}
+
+	xmlStr, err := newSnapshotDesc(d, name, external, overlayPath).Marshal()
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := l.DomainSnapshotCreateXML(dom, xmlStr, uint32(flags)); err != nil {
+		return "", fmt.Errorf("failed to create snapshot %s of domain %s: %v", name, guest, err)
+	}
+
+	if external {
+		if err := l.StoragePoolRefresh(pool, 0); err != nil {
+			return "", fmt.Errorf("failed to refresh storage pool %s: %v", pool.Name, err)
+		}
+	}
+
+	return name, nil
+}
+
+// ListSnapshots returns the snapshots of guest, oldest first.
+func ListSnapshots(l *libvirt.Libvirt, guest string) ([]SnapshotInfo, error) {
+	dom, err := l.DomainLookupByName(guest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup domain %s: %v", guest, err)
+	}
+
+	snaps, _, err := l.DomainListAllSnapshots(dom, 1, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots of domain %s: %v", guest, err)
+	}
+
+	var infos []SnapshotInfo
+	for _, snap := range snaps {
+		s, err := GetSnapshotDesc(l, snap)
+		if err != nil {
+			return nil, err
+		}
+
+		current, err := l.DomainSnapshotIsCurrent(snap, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check if snapshot %s is current: %v", snap.Name, err)
+		}
+
+		info := SnapshotInfo{
+			Name:     s.Name,
+			State:    s.State,
+			Created:  time.Unix(s.CreationTime, 0),
+			External: s.External(),
+			Current:  current == 1,
+		}
+		if s.Parent != nil {
+			info.Parent = s.Parent.Name
+		}
+		infos = append(infos, info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Created.Before(infos[j].Created) })
+	return infos, nil
+}
+
+// RevertSnapshot reverts guest to its snapshot called name, or to its current
+// snapshot if name is empty, discarding the guest's state since.
+//
+// libvirt reverts internal snapshots itself. An external snapshot is reverted by
+// powering the guest off, recreating the snapshot's overlay empty and pointing
+// the root disk back to it; snapshots taken after it are deleted along with their
+// overlays, which were based on the discarded state. The guest is left shut off.
+func RevertSnapshot(l *libvirt.Libvirt, guest, name string) error {
+	dom, err := l.DomainLookupByName(guest)
+	if err != nil {
+		return fmt.Errorf("failed to lookup domain %s: %v", guest, err)
+	}
+
+	snap, err := lookupSnapshot(l, dom, name)
+	if err != nil {
+		return err
+	}
+
+	s, err := GetSnapshotDesc(l, snap)
+	if err != nil {
+		return err
+	}
+
+	if !s.External() {
+		if err := l.DomainRevertToSnapshot(snap, 0); err != nil {
+			return fmt.Errorf("failed to revert domain %s to snapshot %s: %v", guest, snap.Name, err)
+		}
+		return nil
+	}
+
+	// the guest's state is discarded anyway, so there's no point in waiting for it
+	if err := stopDomain(l, dom, 0, true); err != nil {
+		return fmt.Errorf("failed to stop domain %s: %v", guest, err)
+	}
+
+	pool, _, err := snapshotPoolPath(l, guest)
+	if err != nil {
+		return err
+	}
+
+	overlayPath, err := resetOverlay(l, pool, SnapshotImgName(guest, snap.Name))
+	if err != nil {
+		return err
+	}
+
+	if err := setRootDisk(l, dom, overlayPath); err != nil {
+		return err
+	}
+
+	children, _, err := l.DomainSnapshotListAllChildren(snap, 1, uint32(libvirt.DomainSnapshotListDescendants))
+	if err != nil {
+		return fmt.Errorf("failed to list snapshots taken after %s: %v", snap.Name, err)
+	}
+	for _, child := range children {
+		if err := deleteSnapshot(l, pool, guest, child); err != nil {
+			return err
+		}
+	}
+
+	// the snapshot's flags are kept, but it's redefined to make it current again
+	xmldesc, err := l.DomainSnapshotGetXMLDesc(snap, 0)
+	if err != nil {
+		return fmt.Errorf("failed to get snapshot's %s XML: %v", snap.Name, err)
+	}
+	flags := libvirt.DomainSnapshotCreateRedefine | libvirt.DomainSnapshotCreateCurrent
+	if _, err := l.DomainSnapshotCreateXML(dom, xmldesc, uint32(flags)); err != nil {
+		return fmt.Errorf("failed to make snapshot %s current: %v", snap.Name, err)
+	}
+
+	return nil
+}
+
+// resetOverlay recreates the qcow2 overlay volume called name empty, on top of
+// the same backing file, and returns its path.
+func resetOverlay(l *libvirt.Libvirt, pool libvirt.StoragePool, name string) (string, error) {
+	vol, err := l.StorageVolLookupByName(pool, name)
+	if err != nil {
+		return "", fmt.Errorf("failed to lookup storage volume %s under pool %s: %v", name, pool.Name, err)
+	}
+
+	xmldesc, err := l.StorageVolGetXMLDesc(vol, 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to get storage volume's %s XML: %v", name, err)
+	}
+
+	var v struct {
+		Capacity     uint64 `xml:"capacity"`
+		BackingStore struct {
+			Path   string `xml:"path"`
+			Format struct {
+				Type string `xml:"type,attr"`
+			} `xml:"format"`
+		} `xml:"backingStore"`
+	}
+	if err := xml.Unmarshal([]byte(xmldesc), &v); err != nil {
+		return "", fmt.Errorf("failed to unmarshal storage volume's XML: %v", err)
+	}
+	if v.BackingStore.Path == "" {
+		return "", fmt.Errorf("storage volume %s has no backing file", name)
+	}
+
+	if err := l.StorageVolDelete(vol, 0); err != nil {
+		return "", fmt.Errorf("failed to delete storage volume %s: %v", name, err)
+	}
+
+	xmlStr, err := volXML(&volSpec{
+		Name:          name,
+		Capacity:      v.Capacity,
+		Format:        "qcow2",
+		BackingPath:   v.BackingStore.Path,
+		BackingFormat: v.BackingStore.Format.Type,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	vol, err = l.StorageVolCreateXML(pool, xmlStr, 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to create storage volume %s from xml: %v", name, err)
+	}
+
+	path, err := l.StorageVolGetPath(vol)
+	if err != nil {
+		return "", fmt.Errorf("failed to get path of storage volume %s: %v", name, err)
+	}
+	return path, nil
+}
+
+// setRootDisk redefines the shut off domain dom with its root disk backed by
+// the qcow2 file at path.
+func setRootDisk(l *libvirt.Libvirt, dom libvirt.Domain, path string) error {
+	// the secure XML keeps e.g. the graphics passwords on redefinition
+	xmldesc, err := l.DomainGetXMLDesc(dom, libvirt.DomainXMLSecure|libvirt.DomainXMLInactive)
+	if err != nil {
+		return fmt.Errorf("failed to get domain's %s XML: %v", dom.Name, err)
+	}
+
+	xmlStr, err := setDiskSource(xmldesc, rootDiskDev, path)
+	if err != nil {
+		return fmt.Errorf("domain %s: %v", dom.Name, err)
+	}
+
+	if _, err := l.DomainDefineXML(xmlStr); err != nil {
+		return fmt.Errorf("failed to redefine domain %s from xml: %v", dom.Name, err)
+	}
+	return nil
+}
+
+// xmlEdit replaces the bytes [start, end) of an XML document with text.
+type xmlEdit struct {
+	start, end int64
+	text       string
+}
+
+// setDiskSource returns the domain XML document domXML with the disk of
+// target dev backed by the qcow2 file at path. Only the disk's type, its
+// driver's type and its source are rewritten, and the stale backingStore
+// is dropped, so that the elements that DomainDesc doesn't model are kept.
+func setDiskSource(domXML, dev, path string) (string, error) {
+	dec := xml.NewDecoder(strings.NewReader(domXML))
+
+	var (
+		stack     []string
+		edits     []xmlEdit
+		diskEdits []xmlEdit
+		matched   bool
+		elemStart int64
+		tagEnd    int64
+		haveDrv   bool
+		haveSrc   bool
+		found     bool
+	)
+	for !found {
+		start := dec.InputOffset()
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to parse domain's XML: %v", err)
+		}
+		end := dec.InputOffset()
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			stack = append(stack, t.Name.Local)
+			switch {
+			case strings.Join(stack, "/") == "domain/devices/disk":
+				diskEdits = []xmlEdit{{start, end, startTag(domXML[start:end], t, "type", "file")}}
+				tagEnd, haveDrv, haveSrc, matched = end, false, false, false
+			case len(stack) == 4 && stack[2] == "disk":
+				switch t.Name.Local {
+				case "driver":
+					diskEdits = append(diskEdits, xmlEdit{start, end, startTag(domXML[start:end], t, "type", "qcow2")})
+					haveDrv = true
+				case "source", "backingStore":
+					elemStart = start
+				case "target":
+					for _, a := range t.Attr {
+						if a.Name.Local == "dev" && a.Value == dev {
+							matched = true
+						}
+					}
+				}
+			}
+		case xml.EndElement:
+			switch {
+			case len(stack) == 4 && stack[2] == "disk" && t.Name.Local == "source":
+				diskEdits = append(diskEdits, xmlEdit{elemStart, end, sourceTag(path)})
+				haveSrc = true
+			case len(stack) == 4 && stack[2] == "disk" && t.Name.Local == "backingStore":
+				// along with the indentation of its line
+				start := elemStart
+				for start > 0 && strings.ContainsRune(" \t", rune(domXML[start-1])) {
+					start--
+				}
+				if start > 0 && domXML[start-1] == '\n' {
+					start--
+				}
+				diskEdits = append(diskEdits, xmlEdit{start, end, ""})
+			case strings.Join(stack, "/") == "domain/devices/disk" && matched:
+				if !haveSrc {
+					diskEdits = append(diskEdits, xmlEdit{tagEnd, tagEnd, sourceTag(path)})
+				}
+				if !haveDrv {
+					diskEdits = append(diskEdits, xmlEdit{tagEnd, tagEnd, `<driver name="qemu" type="qcow2"/>`})
+				}
+				edits, found = diskEdits, true
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+	if !found {
+		return "", fmt.Errorf("no disk with target %s", dev)
+	}
+
+	sort.SliceStable(edits, func(i, j int) bool { return edits[i].start < edits[j].start })
+	var b strings.Builder
+	var off int64
+	for _, e := range edits {
+		b.WriteString(domXML[off:e.start])
+		b.WriteString(e.text)
+		off = e.end
+	}
+	b.WriteString(domXML[off:])
+	return b.String(), nil
+}
+
+// startTag returns the start tag raw of the element t, with its attribute
+// name set to value.
+func startTag(raw string, t xml.StartElement, name, value string) string {
+	var b strings.Builder
+	b.WriteString("<" + xmlName(t.Name))
+	set := false
+	for _, a := range t.Attr {
+		v := a.Value
+		if a.Name.Space == "" && a.Name.Local == name {
+			v, set = value, true
+		}
+		b.WriteString(" " + xmlName(a.Name) + `="` + xmlEscape(v) + `"`)
+	}
+	if !set {
+		b.WriteString(" " + name + `="` + xmlEscape(value) + `"`)
+	}
+	if strings.HasSuffix(raw, "/>") {
+		b.WriteString("/>")
+	} else {
+		b.WriteString(">")
+	}
+	return b.String()
+}
+
+func sourceTag(path string) string {
+	return `<source file="` + xmlEscape(path) + `"/>`
+}
+
+// xmlName returns the raw, possibly prefixed, name n.
+func xmlName(n xml.Name) string {
+	if n.Space == "" {
+		return n.Local
+	}
+	return n.Space + ":" + n.Local
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// poolBackingFiles returns the backing files of the volumes of pool that have
+// one, by volume path.
+func poolBackingFiles(l *libvirt.Libvirt, pool libvirt.StoragePool) (map[string]string, error) {
+	vols, _, err := l.StoragePoolListAllVolumes(pool, 1, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list storage volumes of pool %s: %v", pool.Name, err)
+	}
+
+	backing := map[string]string{}
+	for _, vol := range vols {
+		v, err := GetStorageVolDesc(l, vol)
+		if err != nil {
+			return nil, err
+		}
+		if v.BackingStore != nil && v.BackingStore.Path != "" {
+			backing[v.Target.Path] = v.BackingStore.Path
+		}
+	}
+	return backing, nil
+}
+
+// overlayReferenced reports whether the volume at path is the root disk at
+// rootPath, is in its backing chain, or backs any other volume, given backing,
+// the backing files by volume path.
+func overlayReferenced(path, rootPath string, backing map[string]string) bool {
+	seen := map[string]bool{}
+	for p := rootPath; p != "" && !seen[p]; p = backing[p] {
+		if p == path {
+			return true
+		}
+		seen[p] = true
+	}
+	for _, b := range backing {
+		if b == path {
+			return true
+		}
+	}
+	return false
+}
+
+// deleteSnapshot deletes snap of guest. libvirt can't merge an external
+// snapshot's overlay back into its backing file, so only its metadata is deleted;
+// the overlay is removed as well if nothing is based on it any more, i.e. if it's
+// neither in the backing chain of the guest's root disk nor backing any other
+// volume (which is the case for discarded descendants of a reverted snapshot).
+func deleteSnapshot(l *libvirt.Libvirt, pool libvirt.StoragePool, guest string, snap libvirt.DomainSnapshot) error {
+	s, err := GetSnapshotDesc(l, snap)
+	if err != nil {
+		return err
+	}
+
+	if !s.External() {
+		if err := l.DomainSnapshotDelete(snap, 0); err != nil {
+			return fmt.Errorf("failed to delete snapshot %s: %v", snap.Name, err)
+		}
+		return nil
+	}
+
+	if err := l.DomainSnapshotDelete(snap, libvirt.DomainSnapshotDeleteMetadataOnly); err != nil {
+		return fmt.Errorf("failed to delete snapshot %s: %v", snap.Name, err)
+	}
+
+	overlay := SnapshotImgName(guest, snap.Name)
+	vol, err := l.StorageVolLookupByName(pool, overlay)
+	if err != nil {
+		return nil
+	}
+	path, err := l.StorageVolGetPath(vol)
+	if err != nil {
+		return fmt.Errorf("failed to get path of storage volume %s: %v", overlay, err)
+	}
+
+	d, err := GetDomainDesc(l, snap.Dom)
+	if err != nil {
+		return err
+	}
+	var rootPath string
+	for _, disk := range d.Devices.Disks {
+		if disk.Target.Dev == rootDiskDev {
+			rootPath = disk.Source.File
+		}
+	}
+
+	backing, err := poolBackingFiles(l, pool)
+	if err != nil {
+		return err
+	}
+	if overlayReferenced(path, rootPath, backing) {
+		return nil
+	}
+
+	if err := l.StorageVolDelete(vol, 0); err != nil {
+		return fmt.Errorf("failed to delete storage volume %s: %v", overlay, err)
+	}
+	return nil
+}
+
+// DeleteSnapshot deletes the snapshot of guest called name. Deleting an
+// external snapshot drops it from the guest's snapshots, but if the guest's root
+// disk or a later snapshot still depends on its overlay, the overlay is kept until
+// the guest is purged.
+func DeleteSnapshot(l *libvirt.Libvirt, guest, name string) error {
+	dom, err := l.DomainLookupByName(guest)
+	if err != nil {
+		return fmt.Errorf("failed to lookup domain %s: %v", guest, err)
+	}
+
+	snap, err := lookupSnapshot(l, dom, name)
+	if err != nil {
+		return err
+	}
+
+	var pool libvirt.StoragePool
+	if s, err := GetSnapshotDesc(l, snap); err == nil && s.External() {
+		if pool, _, err = snapshotPoolPath(l, guest); err != nil {
+			return err
+		}
+	}
+
+	return deleteSnapshot(l, pool, guest, snap)
+}
+
+// purgeSnapshots deletes the snapshots of guest, if it's still defined, and any
+// external snapshot overlays of it left in pool.
+func purgeSnapshots(l *libvirt.Libvirt, pool libvirt.StoragePool, guest string) error {
+	if dom, err := l.DomainLookupByName(guest); err == nil {
+		snaps, _, err := l.DomainListAllSnapshots(dom, 1, 0)
+		if err != nil {
+			return fmt.Errorf("failed to list snapshots of domain %s: %v", guest, err)
+		}
+		for _, snap := range snaps {
+			if err := l.DomainSnapshotDelete(snap, libvirt.DomainSnapshotDeleteMetadataOnly); err != nil {
+				return fmt.Errorf("failed to delete snapshot %s: %v", snap.Name, err)
+			}
+		}
+	}
+
+	vols, _, err := l.StoragePoolListAllVolumes(pool, 1, 0)
+	if err != nil {
+		return fmt.Errorf("failed to list storage volumes of pool %s: %v", pool.Name, err)
+	}
+	for _, vol := range vols {
+		if strings.HasPrefix(vol.Name, SnapshotImgName(guest, "")) {
+			if err := l.StorageVolDelete(vol, 0); err != nil {
+				return fmt.Errorf("failed to delete storage volume %s: %v", vol.Name, err)
+			}
+		}
+	}
+	return nil
+}
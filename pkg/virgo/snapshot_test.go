@@ -0,0 +1,190 @@
+package virgo
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewSnapshotDesc(t *testing.T) {
+	d, err := NewDomainDesc(&domainTests[0].conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	internal, err := newSnapshotDesc(d, "clean", false, "").Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`<name>clean</name>`,
+		`<disk name="vda" snapshot="internal"></disk>`,
+		`<disk name="vdb" snapshot="no"></disk>`,
+	} {
+		if !strings.Contains(internal, want) {
+			t.Errorf("internal snapshot XML lacks %s:\n%s", want, internal)
+		}
+	}
+	if strings.Contains(internal, "<memory") {
+		t.Errorf("internal snapshot XML should keep the memory state:\n%s", internal)
+	}
+
+	external, err := newSnapshotDesc(d, "clean", true, "/pool/foo.virgo.snap.clean").Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`<memory snapshot="no"></memory>`,
+		`<disk name="vda" snapshot="external">`,
+		`<driver type="qcow2"></driver>`,
+		`<source file="/pool/foo.virgo.snap.clean"></source>`,
+		`<disk name="vdb" snapshot="no"></disk>`,
+	} {
+		if !strings.Contains(external, want) {
+			t.Errorf("external snapshot XML lacks %s:\n%s", want, external)
+		}
+	}
+}
+
+func TestCheckInternalSnapshot(t *testing.T) {
+	for _, tt := range domainTests {
+		d, err := NewDomainDesc(&tt.conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkInternalSnapshot(d)
+		if tt.conf.RootImgPath == "" {
+			// volumes of non file-based pools are raw
+			if err == nil || !strings.Contains(err.Error(), "internal snapshots need a qcow2 one") {
+				t.Errorf("%s: expected raw root disk error, got %v", tt.name, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		}
+	}
+}
+
+func TestParseSnapshotDesc(t *testing.T) {
+	// trimmed output of virsh snapshot-dumpxml
+	s, err := ParseSnapshotDesc(`
+<domainsnapshot>
+  <name>clean</name>
+  <state>disk-snapshot</state>
+  <parent>
+    <name>base</name>
+  </parent>
+  <creationTime>1563200000</creationTime>
+  <memory snapshot='no'/>
+  <disks>
+    <disk name='vda' snapshot='external' type='file'>
+      <driver type='qcow2'/>
+      <source file='/pool/foo.virgo.snap.clean'/>
+    </disk>
+    <disk name='vdb' snapshot='no'/>
+  </disks>
+  <domain type='kvm'>
+    <name>foo</name>
+  </domain>
+</domainsnapshot>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Name != "clean" || s.State != "disk-snapshot" || s.CreationTime != 1563200000 {
+		t.Errorf("unexpected snapshot %+v", s)
+	}
+	if s.Parent == nil || s.Parent.Name != "base" {
+		t.Errorf("unexpected parent %+v", s.Parent)
+	}
+	if !s.External() {
+		t.Errorf("snapshot should be external")
+	}
+}
+
+func TestOverlayReferenced(t *testing.T) {
+	// base <- vm.virgo.img <- s1 <- s2, with the root disk on s2, and s0 a
+	// discarded overlay of a reverted snapshot
+	const (
+		root = "/pool/vm.virgo.img"
+		s0   = "/pool/vm.virgo.snap.s0"
+		s1   = "/pool/vm.virgo.snap.s1"
+		s2   = "/pool/vm.virgo.snap.s2"
+	)
+	backing := map[string]string{
+		root: "/pool/bionic.img.virgo.base",
+		s0:   root,
+		s1:   root,
+		s2:   s1,
+	}
+
+	tests := []struct {
+		path       string
+		referenced bool
+	}{
+		{s2, true},
+		{s1, true},
+		{root, true},
+		{s0, false},
+	}
+	for _, tt := range tests {
+		if got := overlayReferenced(tt.path, s2, backing); got != tt.referenced {
+			t.Errorf("expected %s to be referenced: %v, got %v", tt.path, tt.referenced, got)
+		}
+	}
+
+	// reverted to s1, with s2 discarded
+	if overlayReferenced(s2, s1, map[string]string{root: "/pool/bionic.img.virgo.base", s1: root, s2: s1}) {
+		t.Errorf("expected discarded %s not to be referenced", s2)
+	}
+}
+
+func TestSetDiskSource(t *testing.T) {
+	// a domain as dumped by virsh dumpxml, with elements that DomainDesc
+	// doesn't model
+	in, err := ioutil.ReadFile(filepath.Join("testdata", "dumpxml-foo.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const overlay = "/var/lib/libvirt/images/foo.virgo.snap.s1"
+	got, err := setDiskSource(string(in), rootDiskDev, overlay)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	golden := filepath.Join("testdata", "dumpxml-foo-s1.xml")
+	if *update {
+		if err := ioutil.WriteFile(golden, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("domain XML differs from %s (run with -update to refresh):\n%s", golden, got)
+	}
+
+	d, err := ParseDomainDesc(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, disk := range d.Devices.Disks {
+		switch disk.Target.Dev {
+		case rootDiskDev:
+			if disk.Type != "file" || disk.Driver.Type != "qcow2" || disk.Source != (DomainDiskSource{File: overlay}) {
+				t.Errorf("unexpected root disk %+v", disk)
+			}
+		default:
+			if disk.Source.File != "/var/lib/libvirt/images/foo.virgo.iso" {
+				t.Errorf("unexpected disk %+v", disk)
+			}
+		}
+	}
+
+	if _, err := setDiskSource(string(in), "vdc", overlay); err == nil {
+		t.Errorf("expected an error for a missing disk")
+	}
+}
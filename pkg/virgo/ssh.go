@@ -0,0 +1,118 @@
+package virgo
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// GuestIPAddrs returns the IPv4 addresses of a running guest. The addresses are
+// looked up in libvirt's DHCP leases, then via the guest agent and the host's ARP
+// table, and finally in the DHCP leases of every active network for the guest's MACs,
+// which covers bridge interfaces attached to a libvirt network's bridge (e.g. virbr0).
+func GuestIPAddrs(l *libvirt.Libvirt, guest string) ([]string, error) {
+	dom, err := l.DomainLookupByName(guest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup domain %s: %v", guest, err)
+	}
+
+	sources := []libvirt.DomainInterfaceAddressesSource{
+		libvirt.DomainInterfaceAddressesSrcLease,
+		libvirt.DomainInterfaceAddressesSrcAgent,
+		libvirt.DomainInterfaceAddressesSrcArp,
+	}
+	for _, src := range sources {
+		ifaces, err := l.DomainInterfaceAddresses(dom, uint32(src), 0)
+		if err != nil {
+			continue
+		}
+		var addrs []string
+		for _, iface := range ifaces {
+			for _, a := range iface.Addrs {
+				if libvirt.IPAddrType(a.Type) == libvirt.IPAddrTypeIpv4 {
+					addrs = append(addrs, a.Addr)
+				}
+			}
+		}
+		if len(addrs) > 0 {
+			return addrs, nil
+		}
+	}
+
+	addrs, err := leasedAddrs(l, dom)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no IP address found for domain %s", guest)
+	}
+	return addrs, nil
+}
+
+func guestMACs(l *libvirt.Libvirt, dom libvirt.Domain) ([]string, error) {
+	d, err := GetDomainDesc(l, dom)
+	if err != nil {
+		return nil, err
+	}
+
+	var macs []string
+	for _, iface := range d.Devices.Interfaces {
+		if iface.MAC != nil && iface.MAC.Address != "" {
+			macs = append(macs, strings.ToLower(iface.MAC.Address))
+		}
+	}
+	return macs, nil
+}
+
+func leasedAddrs(l *libvirt.Libvirt, dom libvirt.Domain) ([]string, error) {
+	macs, err := guestMACs(l, dom)
+	if err != nil {
+		return nil, err
+	}
+
+	nets, _, err := l.ConnectListAllNetworks(1, libvirt.ConnectListNetworksActive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list networks: %v", err)
+	}
+
+	var addrs []string
+	for _, n := range nets {
+		for _, mac := range macs {
+			leases, _, err := l.NetworkGetDhcpLeases(n, libvirt.OptString{mac}, 1, 0)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get DHCP leases of network %s: %v", n.Name, err)
+			}
+			for _, lease := range leases {
+				if libvirt.IPAddrType(lease.Type) == libvirt.IPAddrTypeIpv4 {
+					addrs = append(addrs, lease.Ipaddr)
+				}
+			}
+		}
+	}
+	return addrs, nil
+}
+
+// SSHCommand returns a command that opens an ssh session as user to addr,
+// running the optional remote command args. The command inherits the caller's
+// standard streams. If insecure is set, the guest's host key is not checked,
+// which is handy for guests that are re-provisioned under the same address.
+func SSHCommand(user, addr string, insecure bool, args ...string) *exec.Cmd {
+	sshArgs := []string{}
+	if insecure {
+		sshArgs = append(sshArgs, "-o", "StrictHostKeyChecking=no", "-o", "UserKnownHostsFile=/dev/null")
+	}
+	if user != "" {
+		sshArgs = append(sshArgs, "-l", user)
+	}
+	sshArgs = append(sshArgs, addr)
+	sshArgs = append(sshArgs, args...)
+
+	cmd := exec.Command("ssh", sshArgs...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd
+}
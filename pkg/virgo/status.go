@@ -0,0 +1,130 @@
+package virgo
+
+import (
+	"fmt"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// GuestStatus summarizes the state of a virgo-managed guest and its volumes.
+type GuestStatus struct {
+	Name              string   `json:"name"`
+	State             string   `json:"state"`
+	NumVcpus          int      `json:"num_vcpus"`
+	MemoryMB          int      `json:"memory_mb"`
+	IPAddrs           []string `json:"ip_addrs,omitempty"`
+	Pool              string   `json:"pool"`
+	RootImgExists     bool     `json:"root_img_exists"`
+	RootImgCapacity   uint64   `json:"root_img_capacity"`
+	RootImgAllocation uint64   `json:"root_img_allocation"`
+	ConfigIsoExists   bool     `json:"config_iso_exists"`
+	// Error is set, with State "unknown", if the status couldn't be read.
+	Error string `json:"error,omitempty"`
+}
+
+var domainStates = map[libvirt.DomainState]string{
+	libvirt.DomainNostate:     "no state",
+	libvirt.DomainRunning:     "running",
+	libvirt.DomainBlocked:     "blocked",
+	libvirt.DomainPaused:      "paused",
+	libvirt.DomainShutdown:    "shutting down",
+	libvirt.DomainShutoff:     "shut off",
+	libvirt.DomainCrashed:     "crashed",
+	libvirt.DomainPmsuspended: "suspended",
+}
+
+func domainStateString(s libvirt.DomainState) string {
+	if str, ok := domainStates[s]; ok {
+		return str
+	}
+	return fmt.Sprintf("unknown (%d)", s)
+}
+
+// guestStatus returns the status of dom, which is described by d.
+func guestStatus(l *libvirt.Libvirt, dom libvirt.Domain, d *DomainDesc) (*GuestStatus, error) {
+	state, _, err := l.DomainGetState(dom, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get state of domain %s: %v", dom.Name, err)
+	}
+
+	_, maxMem, _, nrVirtCPU, _, err := l.DomainGetInfo(dom)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get info of domain %s: %v", dom.Name, err)
+	}
+
+	st := &GuestStatus{
+		Name:     dom.Name,
+		State:    domainStateString(libvirt.DomainState(state)),
+		NumVcpus: int(nrVirtCPU),
+		MemoryMB: int(maxMem / 1024),
+		Pool:     d.Metadata.Virgo.Pool,
+	}
+
+	if libvirt.DomainState(state) == libvirt.DomainRunning {
+		// a guest that's still booting has no address yet, which is not an error
+		st.IPAddrs, _ = GuestIPAddrs(l, dom.Name)
+	}
+
+	if st.Pool == "" {
+		st.Pool = DefaultPool()
+	}
+	pool, err := l.StoragePoolLookupByName(st.Pool)
+	if err != nil {
+		return st, nil
+	}
+
+	if vol, err := l.StorageVolLookupByName(pool, RootImgName(dom.Name)); err == nil {
+		st.RootImgExists = true
+		if _, capacity, allocation, err := l.StorageVolGetInfo(vol); err == nil {
+			st.RootImgCapacity, st.RootImgAllocation = capacity, allocation
+		}
+	}
+
+	if _, err := l.StorageVolLookupByName(pool, ConfigIsoName(dom.Name)); err == nil {
+		st.ConfigIsoExists = true
+	}
+
+	return st, nil
+}
+
+// Status returns the status of guest, which must be managed by virgo.
+func Status(l *libvirt.Libvirt, guest string) (*GuestStatus, error) {
+	dom, err := l.DomainLookupByName(guest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup domain %s: %v", guest, err)
+	}
+
+	d, err := GetDomainDesc(l, dom)
+	if err != nil {
+		return nil, err
+	}
+	if !d.Managed() {
+		return nil, fmt.Errorf("domain %s is not managed by virgo", guest)
+	}
+	return guestStatus(l, dom, d)
+}
+
+// List returns the status of all guests managed by virgo. Guests whose status
+// can't be read are listed with their Error set, and domains whose XML can't be
+// read, e.g. as they were undefined meanwhile, are skipped.
+func List(l *libvirt.Libvirt) ([]GuestStatus, error) {
+	doms, _, err := l.ConnectListAllDomains(1, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list domains: %v", err)
+	}
+
+	var guests []GuestStatus
+	for _, dom := range doms {
+		d, err := GetDomainDesc(l, dom)
+		if err != nil || !d.Managed() {
+			continue
+		}
+
+		st, err := guestStatus(l, dom, d)
+		if err != nil {
+			st = &GuestStatus{Name: dom.Name, State: "unknown", Pool: PoolName(d.Metadata.Virgo.Pool), Error: err.Error()}
+		}
+		guests = append(guests, *st)
+	}
+	return guests, nil
+}
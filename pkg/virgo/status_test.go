@@ -0,0 +1,77 @@
+package virgo
+
+import "testing"
+
+func TestDomainManaged(t *testing.T) {
+	tests := []struct {
+		name    string
+		xml     string
+		managed bool
+		pool    string
+	}{
+		{
+			name: "virgo",
+			xml: `<domain type='kvm' id='1'>
+  <name>foo</name>
+  <metadata>
+    <virgo:virgo xmlns:virgo="https://github.com/anastop/virgo" pool="vg0">
+      <virgo:guest_conf>{&quot;name&quot;:&quot;foo&quot;}</virgo:guest_conf>
+    </virgo:virgo>
+  </metadata>
+</domain>`,
+			managed: true,
+			pool:    "vg0",
+		},
+		{
+			name: "virgo without pool",
+			xml: `<domain type='kvm'>
+  <name>foo</name>
+  <metadata>
+    <virgo xmlns="https://github.com/anastop/virgo"/>
+  </metadata>
+</domain>`,
+			managed: true,
+		},
+		{
+			name: "other metadata",
+			xml: `<domain type='kvm'>
+  <name>win10</name>
+  <metadata>
+    <libosinfo:libosinfo xmlns:libosinfo="http://libosinfo.org/xmlns/libvirt/domain/1.0">
+      <libosinfo:os id="http://microsoft.com/win/10"/>
+    </libosinfo:libosinfo>
+  </metadata>
+</domain>`,
+		},
+		{
+			name: "virgo element of another namespace",
+			xml: `<domain type='kvm'>
+  <name>impostor</name>
+  <metadata>
+    <app:virgo xmlns:app="https://example.com/virgo" pool="default"/>
+  </metadata>
+</domain>`,
+		},
+		{
+			name: "no metadata",
+			xml: `<domain type='kvm'>
+  <name>bar</name>
+</domain>`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := ParseDomainDesc(tt.xml)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.Managed() != tt.managed {
+				t.Fatalf("expected managed %v, got %v", tt.managed, d.Managed())
+			}
+			if tt.managed && d.Metadata.Virgo.Pool != tt.pool {
+				t.Errorf("got pool %q, want %q", d.Metadata.Virgo.Pool, tt.pool)
+			}
+		})
+	}
+}
@@ -0,0 +1,478 @@
+package virgo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// TopologyGuest is a guest of a topology, along with the guests it depends on.
+type TopologyGuest struct {
+	Name      string
+	DependsOn []string
+	Provision *ProvisionConf
+	Guest     *GuestConf
+}
+
+// Topology describes a set of guests that are brought up and down together,
+// e.g. a testbed of VMs wired to the ports of a vswitch.
+//
+// A topology file is a JSON object with the "defaults" shared by all guests and
+// the list of "guests". Each guest takes any provisioning or launch option, which
+// overrides the defaults, along with its "name", the "depends_on" list of guests
+// that it's brought up after (and down before), and "provision_script" and
+// "initd_script" paths, relative to the topology file. The "networks" that the
+// guests' network interfaces refer to are created before any guest is brought
+// up, and deleted after all of them are brought down:
+//
+//	{
+//	  "defaults": {"cloud_img_name": "...", "guest_memory_mb": 4096},
+//	  "networks": [{"name": "lab", "address": "192.168.100.1/24"}],
+//	  "guests": [
+//	    {"name": "vswitch", "guest_num_vcpus": 4, "provision_script": "ovs.sh"},
+//	    {"name": "vm1", "depends_on": ["vswitch"]}
+//	  ]
+//	}
+type Topology struct {
+	Guests   []TopologyGuest
+	Networks []NetworkConf
+}
+
+type topologyFile struct {
+	Defaults map[string]json.RawMessage   `json:"defaults"`
+	Guests   []map[string]json.RawMessage `json:"guests"`
+	Networks []NetworkConf                `json:"networks"`
+}
+
+// topologyGuestFile is the layout of a topology's guest, whose provisioning and
+// launch options are those of config files.
+type topologyGuestFile struct {
+	confFile
+	DependsOn       []string `json:"depends_on"`
+	ProvisionScript string   `json:"provision_script"`
+	InitdScript     string   `json:"initd_script"`
+}
+
+// LoadTopology reads and parses the topology file at path, whose format is
+// given by its extension, as for config files.
+func LoadTopology(path string) (*Topology, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read topology file %s: %v", path, err)
+	}
+	return ParseTopology(data, ConfFormat(path), filepath.Dir(path))
+}
+
+// ParseTopology parses a topology file of the given format, whose scripts are
+// relative to dir.
+func ParseTopology(data []byte, format, dir string) (*Topology, error) {
+	data, err := toJSON(data, format)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse topology: %v", err)
+	}
+
+	tf := &topologyFile{}
+	if err := json.Unmarshal(data, tf); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal topology: %v", err)
+	}
+
+	t := &Topology{Networks: tf.Networks}
+	networks := map[string]bool{}
+	for i := range t.Networks {
+		n := &t.Networks[i]
+		if err := n.Validate(); err != nil {
+			return nil, fmt.Errorf("networks[%d]: invalid network %s: %v", i, n.Name, err)
+		}
+		if networks[n.Name] {
+			return nil, fmt.Errorf("networks[%d]: duplicate network %s", i, n.Name)
+		}
+		networks[n.Name] = true
+	}
+
+	names := map[string]bool{}
+	for i, opts := range tf.Guests {
+		merged := map[string]json.RawMessage{}
+		for k, v := range tf.Defaults {
+			merged[k] = v
+		}
+		for k, v := range opts {
+			merged[k] = v
+		}
+
+		g, err := topologyGuest(merged, dir)
+		if err != nil {
+			return nil, fmt.Errorf("guests[%d]: %v", i, err)
+		}
+		if names[g.Name] {
+			return nil, fmt.Errorf("guests[%d]: duplicate guest %s", i, g.Name)
+		}
+		names[g.Name] = true
+		t.Guests = append(t.Guests, *g)
+	}
+
+	for _, g := range t.Guests {
+		for _, dep := range g.DependsOn {
+			if !names[dep] {
+				return nil, fmt.Errorf("guest %s depends on unknown guest %s", g.Name, dep)
+			}
+		}
+	}
+
+	if err := t.checkCycles(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func topologyGuest(opts map[string]json.RawMessage, dir string) (*TopologyGuest, error) {
+	data, err := json.Marshal(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal guest options: %v", err)
+	}
+
+	tg := &topologyGuestFile{confFile: *newConfFile()}
+	if err := decodeStrict(data, "json", tg); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal guest options: %v", err)
+	}
+	if tg.Name == "" {
+		return nil, fmt.Errorf("guest has no name")
+	}
+	pc, gc := tg.split()
+
+	if tg.ProvisionScript != "" {
+		data, err := ioutil.ReadFile(filepath.Join(dir, tg.ProvisionScript))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read provision script of %s: %v", tg.Name, err)
+		}
+		pc.Provision = string(data)
+	}
+
+	if tg.InitdScript != "" {
+		data, err := ioutil.ReadFile(filepath.Join(dir, tg.InitdScript))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read initd script of %s: %v", tg.Name, err)
+		}
+		pc.Initd = string(data)
+	}
+
+	e := &ConfError{}
+	for _, err := range []error{pc.Validate(), gc.Validate()} {
+		if err, ok := err.(*ConfError); ok {
+			e.Problems = append(e.Problems, err.Problems...)
+		}
+	}
+	if e.err() != nil {
+		return nil, fmt.Errorf("invalid config of %s: %v", tg.Name, e)
+	}
+
+	return &TopologyGuest{Name: tg.Name, DependsOn: tg.DependsOn, Provision: pc, Guest: gc}, nil
+}
+
+// checkCycles returns an error if the guests' dependencies form a cycle.
+func (t *Topology) checkCycles() error {
+	deps := map[string][]string{}
+	for _, g := range t.Guests {
+		deps[g.Name] = g.DependsOn
+	}
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := map[string]int{}
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("dependency cycle: %s", strings.Join(append(path, name), " -> "))
+		case visited:
+			return nil
+		}
+		state[name] = visiting
+		for _, dep := range deps[name] {
+			if err := visit(dep, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		return nil
+	}
+
+	for _, g := range t.Guests {
+		if err := visit(g.Name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walk calls f for every guest of t, running up to parallel calls at a time.
+// A guest is passed to f once f has succeeded for all the guests it depends on,
+// or, if reverse is set, for all the guests that depend on it. Guests that can't
+// be passed to f because of a failure are reported in the returned error.
+func (t *Topology) walk(parallel int, reverse bool, f func(g *TopologyGuest) error) error {
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	before := map[string][]string{}
+	for _, g := range t.Guests {
+		if reverse {
+			for _, dep := range g.DependsOn {
+				before[dep] = append(before[dep], g.Name)
+			}
+		} else {
+			before[g.Name] = g.DependsOn
+		}
+	}
+
+	type result struct {
+		name string
+		err  error
+	}
+	results := make(chan result)
+	started := map[string]bool{}
+	done := map[string]bool{}
+	running := 0
+	var errs []string
+
+	for {
+		for i := range t.Guests {
+			g := &t.Guests[i]
+			if running >= parallel {
+				break
+			}
+			if started[g.Name] {
+				continue
+			}
+
+			ready := true
+			for _, name := range before[g.Name] {
+				if !done[name] {
+					ready = false
+				}
+			}
+			if !ready {
+				continue
+			}
+
+			started[g.Name] = true
+			running++
+			go func() {
+				results <- result{g.Name, f(g)}
+			}()
+		}
+
+		if running == 0 {
+			break
+		}
+
+		r := <-results
+		running--
+		if r.err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", r.name, r.err))
+		} else {
+			done[r.name] = true
+		}
+	}
+
+	sort.Strings(errs)
+
+	var skipped []string
+	for _, g := range t.Guests {
+		if !started[g.Name] {
+			skipped = append(skipped, g.Name)
+		}
+	}
+	if len(skipped) > 0 {
+		errs = append(errs, fmt.Sprintf("skipped %s", strings.Join(skipped, ", ")))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// guestUp brings up g: a guest that's running is left as is, one that's defined
+// but shut off is started, and one that's not defined is launched, after being
+// provisioned if its root image doesn't exist yet.
+func guestUp(l *libvirt.Libvirt, g *TopologyGuest, timeout time.Duration, out io.Writer) error {
+	if dom, err := l.DomainLookupByName(g.Name); err == nil {
+		state, _, err := l.DomainGetState(dom, 0)
+		if err != nil {
+			return fmt.Errorf("failed to get state of domain %s: %v", g.Name, err)
+		}
+		if libvirt.DomainState(state) == libvirt.DomainRunning {
+			fmt.Fprintf(out, "%s: already running\n", g.Name)
+			return nil
+		}
+
+		fmt.Fprintf(out, "%s: starting\n", g.Name)
+		return Start(l, g.Name)
+	}
+
+	pool, err := l.StoragePoolLookupByName(PoolName(g.Provision.StoragePool))
+	provisioned := false
+	if err == nil {
+		_, err := l.StorageVolLookupByName(pool, RootImgName(g.Name))
+		provisioned = err == nil
+	}
+
+	if !provisioned {
+		fmt.Fprintf(out, "%s: provisioning\n", g.Name)
+		pc, gc := *g.Provision, *g.Guest
+		if err := Provision(l, &pc, &gc); err != nil {
+			return fmt.Errorf("provision failed: %v", err)
+		}
+
+		status, err := WaitProvision(l, g.Name, timeout, nil)
+		if err != nil {
+			return fmt.Errorf("failed waiting for provisioning: %v", err)
+		}
+		if status > 0 {
+			return fmt.Errorf("provision script exited with status %d", status)
+		}
+	}
+
+	fmt.Fprintf(out, "%s: launching\n", g.Name)
+	gc := *g.Guest
+	gc.RootImgPath, gc.ConfigIsoPath, err = GuestImagePaths(l, PoolName(gc.StoragePool), g.Name)
+	if err != nil {
+		return fmt.Errorf("failed to compute image paths: %v", err)
+	}
+	if err := LaunchGuest(l, &gc); err != nil {
+		return fmt.Errorf("launch failed: %v", err)
+	}
+	return nil
+}
+
+// networkUp creates the network n, or starts it if it's defined but inactive.
+func networkUp(l *libvirt.Libvirt, n *NetworkConf, out io.Writer) error {
+	nw, err := l.NetworkLookupByName(n.Name)
+	if err != nil {
+		fmt.Fprintf(out, "network %s: creating\n", n.Name)
+		return CreateNetwork(l, n)
+	}
+
+	active, err := l.NetworkIsActive(nw)
+	if err != nil {
+		return fmt.Errorf("failed to get state of network %s: %v", n.Name, err)
+	}
+	if active != 0 {
+		fmt.Fprintf(out, "network %s: already active\n", n.Name)
+		return nil
+	}
+
+	fmt.Fprintf(out, "network %s: starting\n", n.Name)
+	if err := l.NetworkCreate(nw); err != nil {
+		return fmt.Errorf("failed to start network %s: %v", n.Name, err)
+	}
+	return nil
+}
+
+// Up brings up the networks of t, and then its guests in dependency order, up
+// to parallel at a time, skipping the ones that are already running. Guests that
+// need provisioning are given up to timeout for it. Progress is reported on out.
+func Up(l *libvirt.Libvirt, t *Topology, parallel int, timeout time.Duration, out io.Writer) error {
+	for i := range t.Networks {
+		if err := networkUp(l, &t.Networks[i], out); err != nil {
+			return err
+		}
+	}
+
+	return t.walk(parallel, false, func(g *TopologyGuest) error {
+		return guestUp(l, g, timeout, out)
+	})
+}
+
+// guestDown undefines g and deletes its volumes, whichever of them exist.
+func guestDown(l *libvirt.Libvirt, g *TopologyGuest, out io.Writer) error {
+	poolName := PoolName(g.Guest.StoragePool)
+	defined := false
+	if _, err := l.DomainLookupByName(g.Name); err == nil {
+		defined = true
+		poolName = GuestPool(l, g.Name)
+	}
+
+	provisioned := false
+	if pool, err := l.StoragePoolLookupByName(poolName); err == nil {
+		_, err := l.StorageVolLookupByName(pool, RootImgName(g.Name))
+		provisioned = err == nil
+	}
+
+	if !defined && !provisioned {
+		fmt.Fprintf(out, "%s: already down\n", g.Name)
+		return nil
+	}
+
+	if provisioned {
+		if err := CheckPurge(l, g.Name, poolName); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(out, "%s: purging\n", g.Name)
+	if defined {
+		if err := Undefine(l, g.Name); err != nil {
+			return err
+		}
+	}
+	if provisioned {
+		if err := Purge(l, g.Name, poolName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Down purges the guests of t in reverse dependency order, up to parallel at a
+// time, skipping the ones that don't exist, and then deletes its networks, if
+// all guests were purged. Progress is reported on out.
+func Down(l *libvirt.Libvirt, t *Topology, parallel int, out io.Writer) error {
+	err := t.walk(parallel, true, func(g *TopologyGuest) error {
+		return guestDown(l, g, out)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, n := range t.Networks {
+		if _, err := l.NetworkLookupByName(n.Name); err != nil {
+			fmt.Fprintf(out, "network %s: already deleted\n", n.Name)
+			continue
+		}
+
+		fmt.Fprintf(out, "network %s: deleting\n", n.Name)
+		if err := DeleteNetwork(l, n.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TopologyStatus returns the status of the guests of t, in the order they're
+// listed. Guests that aren't defined are reported as such.
+func TopologyStatus(l *libvirt.Libvirt, t *Topology) ([]GuestStatus, error) {
+	var guests []GuestStatus
+	for _, g := range t.Guests {
+		if _, err := l.DomainLookupByName(g.Name); err != nil {
+			guests = append(guests, GuestStatus{Name: g.Name, State: "undefined", Pool: PoolName(g.Guest.StoragePool)})
+			continue
+		}
+
+		st, err := Status(l, g.Name)
+		if err != nil {
+			return nil, err
+		}
+		guests = append(guests, *st)
+	}
+	return guests, nil
+}
@@ -0,0 +1,180 @@
+package virgo
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseTopology(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "ovs.sh"), []byte("apt-get install -y openvswitch-switch"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	topo, err := ParseTopology([]byte(`{
+  "defaults": {
+    "cloud_img_url": "https://cloud-images.ubuntu.com/releases/18.04/release/",
+    "cloud_img_name": "bionic.img",
+    "user": "guest",
+    "passwd": "guest",
+    "root_img_gb": 10,
+    "guest_memory_mb": 4096,
+    "guest_num_vcpus": 2,
+    "guest_num_sockets": 1,
+    "guest_num_cores_per_socket": 2,
+    "guest_num_threads_per_core": 1
+  },
+  "networks": [{"name": "lab", "address": "192.168.100.1/24"}],
+  "guests": [
+    {"name": "vswitch", "guest_num_vcpus": 4, "guest_num_cores_per_socket": 4, "provision_script": "ovs.sh"},
+    {"name": "vm1", "depends_on": ["vswitch"]}
+  ]
+}`), "json", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(topo.Guests) != 2 {
+		t.Fatalf("expected 2 guests, got %d", len(topo.Guests))
+	}
+
+	vswitch, vm1 := topo.Guests[0], topo.Guests[1]
+	if vswitch.Guest.NumVcpus != 4 || vm1.Guest.NumVcpus != 2 {
+		t.Errorf("guest options should override defaults, got %d and %d vCPUs", vswitch.Guest.NumVcpus, vm1.Guest.NumVcpus)
+	}
+	if vm1.Guest.MemoryMB != 4096 || vm1.Provision.CloudImgName != "bionic.img" {
+		t.Errorf("defaults not applied to %+v and %+v", vm1.Guest, vm1.Provision)
+	}
+	if vm1.Guest.Name != "vm1" || vm1.Provision.Name != "vm1" {
+		t.Errorf("guest name not set in its configs")
+	}
+	if vswitch.Provision.Provision != "apt-get install -y openvswitch-switch" {
+		t.Errorf("unexpected provision script %q", vswitch.Provision.Provision)
+	}
+	if len(vm1.DependsOn) != 1 || vm1.DependsOn[0] != "vswitch" {
+		t.Errorf("unexpected dependencies %v", vm1.DependsOn)
+	}
+	if len(topo.Networks) != 1 || topo.Networks[0].Name != "lab" {
+		t.Errorf("unexpected networks %+v", topo.Networks)
+	}
+}
+
+func TestParseTopologyErrors(t *testing.T) {
+	defaults := `"defaults": {
+    "cloud_img_url": "file:///var/cache/virgo/", "cloud_img_name": "bionic.img", "user": "guest", "passwd": "guest",
+    "root_img_gb": 10, "guest_memory_mb": 1024, "guest_num_vcpus": 1,
+    "guest_num_sockets": 1, "guest_num_cores_per_socket": 1, "guest_num_threads_per_core": 1
+  }`
+
+	tests := []struct {
+		guests string
+		err    string
+	}{
+		{`[{"guest_num_vcpus": 1}]`, "guests[0]: guest has no name"},
+		{`[{"name": "a", "guest_num_cpus": 2}]`, `guests[0]: failed to unmarshal guest options: json: unknown field "guest_num_cpus"`},
+		{`[{"name": "a", "guest_num_vcpus": 2}]`, "guests[0]: invalid config of a: guest_num_vcpus is 2, but guest_num_sockets x guest_num_cores_per_socket x guest_num_threads_per_core is 1 x 1 x 1 = 1"},
+		{`[{"name": "a"}, {"name": "a"}]`, "guests[1]: duplicate guest a"},
+		{`[{"name": "a", "depends_on": ["b"]}]`, "guest a depends on unknown guest b"},
+		{`[{"name": "a", "depends_on": ["b"]}, {"name": "b", "depends_on": ["a"]}]`, "dependency cycle: a -> b -> a"},
+	}
+
+	for _, test := range tests {
+		test.guests = fmt.Sprintf(`{%s, "guests": %s}`, defaults, test.guests)
+		_, err := ParseTopology([]byte(test.guests), "json", ".")
+		if err == nil || err.Error() != test.err {
+			t.Errorf("expected error %q for %s, got %v", test.err, test.guests, err)
+		}
+	}
+}
+
+func TestTopologyWalk(t *testing.T) {
+	// a <- b <- d, a <- c <- d, and e on its own
+	topo := &Topology{Guests: []TopologyGuest{
+		{Name: "d", DependsOn: []string{"b", "c"}},
+		{Name: "c", DependsOn: []string{"a"}},
+		{Name: "b", DependsOn: []string{"a"}},
+		{Name: "a"},
+		{Name: "e"},
+	}}
+
+	for _, reverse := range []bool{false, true} {
+		var mu sync.Mutex
+		var order []string
+		running, maxRunning := 0, 0
+		err := topo.walk(2, reverse, func(g *TopologyGuest) error {
+			mu.Lock()
+			order = append(order, g.Name)
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mu.Unlock()
+
+			time.Sleep(10 * time.Millisecond)
+
+			mu.Lock()
+			running--
+			mu.Unlock()
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pos := map[string]int{}
+		for i, name := range order {
+			pos[name] = i
+		}
+		if len(pos) != 5 {
+			t.Fatalf("expected all guests to be walked, got %v", order)
+		}
+		for _, g := range topo.Guests {
+			for _, dep := range g.DependsOn {
+				if (pos[dep] > pos[g.Name]) != reverse {
+					t.Errorf("unexpected order %v (reverse: %v)", order, reverse)
+				}
+			}
+		}
+		if maxRunning > 2 {
+			t.Errorf("expected at most 2 guests at a time, got %d", maxRunning)
+		}
+	}
+}
+
+func TestTopologyWalkFailure(t *testing.T) {
+	topo := &Topology{Guests: []TopologyGuest{
+		{Name: "a"},
+		{Name: "b", DependsOn: []string{"a"}},
+		{Name: "c"},
+	}}
+
+	var mu sync.Mutex
+	var walked []string
+	err := topo.walk(1, false, func(g *TopologyGuest) error {
+		mu.Lock()
+		walked = append(walked, g.Name)
+		mu.Unlock()
+		if g.Name == "a" {
+			return fmt.Errorf("boom")
+		}
+		return nil
+	})
+
+	if err == nil || err.Error() != "a: boom; skipped b" {
+		t.Errorf("unexpected error %v", err)
+	}
+	if strings.Join(walked, ",") != "a,c" {
+		t.Errorf("unexpected guests walked %v", walked)
+	}
+}
@@ -0,0 +1,356 @@
+package virgo
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ConfError lists the problems found in a configuration.
+type ConfError struct {
+	Problems []string
+}
+
+func (e *ConfError) Error() string {
+	return strings.Join(e.Problems, "; ")
+}
+
+// add records a problem, formatted as with fmt.Sprintf.
+func (e *ConfError) add(format string, args ...interface{}) {
+	e.Problems = append(e.Problems, fmt.Sprintf(format, args...))
+}
+
+// err returns e if it holds any problems, or nil.
+func (e *ConfError) err() error {
+	if len(e.Problems) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Validate checks the provisioning options for problems, which are all
+// reported in the returned *ConfError.
+func (p *ProvisionConf) Validate() error {
+	e := &ConfError{}
+
+	if p.CloudImgURL == "" {
+		e.add("cloud_img_url is required")
+	} else if u, err := url.Parse(p.CloudImgURL); err != nil {
+		e.add("cloud_img_url %q is invalid: %v", p.CloudImgURL, err)
+	} else if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "file" {
+		e.add("cloud_img_url %q should be an http, https or file URL", p.CloudImgURL)
+	}
+
+	if p.CloudImgName == "" {
+		e.add("cloud_img_name is required")
+	}
+
+	if p.User == "" {
+		e.add("user is required")
+	}
+
+	if p.Passwd == "" && !p.DisablePasswdAuth {
+		e.add("passwd is required, unless disable_passwd_auth is set")
+	}
+
+	if p.RootImgGB <= 0 {
+		e.add("root_img_gb should be positive, got %d", p.RootImgGB)
+	}
+
+	return e.err()
+}
+
+// Validate checks the launch options for problems, which are all reported in
+// the returned *ConfError.
+func (g *GuestConf) Validate() error {
+	e := &ConfError{}
+
+	if g.MemoryMB <= 0 {
+		e.add("guest_memory_mb should be positive, got %d", g.MemoryMB)
+	}
+
+	g.validateCPUs(e)
+	g.validateNUMA(e)
+	g.validateHugepages(e)
+	g.validateNUMATune(e)
+
+	if g.CPUTune != nil {
+		g.CPUTune.validate(e, g.NumVcpus)
+	}
+
+	// the PCI addresses of the root and config iso disks
+	addrs := map[DomainAddress]string{*pciAddress(7): "the root disk", *pciAddress(8): "the config iso disk"}
+	for i := range g.NetIfs {
+		g.NetIfs[i].validate(e, fmt.Sprintf("guest_net_ifs[%d]", i), addrs)
+	}
+
+	if g.SerialLogPath != "" && !g.SerialLog {
+		e.add("guest_serial_log_path is set, but guest_serial_log is not")
+	}
+
+	return e.err()
+}
+
+func (g *GuestConf) validateCPUs(e *ConfError) {
+	if g.NumVcpus <= 0 {
+		e.add("guest_num_vcpus should be positive, got %d", g.NumVcpus)
+		return
+	}
+
+	if g.NumSockets <= 0 || g.NumCoresPerSocket <= 0 || g.NumThreadsPerCore <= 0 {
+		e.add("guest_num_sockets, guest_num_cores_per_socket and guest_num_threads_per_core should be positive, got %d, %d and %d",
+			g.NumSockets, g.NumCoresPerSocket, g.NumThreadsPerCore)
+		return
+	}
+
+	if n := g.NumSockets * g.NumCoresPerSocket * g.NumThreadsPerCore; n != g.NumVcpus {
+		e.add("guest_num_vcpus is %d, but guest_num_sockets x guest_num_cores_per_socket x guest_num_threads_per_core is %d x %d x %d = %d",
+			g.NumVcpus, g.NumSockets, g.NumCoresPerSocket, g.NumThreadsPerCore, n)
+	}
+}
+
+func (g *GuestConf) validateNUMA(e *ConfError) {
+	if len(g.NUMANodes) == 0 {
+		return
+	}
+
+	ids := map[int]bool{}
+	owner := map[int]int{}
+	memory := 0
+	for i, n := range g.NUMANodes {
+		field := fmt.Sprintf("guest_numa_nodes[%d]", i)
+
+		if ids[n.Id] {
+			e.add("%s: duplicate id %d", field, n.Id)
+		}
+		ids[n.Id] = true
+
+		if n.MemoryMB <= 0 {
+			e.add("%s: memory_mb should be positive, got %d", field, n.MemoryMB)
+		}
+		memory += n.MemoryMB
+
+		cpus, err := ParseCPUSet(n.Cpus)
+		if err != nil {
+			e.add("%s: cpus: %v", field, err)
+			continue
+		}
+		for _, cpu := range cpus {
+			if g.NumVcpus > 0 && cpu >= g.NumVcpus {
+				e.add("%s: vCPU %d is out of range, the guest has %d vCPUs", field, cpu, g.NumVcpus)
+				continue
+			}
+			if other, ok := owner[cpu]; ok {
+				e.add("%s: vCPU %d is already in guest_numa_nodes[%d]", field, cpu, other)
+				continue
+			}
+			owner[cpu] = i
+		}
+	}
+
+	var missing []int
+	for cpu := 0; cpu < g.NumVcpus; cpu++ {
+		if _, ok := owner[cpu]; !ok {
+			missing = append(missing, cpu)
+		}
+	}
+	if len(missing) > 0 {
+		e.add("guest_numa_nodes don't cover vCPUs %s", FormatCPUSet(missing))
+	}
+
+	if memory != g.MemoryMB {
+		e.add("guest_numa_nodes' memory_mb adds up to %d, but guest_memory_mb is %d", memory, g.MemoryMB)
+	}
+}
+
+// hugepageUnits maps the units libvirt accepts for hugepage sizes (in lower
+// case, as they're case insensitive) to their size in bytes.
+var hugepageUnits = map[string]int{
+	"b": 1, "bytes": 1,
+	"k": 1 << 10, "kib": 1 << 10, "kb": 1000,
+	"m": 1 << 20, "mib": 1 << 20, "mb": 1000 * 1000,
+	"g": 1 << 30, "gib": 1 << 30, "gb": 1000 * 1000 * 1000,
+}
+
+func (g *GuestConf) validateHugepages(e *ConfError) {
+	if !g.HugepageSupport {
+		return
+	}
+
+	unit := g.HugepageSizeUnit
+	if unit == "" {
+		// libvirt's default
+		unit = "KiB"
+	}
+	scale, ok := hugepageUnits[strings.ToLower(unit)]
+	if !ok {
+		e.add("guest_hugepage_size_unit %q is invalid, expected e.g. K, M or G", g.HugepageSizeUnit)
+		return
+	}
+
+	size := g.HugepageSize * scale
+	if size != 2<<20 && size != 1<<30 {
+		e.add("guest_hugepage_size %d%s is invalid, x86_64 hugepages are 2M or 1G", g.HugepageSize, g.HugepageSizeUnit)
+		return
+	}
+
+	if g.MemoryMB > 0 && (g.MemoryMB<<20)%size != 0 {
+		e.add("guest_memory_mb %d is not a multiple of the hugepage size %d%s", g.MemoryMB, g.HugepageSize, g.HugepageSizeUnit)
+	}
+
+	if g.HugepageNodeSet != "" {
+		nodes, err := ParseCPUSet(g.HugepageNodeSet)
+		if err != nil {
+			e.add("guest_hugepage_node_set: %v", err)
+			return
+		}
+
+		ids := map[int]bool{}
+		for _, n := range g.NUMANodes {
+			ids[n.Id] = true
+		}
+		for _, n := range nodes {
+			if !ids[n] {
+				e.add("guest_hugepage_node_set refers to NUMA node %d, which is not in guest_numa_nodes", n)
+			}
+		}
+	}
+}
+
+func (n *NetIf) validate(e *ConfError, field string, addrs map[DomainAddress]string) {
+	if n.MacAddr != "" {
+		if _, err := net.ParseMAC(n.MacAddr); err != nil {
+			e.add("%s: mac_addr %q is invalid", field, n.MacAddr)
+		}
+	}
+
+	if n.Queues < 0 {
+		e.add("%s: queues should not be negative, got %d", field, n.Queues)
+	}
+
+	switch n.Model {
+	case "", "virtio":
+	case "e1000":
+		if n.Type == "vhostuser" {
+			e.add("%s: vhostuser interfaces only support the virtio model", field)
+		}
+		if n.Queues > 0 {
+			e.add("%s: queues are only supported by the virtio model", field)
+		}
+	default:
+		e.add("%s: model %q is unsupported, expected virtio or e1000", field, n.Model)
+	}
+
+	if n.PCIAddress != "" {
+		if addr, err := ParsePCIAddress(n.PCIAddress); err != nil {
+			e.add("%s: %v", field, err)
+		} else if owner, ok := addrs[*addr]; ok {
+			e.add("%s: pci_address %s is already used by %s", field, n.PCIAddress, owner)
+		} else {
+			addrs[*addr] = field
+		}
+	}
+
+	if n.Mode != "" && n.Type != "direct" {
+		e.add("%s: mode is only supported for direct interfaces", field)
+	}
+	if n.PortGroup != "" && n.Type != "network" {
+		e.add("%s: portgroup is only supported for network interfaces", field)
+	}
+
+	switch n.Type {
+	case "bridge":
+		if n.Bridge == "" {
+			e.add("%s: bridge is required for bridge interfaces", field)
+		}
+	case "network":
+		if n.Network == "" {
+			e.add("%s: network is required for network interfaces", field)
+		}
+	case "direct":
+		if n.Dev == "" {
+			e.add("%s: dev is required for direct interfaces", field)
+		}
+		switch n.Mode {
+		case "", "vepa", "bridge", "private", "passthrough":
+		default:
+			e.add("%s: mode %q is unsupported, expected vepa, bridge, private or passthrough", field, n.Mode)
+		}
+	case "user":
+		if n.Queues > 0 {
+			e.add("%s: queues are not supported for user interfaces", field)
+		}
+	case "vhostuser":
+		if n.MacAddr == "" {
+			e.add("%s: mac_addr is required for vhostuser interfaces", field)
+		}
+		if n.UnixSocketPath == "" {
+			e.add("%s: unix_socket_path is required for vhostuser interfaces", field)
+		}
+	default:
+		e.add("%s: type %q is unsupported, expected bridge, network, direct, user or vhostuser", field, n.Type)
+	}
+}
+
+// ParseCPUSet parses a libvirt cpuset, e.g. "0-3,^2,6", into the sorted list
+// of the IDs it contains.
+func ParseCPUSet(s string) ([]int, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, fmt.Errorf("empty cpuset")
+	}
+
+	included, excluded := map[int]bool{}, map[int]bool{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		set := included
+		if strings.HasPrefix(part, "^") {
+			set = excluded
+			part = part[1:]
+		}
+
+		from, to := part, part
+		if i := strings.Index(part, "-"); i >= 0 {
+			from, to = part[:i], part[i+1:]
+		}
+
+		first, err1 := strconv.Atoi(from)
+		last, err2 := strconv.Atoi(to)
+		if err1 != nil || err2 != nil || first < 0 || last < first {
+			return nil, fmt.Errorf("invalid cpuset %q", s)
+		}
+
+		for id := first; id <= last; id++ {
+			set[id] = true
+		}
+	}
+
+	var ids []int
+	for id := range included {
+		if !excluded[id] {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// FormatCPUSet formats the sorted IDs as a cpuset, e.g. "0-3,6".
+func FormatCPUSet(ids []int) string {
+	var parts []string
+	for i := 0; i < len(ids); {
+		j := i
+		for j+1 < len(ids) && ids[j+1] == ids[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, strconv.Itoa(ids[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", ids[i], ids[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
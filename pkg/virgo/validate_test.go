@@ -0,0 +1,258 @@
+package virgo
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var validConf = `{
+  "cloud_img_url": "https://cloud-images.ubuntu.com/releases/18.04/release/",
+  "cloud_img_name": "ubuntu-18.04-server-cloudimg-amd64.img",
+  "user": "guest",
+  "passwd": "guest",
+  "root_img_gb": 10,
+  "storage_pool": "default",
+
+  "guest_memory_mb": 4096,
+  "guest_num_vcpus": 8,
+  "guest_num_sockets": 2,
+  "guest_num_cores_per_socket": 2,
+  "guest_num_threads_per_core": 2,
+  "guest_numa_nodes": [
+    {"id": 0, "cpus": "0-3", "memory_mb": 2048 },
+    {"id": 1, "cpus": "4-7", "memory_mb": 2048 }
+  ],
+  "guest_hugepage_support": true,
+  "guest_hugepage_size": 2,
+  "guest_hugepage_size_unit": "M",
+  "guest_hugepage_node_set": "0",
+  "guest_net_ifs": [
+    {"type": "bridge", "bridge": "virbr0"},
+    {"type": "vhostuser", "mac_addr": "de:ad:be:ef:01:23", "unix_socket_path": "/tmp/vhu1", "queues": 2}
+  ]
+}`
+
+func TestParseConf(t *testing.T) {
+	pc, gc, err := ParseConf([]byte(validConf), "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pc.StoragePool != "default" || gc.StoragePool != "default" {
+		t.Errorf("storage_pool should be set in both configs")
+	}
+	if err := pc.Validate(); err != nil {
+		t.Errorf("unexpected provision config problems: %v", err)
+	}
+	if err := gc.Validate(); err != nil {
+		t.Errorf("unexpected guest config problems: %v", err)
+	}
+
+	_, _, err = ParseConf([]byte(`{"guest_memroy_mb": 1024}`), "json")
+	if err == nil || !strings.Contains(err.Error(), `unknown field "guest_memroy_mb"`) {
+		t.Errorf("expected unknown field error, got %v", err)
+	}
+}
+
+func TestGuestConfValidate(t *testing.T) {
+	_, gc, err := ParseConf([]byte(validConf), "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gc.NumSockets = 1
+	gc.NUMANodes[0].Cpus = "0-2"
+	gc.NUMANodes[1].MemoryMB = 1024
+	gc.HugepageSizeUnit = "K"
+	gc.NetIfs[1].MacAddr = ""
+	gc.NetIfs = append(gc.NetIfs, NetIf{Type: "macvtap"})
+
+	err = gc.Validate()
+	ce, ok := err.(*ConfError)
+	if !ok {
+		t.Fatalf("expected a *ConfError, got %v", err)
+	}
+
+	want := []string{
+		"guest_num_vcpus is 8, but guest_num_sockets x guest_num_cores_per_socket x guest_num_threads_per_core is 1 x 2 x 2 = 4",
+		"guest_numa_nodes don't cover vCPUs 3",
+		"guest_numa_nodes' memory_mb adds up to 3072, but guest_memory_mb is 4096",
+		"guest_hugepage_size 2K is invalid, x86_64 hugepages are 2M or 1G",
+		"guest_net_ifs[1]: mac_addr is required for vhostuser interfaces",
+		`guest_net_ifs[2]: type "macvtap" is unsupported, expected bridge, network, direct, user or vhostuser`,
+	}
+	if !reflect.DeepEqual(ce.Problems, want) {
+		t.Errorf("unexpected problems:\n%s\nexpected:\n%s", strings.Join(ce.Problems, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestNetIfValidate(t *testing.T) {
+	g := &GuestConf{
+		NetIfs: []NetIf{
+			{Type: "network", Network: "default", PortGroup: "lab", MacAddr: "52:54:00:00:00:01", PCIAddress: "00:0a.0"},
+			{Type: "direct", Dev: "ens1f0", Mode: "passthrough", Model: "e1000", PCIAddress: "0000:00:0b.0"},
+			{Type: "user", Model: "e1000"},
+			{Type: "network", PortGroup: "lab", Mode: "bridge", PCIAddress: "0000:00:0a.0"},
+			{Type: "direct", Dev: "ens1f0", Mode: "trunk", PCIAddress: "0000:00:07.0"},
+			{Type: "vhostuser", MacAddr: "52:54:00:00:00:02", UnixSocketPath: "/tmp/vhu1", Model: "e1000", Queues: 2},
+			{Type: "user", Model: "rtl8139", PCIAddress: "00:20.0"},
+		},
+	}
+	e := &ConfError{}
+	addrs := map[DomainAddress]string{*pciAddress(7): "the root disk"}
+	for i := range g.NetIfs {
+		g.NetIfs[i].validate(e, fmt.Sprintf("guest_net_ifs[%d]", i), addrs)
+	}
+
+	want := []string{
+		"guest_net_ifs[3]: pci_address 0000:00:0a.0 is already used by guest_net_ifs[0]",
+		"guest_net_ifs[3]: mode is only supported for direct interfaces",
+		"guest_net_ifs[3]: network is required for network interfaces",
+		"guest_net_ifs[4]: pci_address 0000:00:07.0 is already used by the root disk",
+		`guest_net_ifs[4]: mode "trunk" is unsupported, expected vepa, bridge, private or passthrough`,
+		"guest_net_ifs[5]: vhostuser interfaces only support the virtio model",
+		"guest_net_ifs[5]: queues are only supported by the virtio model",
+		`guest_net_ifs[6]: model "rtl8139" is unsupported, expected virtio or e1000`,
+		`guest_net_ifs[6]: invalid PCI address "00:20.0", expected e.g. 0000:00:0a.0`,
+	}
+	if !reflect.DeepEqual(e.Problems, want) {
+		t.Errorf("unexpected problems:\n%s\nexpected:\n%s", strings.Join(e.Problems, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestProvisionConfValidate(t *testing.T) {
+	p := &ProvisionConf{CloudImgURL: "ftp://example.com/", CloudImgName: "img", User: "guest", DisablePasswdAuth: true}
+
+	err := p.Validate()
+	if err == nil || err.Error() != `cloud_img_url "ftp://example.com/" should be an http, https or file URL; root_img_gb should be positive, got 0` {
+		t.Errorf("unexpected problems %v", err)
+	}
+}
+
+func TestCPUSet(t *testing.T) {
+	tests := []struct {
+		set  string
+		ids  []int
+		norm string
+	}{
+		{"0", []int{0}, "0"},
+		{"0-3,^2,6", []int{0, 1, 3, 6}, "0-1,3,6"},
+		{"^1,0-2", []int{0, 2}, "0,2"},
+		{"4-7, 0-3", []int{0, 1, 2, 3, 4, 5, 6, 7}, "0-7"},
+	}
+
+	for _, test := range tests {
+		ids, err := ParseCPUSet(test.set)
+		if err != nil {
+			t.Errorf("failed to parse %q: %v", test.set, err)
+			continue
+		}
+		if !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("expected %v for %q, got %v", test.ids, test.set, ids)
+		}
+		if norm := FormatCPUSet(ids); norm != test.norm {
+			t.Errorf("expected %q for %v, got %q", test.norm, ids, norm)
+		}
+	}
+
+	for _, set := range []string{"", "a", "3-1", "-1", "1,"} {
+		if _, err := ParseCPUSet(set); err == nil {
+			t.Errorf("expected error for %q", set)
+		}
+	}
+}
+
+func TestParseConfFormats(t *testing.T) {
+	yamlConf := `
+# provisioning options
+cloud_img_url: https://cloud-images.ubuntu.com/releases/18.04/release/
+cloud_img_name: ubuntu-18.04-server-cloudimg-amd64.img
+user: guest
+passwd: guest
+root_img_gb: 10
+
+# launch options
+guest_memory_mb: 1024
+guest_num_vcpus: 2
+guest_num_sockets: 1
+guest_num_cores_per_socket: 2
+guest_num_threads_per_core: 1
+guest_net_ifs:
+  - type: vhostuser   # DPDK port
+    mac_addr: de:ad:be:ef:01:23
+    unix_socket_path: /tmp/vhu1
+`
+	tomlConf := `
+# provisioning options
+cloud_img_url = "https://cloud-images.ubuntu.com/releases/18.04/release/"
+cloud_img_name = "ubuntu-18.04-server-cloudimg-amd64.img"
+user = "guest"
+passwd = "guest"
+root_img_gb = 10
+
+# launch options
+guest_memory_mb = 1024
+guest_num_vcpus = 2
+guest_num_sockets = 1
+guest_num_cores_per_socket = 2
+guest_num_threads_per_core = 1
+
+[[guest_net_ifs]]
+type = "vhostuser"  # DPDK port
+mac_addr = "de:ad:be:ef:01:23"
+unix_socket_path = "/tmp/vhu1"
+`
+
+	for format, conf := range map[string]string{"yaml": yamlConf, "toml": tomlConf} {
+		pc, gc, err := ParseConf([]byte(conf), format)
+		if err != nil {
+			t.Errorf("failed to parse %s config: %v", format, err)
+			continue
+		}
+		if err := pc.Validate(); err != nil {
+			t.Errorf("unexpected %s provision config problems: %v", format, err)
+		}
+		if err := gc.Validate(); err != nil {
+			t.Errorf("unexpected %s guest config problems: %v", format, err)
+		}
+		if len(gc.NetIfs) != 1 || gc.NetIfs[0].MacAddr != "de:ad:be:ef:01:23" {
+			t.Errorf("unexpected %s network interfaces %+v", format, gc.NetIfs)
+		}
+	}
+
+	if _, _, err := ParseConf([]byte("user: guest\nusr: guest\n"), "yaml"); err == nil || !strings.Contains(err.Error(), `unknown field "usr"`) {
+		t.Errorf("expected unknown field error, got %v", err)
+	}
+
+	for path, format := range map[string]string{"virgo.yml": "yaml", "a/virgo.YAML": "yaml", "virgo.toml": "toml", "virgo.json": "json", "virgo": "json"} {
+		if f := ConfFormat(path); f != format {
+			t.Errorf("expected format %s for %s, got %s", format, path, f)
+		}
+	}
+}
+
+func TestConfSchema(t *testing.T) {
+	schema, err := ConfSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the published schema is kept at the root of the repository
+	path := filepath.Join("..", "..", "virgo.schema.json")
+	if *update {
+		if err := ioutil.WriteFile(path, schema, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(schema) != string(want) {
+		t.Errorf("%s is out of date, run go test ./pkg/virgo -run ConfSchema -update", path)
+	}
+}
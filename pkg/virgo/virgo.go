@@ -2,14 +2,17 @@ package virgo
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/xml"
 	"fmt"
 	"io/ioutil"
-	"net"
-	"net/url"
+	"os"
 	"os/exec"
+	"os/user"
 	"path/filepath"
 	"regexp"
+	"strings"
 	"text/template"
 	"time"
 
@@ -23,11 +26,21 @@ instance-id: iid-%s;
 var userDataTmpl = `#cloud-config
 users:
   - name: {{.User}}
-    lock_passwd: false
     sudo: ALL=(ALL) NOPASSWD:ALL
     shell: /bin/bash
-    # this is the outcome of the command openssl passwd -1 -salt SaltSalt $PASSWORD
+{{- if .DisablePasswdAuth}}
+    lock_passwd: true
+{{- else}}
+    lock_passwd: false
+    # this is the outcome of the command openssl passwd -6 -salt <random salt> $PASSWORD
     passwd: {{.PasswdHash}}
+{{- end}}
+{{- if .AuthorizedKeys}}
+    ssh_authorized_keys:
+{{- range .AuthorizedKeys}}
+      - {{.}}
+{{- end}}
+{{- end}}
 
 write_files: 
 {{- if ne .Provision ""}}	
@@ -42,17 +55,25 @@ write_files:
     {{.Initd | indentByFour }}
 {{- end}}
 
+{{- if not .KeepCloudInit}}
+
 - path: /remove_cloud_init.sh 
   content: |
     #!/usr/bin/env bash
     echo 'datasource_list: [ None ]' | sudo -s tee /etc/cloud/cloud.cfg.d/90_dpkg.cfg
     sudo apt-get purge -y cloud-init
     sudo rm -rf /etc/cloud/; sudo rm -rf /var/lib/cloud/
+{{- end}}
 
 
-#password: {{.Passwd}}
+{{- if .DisablePasswdAuth}}
+
+ssh_pwauth: False
+{{- else}}
+
 chpasswd: { expire: False }
 ssh_pwauth: True
+{{- end}}
 
 # upgrade packages on startup
 package_upgrade: true
@@ -62,13 +83,15 @@ apt_upgrade: true
 
 runcmd:
 {{- if ne .Provision "" }}
-  - bash /provision.sh
+  - 'bash /provision.sh; echo "virgo-provision-status=$?" > /dev/ttyS0'
 {{- end}}
 {{- if ne .Initd "" }}  
   - chmod +x /etc/init.d/{{.Name}}
   - update-rc.d {{.Name}} defaults
 {{- end}}  
+{{- if not .KeepCloudInit}}
   - bash /remove_cloud_init.sh
+{{- end}}
   - shutdown
 
 power_state:
@@ -82,17 +105,41 @@ type ProvisionConf struct {
 	User         string `json:"user,omitempty"`
 	Passwd       string `json:"passwd,omitempty"`
 	RootImgGB    int    `json:"root_img_gb,omitempty"`
-	Provision    string
-	Initd        string
-	PasswdHash   string
+	// ImgCacheDir is where cloud images are downloaded to; see DefaultCacheDir.
+	ImgCacheDir string `json:"img_cache_dir,omitempty"`
+	StoragePool string `json:"storage_pool,omitempty"`
+	// SSHAuthorizedKeys holds public keys, or paths to public key files, to be
+	// authorized for User. If empty, ~/.ssh/id_*.pub are used.
+	SSHAuthorizedKeys []string `json:"ssh_authorized_keys,omitempty"`
+	DisablePasswdAuth bool     `json:"disable_passwd_auth,omitempty"`
+	// KeepCloudInit keeps cloud-init installed in the provisioned image, so that
+	// clones of the guest pick up their own hostname and identity.
+	KeepCloudInit bool `json:"keep_cloud_init,omitempty"`
+	// the following are set by virgo rather than in config files
+	Provision      string   `json:"-"`
+	Initd          string   `json:"-"`
+	PasswdHash     string   `json:"-"`
+	AuthorizedKeys []string `json:"-"`
 }
 
+// NetIf is a network interface of a guest: a tap device on a host bridge, a
+// port of a libvirt network (type network), a macvtap device on a host NIC (type
+// direct), user-mode networking (type user) or a vhost-user port of a vswitch.
 type NetIf struct {
 	Type           string `json:"type,omitempty"`
 	Bridge         string `json:"bridge,omitempty"`
+	Network        string `json:"network,omitempty"`
+	PortGroup      string `json:"portgroup,omitempty"`
+	Dev            string `json:"dev,omitempty"`
+	Mode           string `json:"mode,omitempty"`
 	MacAddr        string `json:"mac_addr,omitempty"`
 	UnixSocketPath string `json:"unix_socket_path,omitempty"`
 	Queues         int    `json:"queues,omitempty"`
+	// Model is the emulated NIC, virtio (the default) or e1000.
+	Model string `json:"model,omitempty"`
+	// PCIAddress is the guest PCI address of the interface, e.g. 0000:00:0a.0,
+	// instead of one picked by libvirt.
+	PCIAddress string `json:"pci_address,omitempty"`
 }
 
 type NUMANode struct {
@@ -103,6 +150,7 @@ type NUMANode struct {
 
 type GuestConf struct {
 	Name              string     `json:"name,omitempty"`
+	StoragePool       string     `json:"storage_pool,omitempty"`
 	RootImgPath       string     `json:"root_img_path,omitempty"`
 	ConfigIsoPath     string     `json:"config_iso_path,omitempty"`
 	MemoryMB          int        `json:"guest_memory_mb,omitempty"`
@@ -116,14 +164,18 @@ type GuestConf struct {
 	HugepageSizeUnit  string     `json:"guest_hugepage_size_unit,omitempty"`
 	HugepageNodeSet   string     `json:"guest_hugepage_node_set,omitempty"`
 	NetIfs            []NetIf    `json:"guest_net_ifs,omitempty"`
+	// SerialLog enables logging the serial console to SerialLogPath, which
+	// defaults to SerialLogName under the storage pool's directory.
+	SerialLog     bool   `json:"guest_serial_log,omitempty"`
+	SerialLogPath string `json:"guest_serial_log_path,omitempty"`
+	// CPUTune pins the guest's vCPUs, emulator and I/O threads to host CPUs.
+	CPUTune *CPUTune `json:"guest_cputune,omitempty"`
+	// NUMATune binds the guest's memory to host NUMA nodes.
+	NUMATune *NUMATune `json:"guest_numatune,omitempty"`
 }
 
-func createMetaDataFile(path, guest string) error {
-	s := fmt.Sprintf(metaDataFmt, guest)
-	if err := ioutil.WriteFile(path, []byte(s), 0644); err != nil {
-		return err
-	}
-	return nil
+func metaData(guest string) string {
+	return fmt.Sprintf(metaDataFmt, guest)
 }
 
 func indentByFour(s string) string {
@@ -146,179 +198,153 @@ func userData(p *ProvisionConf) (string, error) {
 	return xml.String(), nil
 }
 
-func createUserDataFile(path string, p *ProvisionConf) error {
-	cmd := exec.Command("openssl", "passwd", "-1", "-salt", "SaltSalt", p.Passwd)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("failed to executed %v: %v", cmd.Args, err)
+// homeDir returns the home directory of the invoking user, which under sudo
+// is SUDO_USER's rather than root's.
+func homeDir() (string, error) {
+	if name := os.Getenv("SUDO_USER"); name != "" {
+		if u, err := user.Lookup(name); err == nil {
+			return u.HomeDir, nil
+		}
 	}
+	return os.UserHomeDir()
+}
 
-	p.PasswdHash = string(out)
+func isPublicKey(s string) bool {
+	for _, prefix := range []string{"ssh-", "ecdsa-", "sk-"} {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
 
-	s, err := userData(p)
+// authorizedKeys resolves entries, each one either a public key or a path to
+// a public key file, into public keys. With no entries, ~/.ssh/id_*.pub are used.
+func authorizedKeys(entries []string) ([]string, error) {
+	home, err := homeDir()
 	if err != nil {
-		return fmt.Errorf("failed to create user-data string from config %+v: %v", p, err)
+		return nil, fmt.Errorf("failed to determine home directory: %v", err)
+	}
+
+	if len(entries) == 0 {
+		entries, err = filepath.Glob(filepath.Join(home, ".ssh", "id_*.pub"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var keys []string
+	for _, e := range entries {
+		if isPublicKey(e) {
+			keys = append(keys, e)
+			continue
+		}
+
+		path := e
+		if strings.HasPrefix(path, "~/") {
+			path = filepath.Join(home, path[2:])
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read public key file %s: %v", path, err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				keys = append(keys, line)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// provisionUserData returns the cloud-init user-data for p, after resolving
+// its ssh authorized keys and hashing its password.
+func provisionUserData(p *ProvisionConf) (string, error) {
+	keys, err := authorizedKeys(p.SSHAuthorizedKeys)
+	if err != nil {
+		return "", fmt.Errorf("failed to collect ssh authorized keys: %v", err)
+	}
+	p.AuthorizedKeys = keys
+
+	if p.DisablePasswdAuth {
+		if len(p.AuthorizedKeys) == 0 {
+			return "", fmt.Errorf("password authentication is disabled but no ssh authorized keys were found")
+		}
+	} else {
+		salt, err := cryptSalt()
+		if err != nil {
+			return "", fmt.Errorf("failed to generate password salt: %v", err)
+		}
+		// SHA-512 crypt, as in /etc/shadow
+		cmd := exec.Command("openssl", "passwd", "-6", "-salt", salt, p.Passwd)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("failed to executed %v: %v", cmd.Args, err)
+		}
+		p.PasswdHash = strings.TrimSpace(string(out))
 	}
 
-	if err := ioutil.WriteFile(path, []byte(s), 0644); err != nil {
-		return err
+	s, err := userData(p)
+	if err != nil {
+		return "", fmt.Errorf("failed to create user-data string from config %+v: %v", p, err)
 	}
-	return nil
+	return s, nil
 }
 
-func createConfigIsoImage(path string, p *ProvisionConf) error {
-	userDataPath := "user-data"
-	metaDataPath := "meta-data"
-	if err := createMetaDataFile(metaDataPath, p.Name); err != nil {
-		return fmt.Errorf("failed to create meta-data file for cloud-init: %v", err)
-	}
-	//defer os.Remove(metaDataPath)
+// cryptSaltChars are the characters of crypt(3) salts.
+const cryptSaltChars = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
 
-	if err := createUserDataFile(userDataPath, p); err != nil {
-		return fmt.Errorf("failed to create user-data file for cloud-init: %v", err)
+// cryptSalt returns a random salt of the maximum length of SHA-512 crypt.
+func cryptSalt() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
 	}
-	//defer os.Remove(userDataPath)
-
-	cmd := exec.Command("genisoimage", "-output", path, "-volid", "cidata", "-joliet", "-rock", userDataPath, metaDataPath)
-	_, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("failed to generated config iso: %v", err)
+	for i := range b {
+		b[i] = cryptSaltChars[int(b[i])%len(cryptSaltChars)]
 	}
-	return nil
+	return string(b), nil
 }
 
-func domXML(g *GuestConf) (string, error) {
-	t, err := template.New("domtmpl").
-		Funcs(template.FuncMap{"minusOne": minusOne}).
-		Parse(domTmpl)
+// configIsoImage returns a NoCloud seed image with the cloud-init configuration of p.
+func configIsoImage(p *ProvisionConf) ([]byte, error) {
+	ud, err := provisionUserData(p)
 	if err != nil {
-		return "", fmt.Errorf("failed to parse template: %v", err)
+		return nil, fmt.Errorf("failed to create user-data for cloud-init: %v", err)
 	}
+	return seedImage(p.Name, ud)
+}
 
-	var xml bytes.Buffer
-	if err := t.Execute(&xml, g); err != nil {
-		return "", fmt.Errorf("failed to execute template: %v", err)
-	}
+// cloneUserDataFmt gives a clone its own hostname and machine-id, from which
+// e.g. its DHCP client identifier is derived, and reboots it for the network
+// to be configured with them.
+var cloneUserDataFmt = `#cloud-config
+hostname: %s
 
-	return xml.String(), nil
-}
+bootcmd:
+  - [cloud-init-per, instance, virgo-machine-id, sh, -c, "rm -f /etc/machine-id && systemd-machine-id-setup"]
 
-func minusOne(x int) int {
-	return x - 1
-}
-
-var domTmpl = `
-<domain type='kvm'>
-    <name>{{.Name}}</name>
-    <!-- uuid>4a9b3f53-fa2a-47f3-a757-dd87720d9d1d</uuid -->
-    <memory unit='MiB'>{{.MemoryMB}}</memory>
-    <currentMemory unit='MiB'>{{.MemoryMB}}</currentMemory>
-
-    <!-- hugepages -->
-    {{- if .HugepageSupport}}
-    <memoryBacking>
-    <hugepages> <page size='{{.HugepageSize}}' unit='{{.HugepageSizeUnit}}' nodeset='{{.HugepageNodeSet}}'/> </hugepages>
-    </memoryBacking>
-    {{- end}}
-
-    <vcpu placement='static'>{{.NumVcpus}}</vcpu>
-    <!-- example -->
-    <!-- cputune><shares>4096</shares>
-    <vcpupin vcpu='0' cpuset='4'/>
-    <vcpupin vcpu='1' cpuset='5'/>
-    <emulatorpin cpuset='4,5'/></cputune -->
-
-    <os>
-    <type arch='x86_64' machine='pc'>hvm</type>
-    <boot dev='hd'/>
-    </os>
-      
-    <features>
-    <acpi/>
-    <apic/>
-    </features>
-
-    <!-- cpu topo -->
-    <cpu mode='host-model'>
-        <model fallback='allow'/>
-        <topology sockets='{{.NumSockets}}' cores='{{.NumCoresPerSocket}}' threads='{{.NumThreadsPerCore}}'/>
-        {{- $huge := .HugepageSupport}}
-        
-        <numa>
-            {{- range .NUMANodes}} 
-            <cell id='{{.Id}}' cpus='{{.Cpus}}' memory='{{.MemoryMB}}' unit='MiB' {{if $huge}}memAccess='shared'{{end}}/>
-            {{- end}}
-        </numa>
-    </cpu>
-
-    <on_poweroff>destroy</on_poweroff>
-    <on_reboot>restart</on_reboot>
-    <on_crash>destroy</on_crash>
-
-    <devices>
-        <emulator>/usr/bin/qemu-system-x86_64</emulator>
-        <!-- emulator>/usr/bin/kvm-spice</emulator -->
-
-        <disk type='file' device='disk'>
-        <driver name='qemu' type='qcow2'/>
-        <source file='{{.RootImgPath}}'/>
-        <target dev='vda' bus='virtio'/>
-        <address type='pci' domain='0x0000' bus='0x00' slot='0x07' function='0x0'/>
-        </disk>
-
-        <disk type='file' device='disk'>
-        <driver name='qemu' type='raw'/>
-        <source file='{{.ConfigIsoPath}}'/>
-        <target dev='vdb' bus='virtio'/>
-        <address type='pci' domain='0x0000' bus='0x00' slot='0x08' function='0x0'/>
-        </disk>
-
-        <!-- network interfaces -->
-        {{- range .NetIfs}} 
-        {{- if eq .Type "bridge"}}
-        <interface type='{{.Type}}'>
-            <source bridge='{{.Bridge}}' />
-            <model type='virtio' />
-        </interface>
-        {{- else if eq .Type "vhostuser"}}
-        <interface type='{{.Type}}'>
-            <mac address='{{.MacAddr}}'/>
-            <source type='unix' path='{{.UnixSocketPath}}' mode='client'/>
-            <model type='virtio' />
-            <driver queues='{{.Queues}}'>
-            <host mrg_rxbuf='on'/>
-            </driver>
-        </interface> 
-        {{- end}}
-        {{- end}}
-
-        <serial type='pty'><target port='0'/></serial>
-        <console type='pty'><target type='serial' port='0'/></console>
-    </devices>
-</domain>
+power_state:
+  mode: reboot
 `
 
-func downloadCloudImage(url string) error {
-	_, err := exec.Command("wget", "--no-clobber", url).CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("failed to download cloud image from %s: %v", url, err)
-	}
-	return nil
+// cloneConfigIsoImage returns a NoCloud seed image for the clone called guest.
+func cloneConfigIsoImage(guest string) ([]byte, error) {
+	return seedImage(guest, fmt.Sprintf(cloneUserDataFmt, guest))
 }
 
-func NewLibvirtConn() (*libvirt.Libvirt, error) {
-	sockpath := "/var/run/libvirt/libvirt-sock"
-	c, err := net.DialTimeout("unix", sockpath, 2*time.Second)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open libvirt socket %s: %v", sockpath, err)
+// seedImage returns a NoCloud seed image with the meta-data of guest and userData.
+func seedImage(guest, userData string) ([]byte, error) {
+	files := []isoFile{
+		{Name: "meta-data", Data: []byte(metaData(guest))},
+		{Name: "user-data", Data: []byte(userData)},
 	}
 
-	rpcconn := libvirt.New(c)
-	if err = rpcconn.Connect(); err != nil {
-		return nil, fmt.Errorf("failed to open connection with libvirt daemon: %v", err)
+	img, err := isoImage("cidata", files, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate config iso: %v", err)
 	}
-
-	return rpcconn, nil
+	return img, nil
 }
 
 type StoragePoolTarget struct {
@@ -328,6 +354,8 @@ type StoragePoolTarget struct {
 
 type StoragePoolDesc struct {
 	XMLName xml.Name          `xml:"pool"`
+	Type    string            `xml:"type,attr"`
+	Name    string            `xml:"name"`
 	Target  StoragePoolTarget `xml:"target"`
 }
 
@@ -345,6 +373,9 @@ func GetStoragePoolDesc(rpcconn *libvirt.Libvirt, p libvirt.StoragePool) (*Stora
 	return sp, nil
 }
 
+// GuestImagePaths returns the paths of guest's volumes under the directory of
+// a file-based pool. For other pools, the paths are empty, as volumes are
+// referenced by pool and name instead.
 func GuestImagePaths(l *libvirt.Libvirt, poolName, guest string) (rootImgPath, configIsoPath string, e error) {
 	pool, err := l.StoragePoolLookupByName(poolName)
 	if err != nil {
@@ -358,6 +389,10 @@ func GuestImagePaths(l *libvirt.Libvirt, poolName, guest string) (rootImgPath, c
 		return
 	}
 
+	if !pdesc.FileBased() {
+		return
+	}
+
 	if pdesc.Target.Path == "" {
 		e = fmt.Errorf("storage pool %s has empty target path", pool.Name)
 		return
@@ -370,64 +405,66 @@ func GuestImagePaths(l *libvirt.Libvirt, poolName, guest string) (rootImgPath, c
 }
 
 func createVolumes(l *libvirt.Libvirt, c *ProvisionConf) (rootImgPath, configIsoPath string, e error) {
-	baseu, err := url.Parse(c.CloudImgURL)
+	pool, pdesc, err := EnsurePool(l, c.StoragePool)
 	if err != nil {
-		e = err
+		e = fmt.Errorf("failed to get storage pool: %v", err)
 		return
 	}
 
-	imgu, err := url.Parse(c.CloudImgName)
+	rootImgPath, configIsoPath, err = GuestImagePaths(l, pool.Name, c.Name)
 	if err != nil {
-		e = err
+		e = fmt.Errorf("failed to compute guest image paths: %v", err)
 		return
 	}
 
-	url := baseu.ResolveReference(imgu).String()
-	if err := downloadCloudImage(url); err != nil {
-		e = fmt.Errorf("failed to download %s: %v", url, err)
-		return
+	// base images are cached in a file-based pool, so that they can back overlays
+	basePool := pool
+	if !pdesc.FileBased() {
+		if basePool, _, err = EnsurePool(l, ""); err != nil {
+			e = fmt.Errorf("failed to get storage pool %s for base images: %v", DefaultPool(), err)
+			return
+		}
 	}
 
-	rootImgPath, configIsoPath, err = GuestImagePaths(l, DefaultPool(), c.Name)
+	base, err := cachedBaseImage(l, basePool, c)
 	if err != nil {
-		e = fmt.Errorf("failed to compute guest image paths: %v", err)
+		e = fmt.Errorf("failed to cache base image %s: %v", c.CloudImgName, err)
 		return
 	}
 
-	if err := createConfigIsoImage(ConfigIsoName(c.Name), c); err != nil {
-		e = fmt.Errorf("failed to create configuration iso image %s: %v", ConfigIsoName(c.Name), err)
+	_, baseSize, _, err := l.StorageVolGetInfo(base)
+	if err != nil {
+		e = fmt.Errorf("failed to get info of storage volume %s: %v", base.Name, err)
 		return
 	}
-
-	if err := copyFile(ConfigIsoName(c.Name), configIsoPath); err != nil {
-		e = fmt.Errorf("failed to copy configuration iso under storage pool's directory: %v", err)
+	if gbToBytes(c.RootImgGB) < baseSize {
+		e = fmt.Errorf("root_img_gb is %d, but cloud image %s has a virtual size of %.1f GiB", c.RootImgGB, c.CloudImgName, float64(baseSize)/float64(1<<30))
 		return
 	}
 
-	if err := copyFile(c.CloudImgName, rootImgPath); err != nil {
-		e = fmt.Errorf("failed to copy cloud image under storage pool's directory: %v", err)
-		return
+	if pdesc.FileBased() {
+		_, err = createOverlay(l, pool, RootImgName(c.Name), base, gbToBytes(c.RootImgGB))
+	} else {
+		_, err = createClone(l, pool, RootImgName(c.Name), base, gbToBytes(c.RootImgGB), "")
 	}
-
-	pool, err := l.StoragePoolLookupByName(DefaultPool())
 	if err != nil {
-		e = fmt.Errorf("failed to lookup storage pool %s: %v", DefaultPool(), err)
+		e = fmt.Errorf("failed to create root image: %v", err)
 		return
 	}
 
-	if err := l.StoragePoolRefresh(pool, 0); err != nil {
-		e = err
+	img, err := configIsoImage(c)
+	if err != nil {
+		e = fmt.Errorf("failed to create configuration iso image: %v", err)
 		return
 	}
 
-	vol, err := l.StorageVolLookupByName(pool, RootImgName(c.Name))
-	if err != nil {
-		e = fmt.Errorf("failed to lookup storage volume %s under pool %s: %v", RootImgName(c.Name), pool.Name, err)
+	if _, err := uploadVolume(l, pool, ConfigIsoName(c.Name), "raw", bytes.NewReader(img), uint64(len(img)), nil); err != nil {
+		e = fmt.Errorf("failed to create configuration iso volume: %v", err)
 		return
 	}
 
-	if err := l.StorageVolResize(vol, uint64(1024*1024*1024*c.RootImgGB), 0); err != nil {
-		e = fmt.Errorf("failed to resize volume: %v", err)
+	if err := l.StoragePoolRefresh(pool, 0); err != nil {
+		e = err
 		return
 	}
 
@@ -435,14 +472,73 @@ func createVolumes(l *libvirt.Libvirt, c *ProvisionConf) (rootImgPath, configIso
 }
 
 func LaunchGuest(l *libvirt.Libvirt, g *GuestConf) error {
-	if g.ConfigIsoPath == "" || g.RootImgPath == "" {
-		return fmt.Errorf("empty root image path or config iso path")
+	if (g.ConfigIsoPath == "") != (g.RootImgPath == "") {
+		return fmt.Errorf("root image path and config iso path should be both set, or both empty for volumes of non file-based pools")
 	}
 
-	Undefine(l, g.Name)
+	if g.SerialLog && g.SerialLogPath == "" {
+		dir := filepath.Dir(g.RootImgPath)
+		if g.RootImgPath == "" {
+			dir = "/var/log/libvirt/qemu"
+		}
+		g.SerialLogPath = filepath.Join(dir, SerialLogName(g.Name))
+	}
+
+	// checked before a previous instance of the guest is undefined, whose own
+	// hugepages are counted as free
+	if err := PreflightErr(Preflight(l, nil, g)); err != nil {
+		return err
+	}
+
+	d, err := NewDomainDesc(g)
+	if err != nil {
+		return fmt.Errorf("failed to create domain XML for %s: %v", g.Name, err)
+	}
+
+	if g.NUMATune != nil {
+		caps, err := GetCapabilities(l)
+		if err != nil {
+			return err
+		}
+		if err := checkHostNUMA(caps, g); err != nil {
+			return fmt.Errorf("guest %s does not fit the host's NUMA nodes: %v", g.Name, err)
+		}
+	}
+
+	if g.CPUTune != nil && g.CPUTune.Auto {
+		if !isLocal(l) {
+			return fmt.Errorf("auto CPU pinning of %s reads the host's CPUs in sysfs, and is only supported on local hosts; pin its vCPUs explicitly", g.Name)
+		}
+		// held until the domain runs, and its CPUs are taken
+		cpuPinMu.Lock()
+		defer cpuPinMu.Unlock()
+
+		taken, err := pinnedCPUs(l, g.Name)
+		if err != nil {
+			return err
+		}
+		// pins are picked at every launch, leaving the recorded config as is
+		t, err := autoCPUTune(g.CPUTune, g.NumVcpus, taken)
+		if err != nil {
+			return fmt.Errorf("failed to pick CPUs for %s: %v", g.Name, err)
+		}
+		d.CPUTune = cputuneDesc(t)
+	}
+
+	xmlStr, err := d.Marshal()
+	if err != nil {
+		return fmt.Errorf("failed to create domain XML for %s: %v", g.Name, err)
+	}
+
+	// a previous instance of the guest is replaced
+	if _, err := l.DomainLookupByName(g.Name); err == nil {
+		if err := Undefine(l, g.Name); err != nil {
+			return err
+		}
+	} else if !libvirt.IsNotFound(err) {
+		return fmt.Errorf("failed to lookup domain %s: %v", g.Name, err)
+	}
 
-	//xmlStr := domXMLStr(guest, rootImgPath, configIsoPath, g)
-	xmlStr, err := domXML(g)
 	dom, err := l.DomainDefineXML(xmlStr)
 	if err != nil {
 		return fmt.Errorf("failed to define domain %s from xml: %v", g.Name, err)
@@ -463,11 +559,27 @@ func RootImgName(guest string) string {
 	return fmt.Sprintf("%s.virgo.img", guest)
 }
 
+func SerialLogName(guest string) string {
+	return fmt.Sprintf("%s.virgo.log", guest)
+}
+
+// BaseImgName returns the name of the pool volume caching the cloud image
+// called cloudImgName under cloudImgURL, that guests' root images are overlaid
+// on. Images of the same name from different URLs are cached apart.
+func BaseImgName(cloudImgURL, cloudImgName string) string {
+	sum := sha256.Sum256([]byte(cloudImgURL + cloudImgName))
+	return fmt.Sprintf("%s.%x.virgo.base", cloudImgName, sum[:4])
+}
+
 func ConfigIsoName(guest string) string {
 	return fmt.Sprintf("%s.virgo.iso", guest)
 }
 
 func Provision(l *libvirt.Libvirt, p *ProvisionConf, g *GuestConf) error {
+	if err := PreflightErr(Preflight(l, p, nil)); err != nil {
+		return err
+	}
+
 	var err error
 	g.RootImgPath, g.ConfigIsoPath, err = createVolumes(l, p)
 	if err != nil {
@@ -494,38 +606,91 @@ func Start(l *libvirt.Libvirt, guest string) error {
 	return nil
 }
 
-func Stop(l *libvirt.Libvirt, guest string) error {
-	dom, err := l.DomainLookupByName(guest)
+// DefaultStopTimeout is how long a guest is given to shut down gracefully
+// before it's destroyed when undefining it.
+const DefaultStopTimeout = 60 * time.Second
+
+// stopDomain shuts down dom and waits up to timeout for it to power off. If it
+// doesn't, it's destroyed if force is set, otherwise an error is returned.
+// With a zero timeout, stopDomain returns right after requesting the shutdown.
+func stopDomain(l *libvirt.Libvirt, dom libvirt.Domain, timeout time.Duration, force bool) error {
+	state, _, err := l.DomainGetState(dom, 0)
 	if err != nil {
-		return fmt.Errorf("failed to lookup domain %s: %v", guest, err)
+		return fmt.Errorf("failed to get state of domain %s: %v", dom.Name, err)
+	}
+	if libvirt.DomainState(state) == libvirt.DomainShutoff {
+		return nil
 	}
 
 	if err := l.DomainShutdown(dom); err != nil {
-		return fmt.Errorf("failed to shutdown domain %s: %v", guest, err)
+		if !force {
+			return fmt.Errorf("failed to shutdown domain %s: %v", dom.Name, err)
+		}
+	} else {
+		if timeout == 0 && !force {
+			return nil
+		}
+		err := WaitForState(l, dom, libvirt.DomainShutoff, timeout)
+		if err == nil {
+			return nil
+		}
+		if !force {
+			return err
+		}
+	}
+
+	if err := l.DomainDestroy(dom); err != nil {
+		return fmt.Errorf("failed to destroy domain %s: %v", dom.Name, err)
 	}
-
 	return nil
 }
 
+// Stop shuts down guest gracefully, waiting up to timeout for it to power off,
+// and destroys it if it's still running after that and force is set.
+func Stop(l *libvirt.Libvirt, guest string, timeout time.Duration, force bool) error {
+	dom, err := l.DomainLookupByName(guest)
+	if err != nil {
+		return fmt.Errorf("failed to lookup domain %s: %v", guest, err)
+	}
+
+	return stopDomain(l, dom, timeout, force)
+}
+
+// Undefine stops guest if it's running, giving it DefaultStopTimeout to shut
+// down before destroying it, and removes its definition along with any managed
+// save image and snapshot metadata.
 func Undefine(l *libvirt.Libvirt, guest string) error {
 	dom, err := l.DomainLookupByName(guest)
 	if err != nil {
 		return fmt.Errorf("failed to lookup domain %s: %v", guest, err)
 	}
 
-	l.DomainShutdown(dom)
+	if err := stopDomain(l, dom, DefaultStopTimeout, true); err != nil {
+		return fmt.Errorf("failed to stop domain %s: %v", guest, err)
+	}
 
-	if err := l.DomainUndefine(dom); err != nil {
+	flags := libvirt.DomainUndefineManagedSave | libvirt.DomainUndefineSnapshotsMetadata
+	if err := l.DomainUndefineFlags(dom, flags); err != nil {
 		return fmt.Errorf("failed to undefine domain %s: %v", dom.Name, err)
 	}
 
 	return nil
 }
 
-func Purge(l *libvirt.Libvirt, guest string) error {
-	pool, err := l.StoragePoolLookupByName(DefaultPool())
+// Purge deletes guest's snapshots and volumes, including any external snapshot
+// overlays, from the storage pool called poolName.
+func Purge(l *libvirt.Libvirt, guest, poolName string) error {
+	pool, err := l.StoragePoolLookupByName(PoolName(poolName))
 	if err != nil {
-		return fmt.Errorf("failed to lookup storage pool %s: %v", DefaultPool(), err)
+		return fmt.Errorf("failed to lookup storage pool %s: %v", PoolName(poolName), err)
+	}
+
+	if err := CheckPurge(l, guest, poolName); err != nil {
+		return err
+	}
+
+	if err := purgeSnapshots(l, pool, guest); err != nil {
+		return fmt.Errorf("failed to delete snapshots of %s: %v", guest, err)
 	}
 
 	rootVol, err := l.StorageVolLookupByName(pool, RootImgName(guest))
@@ -546,20 +711,16 @@ func Purge(l *libvirt.Libvirt, guest string) error {
 		return fmt.Errorf("failed to delete storage volume %s: %v", configVol.Name, err)
 	}
 
-	if err := l.StoragePoolRefresh(pool, 0); err != nil {
-		return err
+	// the serial console log is optional
+	if logVol, err := l.StorageVolLookupByName(pool, SerialLogName(guest)); err == nil {
+		if err := l.StorageVolDelete(logVol, 0); err != nil {
+			return fmt.Errorf("failed to delete storage volume %s: %v", logVol.Name, err)
+		}
 	}
 
-	return nil
-}
-
-func copyFile(srcPath, dstPath string) error {
-	in, err := ioutil.ReadFile(srcPath)
-	if err != nil {
-		return err
-	}
-	if err := ioutil.WriteFile(dstPath, in, 0644); err != nil {
+	if err := l.StoragePoolRefresh(pool, 0); err != nil {
 		return err
 	}
+
 	return nil
 }
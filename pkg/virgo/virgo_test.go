@@ -1,6 +1,10 @@
 package virgo
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -47,7 +51,7 @@ func TestDomXMLStr(t *testing.T) {
 	t.Logf("Domain XML string: %s", xml)
 }
 
-func TestCreateUserDataFile(t *testing.T) {
+func TestProvisionUserData(t *testing.T) {
 	p := &ProvisionConf{Name: "test",
 		CloudImgURL:  "https://cloud-images.ubuntu.com/releases/16.04/release/",
 		CloudImgName: "ubuntu-16.04-server-cloudimg-amd64-disk1.img",
@@ -61,7 +65,76 @@ echo Hello again`
 
 	p.Initd = p.Provision
 
-	if err := createUserDataFile("user-data", p); err != nil {
+	if _, err := provisionUserData(p); err != nil {
 		t.Fatal(err)
 	}
+
+	// SHA-512 crypt, salted anew for every guest
+	hash := p.PasswdHash
+	if !strings.HasPrefix(hash, "$6$") || strings.ContainsAny(hash, " \n") {
+		t.Errorf("unexpected password hash %q", hash)
+	}
+	if _, err := provisionUserData(p); err != nil {
+		t.Fatal(err)
+	}
+	if p.PasswdHash == hash {
+		t.Errorf("password hashed with the same salt twice")
+	}
+}
+
+func TestUserDataAuthorizedKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyPath := filepath.Join(dir, "id_ed25519.pub")
+	if err := ioutil.WriteFile(keyPath, []byte("ssh-ed25519 AAAAfile user@host\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := authorizedKeys([]string{"ssh-rsa AAAAinline user@host", keyPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[1] != "ssh-ed25519 AAAAfile user@host" {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+
+	p := &ProvisionConf{Name: "test", User: "nfvsap", DisablePasswdAuth: true, AuthorizedKeys: keys}
+	s, err := userData(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"lock_passwd: true", "ssh_pwauth: False", "      - ssh-rsa AAAAinline user@host"} {
+		if !strings.Contains(s, want) {
+			t.Errorf("user-data does not contain %q:\n%s", want, s)
+		}
+	}
+	if strings.Contains(s, "    passwd:") {
+		t.Errorf("user-data contains a password:\n%s", s)
+	}
+}
+
+func TestProvisionStatus(t *testing.T) {
+	p := &ProvisionConf{Name: "test", User: "nfvsap", Provision: "#!/bin/bash\nexit 3"}
+	s, err := userData(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(s, `echo "virgo-provision-status=$?" > /dev/ttyS0`) {
+		t.Fatalf("user-data does not report the provision script's status:\n%s", s)
+	}
+
+	for log, want := range map[string]int{
+		"[  OK  ] Started foo\r\nvirgo-provision-status=0\r\n":   0,
+		"Cloud-init v. 19.1 running\nvirgo-provision-status=3\n": 3,
+		"Cloud-init v. 19.1 finished\n":                          -1,
+	} {
+		if got := provisionStatus([]byte(log)); got != want {
+			t.Errorf("provisionStatus(%q) = %d, want %d", log, got, want)
+		}
+	}
 }
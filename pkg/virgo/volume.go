@@ -0,0 +1,281 @@
+package virgo
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"text/template"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+var volTmpl = `
+<volume>
+    <name>{{.Name}}</name>
+    <capacity unit='bytes'>{{.Capacity}}</capacity>
+    {{- if .Format}}
+    <target>
+        <format type='{{.Format}}'/>
+    </target>
+    {{- end}}
+    {{- if .BackingPath}}
+    <backingStore>
+        <path>{{.BackingPath}}</path>
+        <format type='{{.BackingFormat}}'/>
+    </backingStore>
+    {{- end}}
+</volume>
+`
+
+type volSpec struct {
+	Name     string
+	Capacity uint64
+	// Format is left to the pool's default if empty.
+	Format string
+	// BackingPath makes the volume an overlay of the backing volume, if set.
+	BackingPath   string
+	BackingFormat string
+}
+
+func volXML(v *volSpec) (string, error) {
+	t, err := template.New("voltmpl").Parse(volTmpl)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse template: %v", err)
+	}
+
+	var xml bytes.Buffer
+	if err := t.Execute(&xml, v); err != nil {
+		return "", fmt.Errorf("failed to execute template: %v", err)
+	}
+
+	return xml.String(), nil
+}
+
+func gbToBytes(gb int) uint64 {
+	return uint64(gb) * 1024 * 1024 * 1024
+}
+
+// StorageVolDesc models the subset of libvirt's storage volume XML that virgo
+// reads.
+type StorageVolDesc struct {
+	XMLName      xml.Name                `xml:"volume"`
+	Name         string                  `xml:"name"`
+	Target       StorageVolTarget        `xml:"target"`
+	BackingStore *StorageVolBackingStore `xml:"backingStore"`
+}
+
+type StorageVolFormat struct {
+	Type string `xml:"type,attr"`
+}
+
+type StorageVolTarget struct {
+	Path   string           `xml:"path"`
+	Format StorageVolFormat `xml:"format"`
+}
+
+type StorageVolBackingStore struct {
+	Path   string           `xml:"path"`
+	Format StorageVolFormat `xml:"format"`
+}
+
+// ParseStorageVolDesc parses a libvirt storage volume XML document.
+func ParseStorageVolDesc(s string) (*StorageVolDesc, error) {
+	v := &StorageVolDesc{}
+	if err := xml.Unmarshal([]byte(s), v); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal storage volume's XML: %v", err)
+	}
+	return v, nil
+}
+
+// GetStorageVolDesc returns the description of an existing storage volume.
+func GetStorageVolDesc(l *libvirt.Libvirt, vol libvirt.StorageVol) (*StorageVolDesc, error) {
+	xmldesc, err := l.StorageVolGetXMLDesc(vol, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get storage volume's %s XML: %v", vol.Name, err)
+	}
+	return ParseStorageVolDesc(xmldesc)
+}
+
+// deleteVolume deletes the volume called name from pool, if it exists.
+func deleteVolume(l *libvirt.Libvirt, pool libvirt.StoragePool, name string) error {
+	vol, err := l.StorageVolLookupByName(pool, name)
+	if err != nil {
+		return nil
+	}
+	if err := l.StorageVolDelete(vol, 0); err != nil {
+		return fmt.Errorf("failed to delete existing storage volume %s: %v", name, err)
+	}
+	return nil
+}
+
+// qcow2Magic starts the header of qcow2 images.
+var qcow2Magic = []byte{'Q', 'F', 'I', 0xfb}
+
+// imageFormat returns the format of the disk image read from r: qcow2, or raw
+// for anything else, e.g. the .img cloud images of some distributions.
+func imageFormat(r io.Reader) (string, error) {
+	magic := make([]byte, len(qcow2Magic))
+	if _, err := io.ReadFull(r, magic); err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", fmt.Errorf("failed to read image header: %v", err)
+	}
+	if bytes.Equal(magic, qcow2Magic) {
+		return "qcow2", nil
+	}
+	return "raw", nil
+}
+
+var baseImgMu sync.Mutex
+
+// cachedBaseImage returns the pool's base image volume for the cloud image of c,
+// downloading the image and adding it to the pool first if it's not cached yet.
+func cachedBaseImage(l *libvirt.Libvirt, pool libvirt.StoragePool, c *ProvisionConf) (libvirt.StorageVol, error) {
+	// guests provisioned in parallel share the download and upload
+	baseImgMu.Lock()
+	defer baseImgMu.Unlock()
+
+	name := BaseImgName(c.CloudImgURL, c.CloudImgName)
+	if vol, err := l.StorageVolLookupByName(pool, name); err == nil {
+		return vol, nil
+	}
+
+	cacheDir := c.ImgCacheDir
+	if cacheDir == "" {
+		cacheDir = DefaultCacheDir()
+	}
+
+	d := &Downloader{CacheDir: cacheDir, Progress: os.Stderr}
+	imgPath, err := d.Fetch(c.CloudImgURL, c.CloudImgName)
+	if err != nil {
+		return libvirt.StorageVol{}, fmt.Errorf("failed to fetch cloud image: %v", err)
+	}
+
+	f, err := os.Open(imgPath)
+	if err != nil {
+		return libvirt.StorageVol{}, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return libvirt.StorageVol{}, err
+	}
+
+	format, err := imageFormat(f)
+	if err != nil {
+		return libvirt.StorageVol{}, fmt.Errorf("failed to detect format of cloud image %s: %v", imgPath, err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return libvirt.StorageVol{}, err
+	}
+
+	if _, err := uploadVolume(l, pool, name, format, f, uint64(fi.Size()), os.Stderr); err != nil {
+		return libvirt.StorageVol{}, fmt.Errorf("failed to upload cloud image to storage pool %s: %v", pool.Name, err)
+	}
+
+	if err := l.StoragePoolRefresh(pool, 0); err != nil {
+		return libvirt.StorageVol{}, fmt.Errorf("failed to refresh storage pool %s: %v", pool.Name, err)
+	}
+
+	vol, err := l.StorageVolLookupByName(pool, name)
+	if err != nil {
+		return libvirt.StorageVol{}, fmt.Errorf("failed to lookup storage volume %s under pool %s: %v", name, pool.Name, err)
+	}
+	return vol, nil
+}
+
+// createOverlay creates a qcow2 volume called name with a capacity of capacity
+// bytes, backed by the base volume, in the format recorded on it. Any existing
+// volume with the same name is deleted first.
+func createOverlay(l *libvirt.Libvirt, pool libvirt.StoragePool, name string, base libvirt.StorageVol, capacity uint64) (libvirt.StorageVol, error) {
+	if err := deleteVolume(l, pool, name); err != nil {
+		return libvirt.StorageVol{}, err
+	}
+
+	basePath, err := l.StorageVolGetPath(base)
+	if err != nil {
+		return libvirt.StorageVol{}, fmt.Errorf("failed to get path of storage volume %s: %v", base.Name, err)
+	}
+
+	bdesc, err := GetStorageVolDesc(l, base)
+	if err != nil {
+		return libvirt.StorageVol{}, err
+	}
+	baseFormat := bdesc.Target.Format.Type
+	if baseFormat == "" {
+		baseFormat = "raw"
+	}
+
+	xmlStr, err := volXML(&volSpec{
+		Name:          name,
+		Capacity:      capacity,
+		Format:        "qcow2",
+		BackingPath:   basePath,
+		BackingFormat: baseFormat,
+	})
+	if err != nil {
+		return libvirt.StorageVol{}, err
+	}
+
+	vol, err := l.StorageVolCreateXML(pool, xmlStr, 0)
+	if err != nil {
+		return libvirt.StorageVol{}, fmt.Errorf("failed to create storage volume %s from xml: %v", name, err)
+	}
+	return vol, nil
+}
+
+// createClone creates a volume called name of the given format (or the pool's
+// default, if empty) with a capacity of capacity bytes in pool, holding a full
+// copy of the base volume, which libvirt converts as needed. It's used for pools
+// that can't hold qcow2 overlays, e.g. LVM or ZFS pools, and for full clones of
+// guests. Any existing volume with the same name is deleted first.
+func createClone(l *libvirt.Libvirt, pool libvirt.StoragePool, name string, base libvirt.StorageVol, capacity uint64, format string) (libvirt.StorageVol, error) {
+	if err := deleteVolume(l, pool, name); err != nil {
+		return libvirt.StorageVol{}, err
+	}
+
+	xmlStr, err := volXML(&volSpec{Name: name, Capacity: capacity, Format: format})
+	if err != nil {
+		return libvirt.StorageVol{}, err
+	}
+
+	vol, err := l.StorageVolCreateXMLFrom(pool, xmlStr, base, 0)
+	if err != nil {
+		return libvirt.StorageVol{}, fmt.Errorf("failed to create storage volume %s from %s: %v", name, base.Name, err)
+	}
+	return vol, nil
+}
+
+// uploadVolume creates a volume called name in pool and streams size bytes
+// from r into it through libvirt, so the pool may well be remote. The upload's
+// progress is rendered on progress, if not nil. Any existing volume with the
+// same name is deleted first.
+func uploadVolume(l *libvirt.Libvirt, pool libvirt.StoragePool, name, format string, r io.Reader, size uint64, progress io.Writer) (libvirt.StorageVol, error) {
+	if err := deleteVolume(l, pool, name); err != nil {
+		return libvirt.StorageVol{}, err
+	}
+
+	xmlStr, err := volXML(&volSpec{Name: name, Capacity: size, Format: format})
+	if err != nil {
+		return libvirt.StorageVol{}, err
+	}
+
+	vol, err := l.StorageVolCreateXML(pool, xmlStr, 0)
+	if err != nil {
+		return libvirt.StorageVol{}, fmt.Errorf("failed to create storage volume %s from xml: %v", name, err)
+	}
+
+	if progress != nil {
+		pw := &progressWriter{out: progress, name: name, total: int64(size)}
+		r = io.TeeReader(r, pw)
+		defer pw.finish()
+	}
+
+	if err := l.StorageVolUpload(vol, r, 0, size, 0); err != nil {
+		l.StorageVolDelete(vol, 0)
+		return libvirt.StorageVol{}, fmt.Errorf("failed to upload storage volume %s: %v", name, err)
+	}
+	return vol, nil
+}
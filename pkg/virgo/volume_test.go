@@ -0,0 +1,83 @@
+package virgo
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+func TestVolXML(t *testing.T) {
+	s, err := volXML(&volSpec{
+		Name:          "foo.virgo.img",
+		Capacity:      gbToBytes(10),
+		Format:        "qcow2",
+		BackingPath:   "/var/lib/libvirt/images/base.img.virgo.base",
+		BackingFormat: "qcow2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := struct {
+		Name        string `xml:"name"`
+		Capacity    uint64 `xml:"capacity"`
+		BackingPath string `xml:"backingStore>path"`
+	}{}
+	if err := xml.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatalf("invalid volume XML %s: %v", s, err)
+	}
+	if v.Name != "foo.virgo.img" || v.Capacity != 10<<30 || v.BackingPath != "/var/lib/libvirt/images/base.img.virgo.base" {
+		t.Errorf("unexpected volume %+v from XML %s", v, s)
+	}
+}
+
+func TestVolXMLNoBackingStore(t *testing.T) {
+	s, err := volXML(&volSpec{Name: "foo.virgo.iso", Capacity: 55296})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := struct {
+		Format       *struct{} `xml:"target>format"`
+		BackingStore *struct{} `xml:"backingStore"`
+	}{}
+	if err := xml.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatalf("invalid volume XML %s: %v", s, err)
+	}
+	if v.Format != nil || v.BackingStore != nil {
+		t.Errorf("unexpected format or backing store in volume XML %s", s)
+	}
+}
+
+func TestImageFormat(t *testing.T) {
+	tests := []struct {
+		header []byte
+		format string
+	}{
+		{[]byte{'Q', 'F', 'I', 0xfb, 0, 0, 0, 3}, "qcow2"},
+		{[]byte{0xeb, 0x63, 0x90, 0x00}, "raw"},
+		{[]byte{'Q', 'F'}, "raw"},
+		{nil, "raw"},
+	}
+	for _, tt := range tests {
+		format, err := imageFormat(bytes.NewReader(tt.header))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if format != tt.format {
+			t.Errorf("expected %s for header %x, got %s", tt.format, tt.header, format)
+		}
+	}
+}
+
+func TestBaseImgName(t *testing.T) {
+	bionic := BaseImgName("https://cloud-images.ubuntu.com/releases/18.04/release/", "disk.img")
+	focal := BaseImgName("https://cloud-images.ubuntu.com/releases/20.04/release/", "disk.img")
+	if bionic == focal {
+		t.Errorf("images of the same name from different URLs share base volume %s", bionic)
+	}
+	if !strings.HasPrefix(bionic, "disk.img.") || !strings.HasSuffix(bionic, ".virgo.base") {
+		t.Errorf("unexpected base volume name %s", bionic)
+	}
+}
@@ -0,0 +1,104 @@
+package virgo
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+const pollInterval = 500 * time.Millisecond
+
+// provisionStatusRe matches the line that the guest writes to its serial
+// console once the provision script has run; see userDataTmpl.
+var provisionStatusRe = regexp.MustCompile(`virgo-provision-status=(\d+)`)
+
+// WaitForState polls the state of dom until it reaches state or timeout elapses.
+func WaitForState(l *libvirt.Libvirt, dom libvirt.Domain, state libvirt.DomainState, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		s, _, err := l.DomainGetState(dom, 0)
+		if err != nil {
+			return fmt.Errorf("failed to get state of domain %s: %v", dom.Name, err)
+		}
+		if libvirt.DomainState(s) == state {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %v waiting for domain %s to become %s, it's %s",
+				timeout, dom.Name, domainStateString(state), domainStateString(libvirt.DomainState(s)))
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// lockedBuffer is a bytes.Buffer safe for concurrent use.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+// provisionStatus returns the exit status of the provision script reported
+// in a serial console log, or -1 if none is reported.
+func provisionStatus(log []byte) int {
+	m := provisionStatusRe.FindSubmatch(log)
+	if m == nil {
+		return -1
+	}
+	status, err := strconv.Atoi(string(m[1]))
+	if err != nil {
+		return -1
+	}
+	return status
+}
+
+// WaitProvision waits for a guest that's being provisioned to shut itself off,
+// copying its serial console output to console (if not nil). It returns the exit
+// status of the provision script, or -1 if the guest didn't report one, e.g.
+// because no provision script was given.
+func WaitProvision(l *libvirt.Libvirt, guest string, timeout time.Duration, console io.Writer) (int, error) {
+	dom, err := l.DomainLookupByName(guest)
+	if err != nil {
+		return -1, fmt.Errorf("failed to lookup domain %s: %v", guest, err)
+	}
+
+	if console == nil {
+		console = ioutil.Discard
+	}
+
+	log := &lockedBuffer{}
+	done := make(chan error, 1)
+	go func() {
+		done <- l.DomainOpenConsole(dom, nil, io.MultiWriter(console, log), 0)
+	}()
+
+	if err := WaitForState(l, dom, libvirt.DomainShutoff, timeout); err != nil {
+		return -1, err
+	}
+
+	// the console stream ends once the guest is off
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+	}
+
+	return provisionStatus(log.Bytes()), nil
+}